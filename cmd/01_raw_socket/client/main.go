@@ -50,14 +50,14 @@ func makeRequest(clientID int, method string, params []int) error {
 
 	log.Printf("[Client %d] Sending request: %s.%s(%v)", clientID, req.Service, req.Method, req.Params)
 
-	// Send request
-	if err := socket.WriteJSON(conn, req); err != nil {
+	// Send request as a length-prefixed frame
+	if err := socket.NewFrameWriter(conn).WriteJSON(req); err != nil {
 		return fmt.Errorf("write error: %w", err)
 	}
 
 	// Wait for response
 	var resp Response
-	if err := socket.ReadJSON(conn, &resp); err != nil {
+	if err := socket.NewFrameReader(conn).ReadJSON(&resp); err != nil {
 		return fmt.Errorf("read error: %w", err)
 	}
 
@@ -39,12 +39,16 @@ func handleConnection(conn net.Conn, connID int) {
 
 	log.Printf("[Connection %d] New connection from %s", connID, conn.RemoteAddr())
 
+	// Length-prefixed framing keeps message boundaries intact across reads
+	reader := socket.NewFrameReader(conn)
+	writer := socket.NewFrameWriter(conn)
+
 	for {
 		// Set read deadline to avoid hanging forever
 		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
 
 		var req Request
-		if err := socket.ReadJSON(conn, &req); err != nil {
+		if err := reader.ReadJSON(&req); err != nil {
 			log.Printf("[Connection %d] Read error: %v", connID, err)
 			return
 		}
@@ -55,7 +59,7 @@ func handleConnection(conn net.Conn, connID int) {
 		resp := processRequest(req)
 
 		// Send response
-		if err := socket.WriteJSON(conn, resp); err != nil {
+		if err := writer.WriteJSON(resp); err != nil {
 			log.Printf("[Connection %d] Write error: %v", connID, err)
 			return
 		}
@@ -0,0 +1,57 @@
+// Code generated by rpcgen; DO NOT EDIT.
+
+package main
+
+import (
+	"context"
+
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/rpc"
+)
+
+// CalculatorClient is a typed client for the CalculatorService service
+type CalculatorClient struct {
+	invoker rpc.Invoker
+}
+
+// NewCalculatorClient wraps invoker, typically an *rpc.Client
+func NewCalculatorClient(invoker rpc.Invoker) *CalculatorClient {
+	return &CalculatorClient{invoker: invoker}
+}
+
+// Add calls CalculatorService.Add
+func (c *CalculatorClient) Add(ctx context.Context, a int, b int) (int, error) {
+	var reply int
+	err := c.invoker.Invoke(ctx, "CalculatorService", "Add", &reply, a, b)
+	return reply, err
+}
+
+// Multiply calls CalculatorService.Multiply
+func (c *CalculatorClient) Multiply(ctx context.Context, a int, b int) (int, error) {
+	var reply int
+	err := c.invoker.Invoke(ctx, "CalculatorService", "Multiply", &reply, a, b)
+	return reply, err
+}
+
+// Subtract calls CalculatorService.Subtract
+func (c *CalculatorClient) Subtract(ctx context.Context, a int, b int) (int, error) {
+	var reply int
+	err := c.invoker.Invoke(ctx, "CalculatorService", "Subtract", &reply, a, b)
+	return reply, err
+}
+
+// Divide calls CalculatorService.Divide
+func (c *CalculatorClient) Divide(ctx context.Context, a int, b int) (int, error) {
+	var reply int
+	err := c.invoker.Invoke(ctx, "CalculatorService", "Divide", &reply, a, b)
+	return reply, err
+}
+
+// Fibonacci opens the CalculatorService.Fibonacci stream
+func (c *CalculatorClient) Fibonacci(ctx context.Context, n int) (*rpc.ClientStream, error) {
+	return rpc.OpenStream(ctx, c.invoker, "CalculatorService", "Fibonacci", n)
+}
+
+// RunningSum opens the CalculatorService.RunningSum stream
+func (c *CalculatorClient) RunningSum(ctx context.Context) (*rpc.ClientStream, error) {
+	return rpc.OpenStream(ctx, c.invoker, "CalculatorService", "RunningSum")
+}
@@ -1,23 +1,96 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/registry"
 	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/rpc"
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/tlsconfig"
 )
 
 const (
 	ServerAddr = "localhost:9100"
 )
 
+// caller is what the demos need; *rpc.Client and *rpc.BalancedClient both provide it
+type caller interface {
+	rpc.Invoker
+	Call(service, method string, params ...interface{}) (interface{}, error)
+	CallContext(ctx context.Context, service, method string, params ...interface{}) (interface{}, error)
+	Close() error
+}
+
+// newCaller connects directly to ServerAddr, or through the registry when
+// registryAddr is set. connOpts select the codec, TLS and credentials.
+func newCaller(registryAddr string, connOpts []rpc.ClientOption) (caller, error) {
+	// Redial with backoff if the server restarts, and retry the methods
+	// the server declared idempotent
+	opts := append([]rpc.ClientOption{
+		rpc.WithReconnect(rpc.DefaultBackoff),
+		rpc.WithRetry(rpc.DefaultRetryPolicy),
+	}, connOpts...)
+
+	if registryAddr == "" {
+		return rpc.NewClient(ServerAddr, opts...)
+	}
+
+	log.Printf("Discovering CalculatorService via registry %s", registryAddr)
+	resolver := registry.NewResolver(registry.NewClient(registryAddr), "CalculatorService")
+	return rpc.NewBalancedClient(resolver, rpc.WithClientOptions(opts...))
+}
+
 func main() {
 	log.Println("Simple RPC Client Demo")
 	log.Println("======================")
 
+	codecName := flag.String("codec", "json", "wire codec: json, gob or proto")
+	servers := flag.String("servers", "", "comma-separated server addresses for the load balancing demo")
+	registryAddr := flag.String("registry", "", "registry address (e.g. localhost:9300); discover servers instead of using "+ServerAddr)
+	token := flag.String("token", "", "bearer token to authenticate with")
+	hmacCreds := flag.String("hmac", "", "principal=secret to sign requests with HMAC")
+	tlsFlags := tlsconfig.RegisterFlags()
+	flag.Parse()
+
+	codecType, ok := rpc.CodecByName(*codecName)
+	if !ok {
+		log.Fatalf("Unknown codec: %s", *codecName)
+	}
+	log.Printf("Using codec: %s", codecType)
+	connOpts := []rpc.ClientOption{rpc.WithCodec(codecType)}
+
+	tlsConfig, err := tlsFlags.ClientConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS settings: %v", err)
+	}
+	if tlsConfig != nil {
+		connOpts = append(connOpts, rpc.WithClientTLS(tlsConfig))
+	}
+
+	// Credentials travel as "authorization" metadata on every request
+	if *token != "" {
+		connOpts = append(connOpts, rpc.WithPerRPCCredentials(rpc.BearerToken(*token)))
+	}
+	if *hmacCreds != "" {
+		principal, secret, ok := strings.Cut(*hmacCreds, "=")
+		if !ok {
+			log.Fatalf("-hmac must be principal=secret")
+		}
+		connOpts = append(connOpts, rpc.WithPerRPCCredentials(rpc.HMACCredentials{
+			Principal: principal,
+			Secret:    []byte(secret),
+		}))
+	}
+
 	// Create RPC client
-	client, err := rpc.NewClient(ServerAddr)
+	client, err := newCaller(*registryAddr, connOpts)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
@@ -75,4 +148,164 @@ func main() {
 	} else {
 		log.Printf("100 + 200 = %v", result)
 	}
+
+	// Deadline propagation demo: the server sees the remaining budget
+	log.Println("\n--- Deadline Demo ---")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	result, err = client.CallContext(ctx, "CalculatorService", "Multiply", 6, 7)
+	if err != nil {
+		log.Printf("Call failed: %v", err)
+	} else {
+		log.Printf("6 * 7 = %v (within 2s deadline)", result)
+	}
+
+	// Structured error demo: the server's error code survives the round trip
+	log.Println("\n--- Remote Error Demo ---")
+	_, err = client.Call("CalculatorService", "Divide", 1, 0)
+	var remoteErr *rpc.RemoteError
+	if errors.As(err, &remoteErr) {
+		log.Printf("Divide(1, 0) failed: code=%s message=%q details=%v",
+			remoteErr.Code, remoteErr.Message, remoteErr.Details)
+	} else if err != nil {
+		log.Printf("Call failed: %v", err)
+	}
+
+	// Typed stub demo: calculator_client.go is generated by cmd/rpcgen, so
+	// arguments and results are checked at compile time
+	log.Println("\n--- Typed Stub Demo ---")
+	calc := NewCalculatorClient(client)
+	sum, err := calc.Add(context.Background(), 40, 2)
+	if err != nil {
+		log.Printf("Call failed: %v", err)
+	} else {
+		log.Printf("calc.Add(40, 2) = %d (type %T)", sum, sum)
+	}
+
+	// Metadata demo: headers travel with the request, and the server's
+	// interceptor answers with its own
+	log.Println("\n--- Metadata Demo ---")
+	var header rpc.Metadata
+	mdCtx := rpc.WithMetadata(context.Background(), rpc.NewMetadata("caller", "02-client", "trace-id", "demo-trace-1"))
+	mdCtx = rpc.WithResponseMetadata(mdCtx, &header)
+	product, err := calc.Multiply(mdCtx, 6, 9)
+	if err != nil {
+		log.Printf("Call failed: %v", err)
+	} else {
+		log.Printf("calc.Multiply(6, 9) = %d, server took %s", product, header.Get("x-elapsed"))
+	}
+
+	streamingDemo(calc)
+
+	if c, ok := client.(*rpc.Client); ok {
+		asyncDemo(c)
+	}
+
+	if *servers != "" {
+		balancingDemo(strings.Split(*servers, ","), connOpts)
+	}
+}
+
+// streamingDemo shows server streaming and bidirectional streaming over
+// the same connection as the unary calls
+func streamingDemo(calc *CalculatorClient) {
+	log.Println("\n--- Server Streaming Demo ---")
+	fib, err := calc.Fibonacci(context.Background(), 10)
+	if err != nil {
+		log.Printf("Stream failed: %v", err)
+		return
+	}
+	var numbers []int
+	for {
+		var n int
+		err := fib.Recv(&n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Recv failed: %v", err)
+			return
+		}
+		numbers = append(numbers, n)
+	}
+	log.Printf("Fibonacci(10) = %v", numbers)
+
+	log.Println("\n--- Bidirectional Streaming Demo ---")
+	sums, err := calc.RunningSum(context.Background())
+	if err != nil {
+		log.Printf("Stream failed: %v", err)
+		return
+	}
+	for _, n := range []int{5, 10, 20} {
+		if err := sums.Send(n); err != nil {
+			log.Printf("Send failed: %v", err)
+			return
+		}
+		var sum int
+		if err := sums.Recv(&sum); err != nil {
+			log.Printf("Recv failed: %v", err)
+			return
+		}
+		log.Printf("sent %d, running sum %d", n, sum)
+	}
+	sums.CloseSend()
+	if err := sums.Recv(nil); err != io.EOF {
+		log.Printf("Stream ended with: %v", err)
+	}
+}
+
+// asyncDemo starts several calls without waiting for each, then sends a
+// one-way notification
+func asyncDemo(client *rpc.Client) {
+	log.Println("\n--- Async Call Demo ---")
+	calls := []*rpc.Call{
+		client.Go("CalculatorService", "Add", 1, 1),
+		client.Go("CalculatorService", "Multiply", 2, 3),
+		client.Go("CalculatorService", "Subtract", 10, 4),
+	}
+	for _, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			log.Printf("%s%v failed: %v", call.Method, call.Params, call.Error)
+			continue
+		}
+		log.Printf("%s%v = %v", call.Method, call.Params, call.Result)
+	}
+
+	// The server runs the method but sends nothing back
+	if err := client.Notify(context.Background(), "CalculatorService", "Add", 0, 0); err != nil {
+		log.Printf("Notify failed: %v", err)
+	} else {
+		log.Println("Notify(Add, 0, 0) sent, no response expected")
+	}
+}
+
+// balancingDemo spreads calls over several servers with each policy
+func balancingDemo(addrs []string, connOpts []rpc.ClientOption) {
+	log.Println("\n--- Load Balancing Demo ---")
+
+	for _, policy := range []rpc.Policy{rpc.RoundRobin, rpc.LeastOutstanding, rpc.ConsistentHash} {
+		balanced, err := rpc.NewBalancedClient(rpc.StaticResolver(addrs),
+			rpc.WithPolicy(policy),
+			rpc.WithClientOptions(connOpts...),
+		)
+		if err != nil {
+			log.Printf("[%s] Failed to create balanced client: %v", policy, err)
+			continue
+		}
+
+		calc := NewCalculatorClient(balanced)
+		for i := 0; i < len(addrs)*2; i++ {
+			// The hash key only matters for ConsistentHash: same key, same server
+			ctx := rpc.WithHashKey(context.Background(), fmt.Sprintf("user-%d", i%2))
+			sum, err := calc.Add(ctx, i, i)
+			if err != nil {
+				log.Printf("[%s] Add(%d, %d) failed: %v", policy, i, i, err)
+			} else {
+				log.Printf("[%s] Add(%d, %d) = %d", policy, i, i, sum)
+			}
+		}
+		balanced.Close()
+	}
 }
@@ -0,0 +1,11 @@
+// Code generated by rpcgen; DO NOT EDIT.
+
+package main
+
+import "github.com/cont1nu1ty/distributed-systems-go-demos/internal/rpc"
+
+// RegisterCalculatorService registers impl as the "CalculatorService" service.
+// Taking a CalculatorService makes the compiler check the implementation.
+func RegisterCalculatorService(s *rpc.Server, impl CalculatorService, opts ...rpc.RegisterOption) error {
+	return s.Register("CalculatorService", impl, opts...)
+}
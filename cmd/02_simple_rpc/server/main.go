@@ -1,21 +1,36 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"io"
 	"log"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/registry"
 	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/rpc"
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/tlsconfig"
 )
 
 const (
 	Port = ":9100"
 )
 
+//go:generate go run ../../rpcgen -type CalculatorService -client ../client/calculator_client.go -server calculator_server.go
+
 // CalculatorService defines the calculator service interface
 type CalculatorService interface {
 	Add(a, b int) int
 	Multiply(a, b int) int
 	Subtract(a, b int) int
-	Divide(a, b int) int
+	Divide(a, b int) (int, error)
+	Fibonacci(ctx context.Context, n int, stream *rpc.ServerStream) error
+	RunningSum(stream *rpc.ServerStream) error
 }
 
 // CalculatorImpl is the implementation of CalculatorService
@@ -39,31 +54,210 @@ func (c *CalculatorImpl) Subtract(a, b int) int {
 	return a - b
 }
 
-// Divide divides a by b
-func (c *CalculatorImpl) Divide(a, b int) int {
+// Divide divides a by b, failing with an invalid_argument error when b is zero
+func (c *CalculatorImpl) Divide(a, b int) (int, error) {
 	log.Printf("Divide(%d, %d) called", a, b)
 	if b == 0 {
-		log.Println("Warning: division by zero, returning 0")
-		return 0
+		return 0, &rpc.RemoteError{
+			Code:    rpc.CodeInvalidArgument,
+			Message: "division by zero",
+			Details: map[string]string{"dividend": strconv.Itoa(a)},
+		}
+	}
+	return a / b, nil
+}
+
+// Fibonacci streams the first n Fibonacci numbers (server streaming). It
+// stops as soon as the client cancels the stream or its deadline passes.
+func (c *CalculatorImpl) Fibonacci(ctx context.Context, n int, stream *rpc.ServerStream) error {
+	log.Printf("Fibonacci(%d) stream opened", n)
+	a, b := 0, 1
+	for i := 0; i < n; i++ {
+		if err := ctx.Err(); err != nil {
+			log.Printf("Fibonacci(%d) stopped after %d numbers: %v", n, i, err)
+			return err
+		}
+		// Send blocks while the client is behind and fails once it cancels
+		if err := stream.Send(a); err != nil {
+			return err
+		}
+		a, b = b, a+b
+	}
+	return nil
+}
+
+// RunningSum answers every number the client sends with the sum so far
+// (bidirectional streaming)
+func (c *CalculatorImpl) RunningSum(stream *rpc.ServerStream) error {
+	log.Println("RunningSum stream opened")
+	sum := 0
+	for {
+		var n int
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sum += n
+		if err := stream.Send(sum); err != nil {
+			return err
+		}
 	}
-	return a / b
+}
+
+// logRequests is a server interceptor that logs each call with its caller,
+// duration and error code, and reports the duration back as metadata
+func logRequests(ctx context.Context, req *rpc.Request, next rpc.Handler) (interface{}, error) {
+	start := time.Now()
+	result, err := next(ctx, req)
+	elapsed := time.Since(start)
+
+	caller := rpc.MetadataFromContext(ctx).Get("caller")
+	if caller == "" {
+		caller = "anonymous"
+	}
+	// With mutual TLS the client certificate says who is really calling
+	if peer, ok := rpc.PeerFromContext(ctx); ok && peer.Identity() != "" {
+		caller += " (cert " + peer.Identity() + ")"
+	}
+	rpc.SetResponseMetadata(ctx, "x-elapsed", elapsed.String())
+
+	var remoteErr *rpc.RemoteError
+	switch {
+	case err == nil:
+		log.Printf("%s.%s from %s ok in %v", req.Service, req.Method, caller, elapsed)
+	case errors.As(err, &remoteErr):
+		log.Printf("%s.%s from %s failed in %v: %s", req.Service, req.Method, caller, elapsed, remoteErr.Code)
+	default:
+		log.Printf("%s.%s from %s failed in %v: %v", req.Service, req.Method, caller, elapsed, err)
+	}
+	return result, err
 }
 
 func main() {
-	// Create RPC server
-	server := rpc.NewServer()
+	addr := flag.String("addr", Port, "listen address; start several instances on different ports to try load balancing")
+	registryAddr := flag.String("registry", "", "registry address (e.g. localhost:9300) to announce this server to")
+	tokens := flag.String("tokens", "", "comma-separated token=principal pairs accepted as bearer tokens")
+	hmacSecret := flag.String("hmac-secret", "", "shared secret for HMAC-signed requests")
+	aclSpec := flag.String("acl", "*=*", "principal=pattern,pattern;... methods each principal may call once authentication is on")
+	tlsFlags := tlsconfig.RegisterFlags()
+	flag.Parse()
 
-	// Create and register calculator service
+	// Create RPC server; every request passes through the logging interceptor
+	opts := []rpc.ServerOption{rpc.WithServerInterceptors(logRequests)}
+	tlsConfig, err := tlsFlags.ServerConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS settings: %v", err)
+	}
+	if tlsConfig != nil {
+		opts = append(opts, rpc.WithServerTLS(tlsConfig))
+		log.Printf("TLS enabled (client certificates required: %v)", tlsConfig.ClientCAs != nil)
+	}
+
+	// Authentication is on as soon as any credential source is configured;
+	// the ACL then decides what each principal may call
+	var authenticators []rpc.Authenticator
+	if tlsConfig != nil && tlsConfig.ClientCAs != nil {
+		authenticators = append(authenticators, rpc.MTLSAuthenticator())
+	}
+	if *tokens != "" {
+		authenticators = append(authenticators, rpc.BearerAuthenticator(parsePairs(*tokens)))
+	}
+	if *hmacSecret != "" {
+		authenticators = append(authenticators, rpc.HMACAuthenticator([]byte(*hmacSecret), time.Minute))
+	}
+	if len(authenticators) > 0 {
+		acl := parseACL(*aclSpec)
+		opts = append(opts, rpc.WithServerInterceptors(rpc.AuthInterceptor(authenticators...), acl.Interceptor()))
+		log.Printf("Authentication enabled (%d authenticators), ACL %q", len(authenticators), *aclSpec)
+	}
+	server := rpc.NewServer(opts...)
+
+	// Create and register calculator service; the generated helper checks
+	// at compile time that CalculatorImpl satisfies CalculatorService.
+	// Every calculator method is a pure function, so clients may retry them.
 	calc := &CalculatorImpl{}
-	if err := server.Register("CalculatorService", calc); err != nil {
+	if err := RegisterCalculatorService(server, calc,
+		rpc.WithIdempotent("Add", "Multiply", "Subtract", "Divide"),
+	); err != nil {
 		log.Fatalf("Failed to register service: %v", err)
 	}
 
+	// SIGINT/SIGTERM stop accepting connections and drain the calls in flight
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *registryAddr != "" {
+		registrations := announce(server, *registryAddr, registry.AdvertiseAddr(*addr))
+		deregisterOnDone(ctx, registrations)
+	}
+
 	log.Println("Simple RPC Server starting...")
-	log.Printf("Listening on %s", Port)
+	log.Printf("Listening on %s", *addr)
 
-	// Start server (blocking)
-	if err := server.Serve(Port); err != nil {
+	// Start server (blocking until shut down)
+	err = server.Serve(ctx, *addr)
+	if err != nil && !errors.Is(err, rpc.ErrServerClosed) {
 		log.Fatalf("Server error: %v", err)
 	}
+	log.Println("Server stopped")
+}
+
+// parsePairs parses "key=value,key=value"
+func parsePairs(spec string) map[string]string {
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Fatalf("Invalid pair %q, want key=value", pair)
+		}
+		pairs[key] = value
+	}
+	return pairs
+}
+
+// parseACL parses "principal=pattern,pattern;principal=pattern"
+func parseACL(spec string) *rpc.ACL {
+	acl := rpc.NewACL()
+	for _, rule := range strings.Split(spec, ";") {
+		principal, patterns, ok := strings.Cut(rule, "=")
+		if !ok {
+			log.Fatalf("Invalid ACL rule %q, want principal=pattern,...", rule)
+		}
+		acl.Allow(principal, strings.Split(patterns, ",")...)
+	}
+	return acl
+}
+
+// announce registers every service of server with the registry; the
+// registrations keep themselves alive with heartbeats
+func announce(server *rpc.Server, registryAddr, advertiseAddr string) []*registry.Registration {
+	client := registry.NewClient(registryAddr)
+
+	var registrations []*registry.Registration
+	for _, name := range server.ServiceNames() {
+		reg, err := client.Register(context.Background(), registry.Instance{
+			Service: name,
+			Addr:    advertiseAddr,
+		}, registry.DefaultTTL)
+		if err != nil {
+			log.Fatalf("Failed to register %s with registry: %v", name, err)
+		}
+		log.Printf("Announced %s at %s to registry %s", name, advertiseAddr, registryAddr)
+		registrations = append(registrations, reg)
+	}
+	return registrations
+}
+
+// deregisterOnDone removes the registrations once ctx is done, while the
+// server drains, so clients stop routing here without waiting for the TTL
+func deregisterOnDone(ctx context.Context, registrations []*registry.Registration) {
+	context.AfterFunc(ctx, func() {
+		log.Println("Shutting down, deregistering...")
+		for _, reg := range registrations {
+			reg.Close()
+		}
+	})
 }
@@ -1,37 +1,78 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/broker"
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/registry"
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/tlsconfig"
+	"github.com/cont1nu1ty/distributed-systems-go-demos/pkg/socket"
 )
 
 const (
 	Port = ":9200"
+
+	// ServiceName is the name the broker registers under in the registry
+	ServiceName = "MessageBroker"
 )
 
 // Command represents a broker command
 type Command struct {
-	Action  string      `json:"action"` // "subscribe", "publish"
+	Action  string      `json:"action"` // "subscribe", "publish", "ack", "nack", "redrive"
 	Topic   string      `json:"topic"`
 	Payload interface{} `json:"payload,omitempty"`
+	// From is where a subscription starts: "earliest", "latest" (the
+	// default), an offset or an RFC 3339 time
+	From string `json:"from,omitempty"`
+	// Group makes the subscriber a member of a consumer group, whose
+	// members share the messages; Balance is "round-robin" (the default)
+	// or "least-loaded"
+	Group   string `json:"group,omitempty"`
+	Balance string `json:"balance,omitempty"`
+	// Ack makes the subscriber acknowledge every message with an "ack"
+	// command carrying its ID on the same connection; messages that are
+	// nacked or not acked within AckDeadline (a Go duration, "30s" by
+	// default) are delivered again, at most MaxDeliveries times if set
+	Ack           bool   `json:"ack,omitempty"`
+	AckDeadline   string `json:"ack_deadline,omitempty"`
+	MaxDeliveries int    `json:"max_deliveries,omitempty"`
+	// DeadLetter is the topic receiving the messages the subscriber's
+	// group gives up on, e.g. "<topic>.dlq"
+	DeadLetter string `json:"dead_letter,omitempty"`
+	// ID is the message an "ack" or "nack" refers to; Reject makes a
+	// "nack" give up on the message instead of redelivering it
+	ID     string `json:"id,omitempty"`
+	Reject bool   `json:"reject,omitempty"`
+	// Max limits how many messages a "redrive" of the dead-letter topic
+	// Topic moves back; 0 moves all
+	Max int `json:"max,omitempty"`
 }
 
 // BrokerServer wraps the broker and handles network connections
 type BrokerServer struct {
-	broker *broker.Broker
-	mu     sync.Mutex
+	broker    *broker.Broker
+	mu        sync.Mutex
+	tlsConfig *tls.Config // nil serves plain TCP
 }
 
-// NewBrokerServer creates a new broker server
-func NewBrokerServer() *BrokerServer {
+// NewBrokerServer creates a new broker server for b; tlsConfig, if not
+// nil, makes it accept TLS connections only
+func NewBrokerServer(b *broker.Broker, tlsConfig *tls.Config) *BrokerServer {
 	return &BrokerServer{
-		broker: broker.NewBroker(),
+		broker:    b,
+		tlsConfig: tlsConfig,
 	}
 }
 
@@ -39,7 +80,12 @@ func NewBrokerServer() *BrokerServer {
 func (bs *BrokerServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	log.Printf("New connection from %s", conn.RemoteAddr())
+	identity, err := peerIdentity(conn)
+	if err != nil {
+		log.Printf("Connection from %s rejected: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Printf("New connection from %s%s", conn.RemoteAddr(), identity)
 
 	decoder := json.NewDecoder(conn)
 	encoder := json.NewEncoder(conn)
@@ -57,7 +103,7 @@ func (bs *BrokerServer) handleConnection(conn net.Conn) {
 
 		switch cmd.Action {
 		case "subscribe":
-			bs.handleSubscribe(conn, cmd.Topic, encoder)
+			bs.handleSubscribe(cmd, decoder, encoder)
 			return // Subscription is long-lived, exit after handling
 
 		case "publish":
@@ -69,6 +115,15 @@ func (bs *BrokerServer) handleConnection(conn net.Conn) {
 				encoder.Encode(response)
 			}
 
+		case "redrive":
+			if moved, err := bs.broker.Redrive(cmd.Topic, cmd.Max); err != nil {
+				response := map[string]interface{}{"status": "error", "message": err.Error(), "redriven": moved}
+				encoder.Encode(response)
+			} else {
+				response := map[string]interface{}{"status": "ok", "redriven": moved}
+				encoder.Encode(response)
+			}
+
 		default:
 			response := map[string]string{"status": "error", "message": "unknown action"}
 			encoder.Encode(response)
@@ -77,8 +132,16 @@ func (bs *BrokerServer) handleConnection(conn net.Conn) {
 }
 
 // handleSubscribe handles a subscription request
-func (bs *BrokerServer) handleSubscribe(conn net.Conn, topic string, encoder *json.Encoder) {
-	msgChan, err := bs.broker.Subscribe(topic)
+func (bs *BrokerServer) handleSubscribe(cmd Command, decoder *json.Decoder, encoder *json.Encoder) {
+	topic := cmd.Topic
+	opts, err := subscribeOptions(cmd)
+	if err != nil {
+		response := map[string]string{"status": "error", "message": err.Error()}
+		encoder.Encode(response)
+		return
+	}
+
+	msgChan, err := bs.broker.Subscribe(topic, opts...)
 	if err != nil {
 		response := map[string]string{"status": "error", "message": err.Error()}
 		encoder.Encode(response)
@@ -91,12 +154,28 @@ func (bs *BrokerServer) handleSubscribe(conn net.Conn, topic string, encoder *js
 		return
 	}
 
-	log.Printf("Client subscribed to topic '%s'", topic)
+	if cmd.Group != "" {
+		log.Printf("Client joined group '%s' on topic '%s'", cmd.Group, topic)
+	} else {
+		log.Printf("Client subscribed to topic '%s'", topic)
+	}
+
+	// From now on messages and ack errors share the connection
+	out := &lockedEncoder{encoder: encoder}
+
+	// The cursor waits for a subscriber that is not reading, so notice a
+	// client that hung up even when there is nothing to send. Everything
+	// the client sends from now on settles the messages it received.
+	go func() {
+		bs.handleAcks(decoder, out, topic, msgChan)
+		bs.broker.Unsubscribe(topic, msgChan)
+	}()
 
 	// Stream messages to client
 	for msg := range msgChan {
-		if err := encoder.Encode(msg); err != nil {
+		if err := out.Encode(msg); err != nil {
 			log.Printf("Failed to send message: %v", err)
+			bs.broker.Unsubscribe(topic, msgChan)
 			return
 		}
 	}
@@ -104,33 +183,182 @@ func (bs *BrokerServer) handleSubscribe(conn net.Conn, topic string, encoder *js
 	log.Printf("Subscription ended for topic '%s'", topic)
 }
 
-// Start starts the broker server
-func (bs *BrokerServer) Start() error {
+// lockedEncoder lets the message stream and handleAcks write to the same
+// connection
+type lockedEncoder struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (e *lockedEncoder) Encode(v interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.encoder.Encode(v)
+}
+
+// handleAcks applies the ack and nack commands a subscriber sends until
+// it hangs up. Successful ones are not answered; a failure is sent back
+// between the messages as an error response carrying the message ID.
+func (bs *BrokerServer) handleAcks(decoder *json.Decoder, out *lockedEncoder, topic string, msgChan <-chan broker.Message) {
+	for {
+		var cmd Command
+		if err := decoder.Decode(&cmd); err != nil {
+			return
+		}
+
+		var err error
+		switch cmd.Action {
+		case "ack":
+			err = bs.broker.Ack(topic, msgChan, cmd.ID)
+		case "nack":
+			if cmd.Reject {
+				err = bs.broker.Reject(topic, msgChan, cmd.ID)
+			} else {
+				err = bs.broker.Nack(topic, msgChan, cmd.ID)
+			}
+		default:
+			err = fmt.Errorf("unknown action")
+		}
+		if err != nil {
+			log.Printf("Failed to %s message %s on topic '%s': %v", cmd.Action, cmd.ID, topic, err)
+			response := map[string]string{"status": "error", "message": err.Error(), "id": cmd.ID}
+			if out.Encode(response) != nil {
+				return
+			}
+		}
+	}
+}
+
+// subscribeOptions translates the fields of a subscribe command
+func subscribeOptions(cmd Command) ([]broker.SubscribeOption, error) {
+	position, err := broker.ParsePosition(cmd.From)
+	if err != nil {
+		return nil, err
+	}
+	opts := []broker.SubscribeOption{broker.StartAt(position)}
+
+	if cmd.Group != "" {
+		opts = append(opts, broker.WithGroup(cmd.Group))
+	}
+	if cmd.Balance != "" {
+		balance, err := broker.ParseBalance(cmd.Balance)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, broker.WithBalance(balance))
+	}
+	if cmd.Ack {
+		policy := broker.AckPolicy{MaxDeliveries: cmd.MaxDeliveries, DeadLetter: cmd.DeadLetter}
+		if cmd.AckDeadline != "" {
+			deadline, err := time.ParseDuration(cmd.AckDeadline)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ack deadline: %w", err)
+			}
+			policy.Deadline = deadline
+		}
+		opts = append(opts, broker.WithAck(policy))
+	}
+	return opts, nil
+}
+
+// peerIdentity completes the TLS handshake of conn, if it is a TLS
+// connection, and describes the verified client certificate for logging
+func peerIdentity(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return "", fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return " (TLS)", nil
+	}
+	return fmt.Sprintf(" (TLS, client %s)", chains[0][0].Subject.CommonName), nil
+}
+
+// Start starts the broker server and serves until ctx is done
+func (bs *BrokerServer) Start(ctx context.Context) error {
 	listener, err := net.Listen("tcp", Port)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
+	if bs.tlsConfig != nil {
+		listener = tls.NewListener(listener, bs.tlsConfig)
+	}
 	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
 
 	log.Printf("Message Broker Server listening on %s", Port)
 	log.Println("Waiting for connections...")
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Accept error: %v", err)
-			continue
-		}
-
-		go bs.handleConnection(conn)
+	err = socket.Serve(listener, bs.handleConnection)
+	if ctx.Err() != nil {
+		return nil
 	}
+	return err
 }
 
 func main() {
+	registryAddr := flag.String("registry", "", "registry address (e.g. localhost:9300) to announce this broker to")
+	dataDir := flag.String("data-dir", "", "directory for the durable topic logs; empty keeps messages in memory only")
+	fsync := flag.String("fsync", broker.SyncInterval.String(), "when to fsync the logs: always, interval or never")
+	segmentBytes := flag.Int64("segment-bytes", broker.DefaultSegmentBytes, "size at which a topic log starts a new segment file")
+	tlsFlags := tlsconfig.RegisterFlags()
+	flag.Parse()
+
 	log.Println("Message Broker Server starting...")
 
-	server := NewBrokerServer()
-	if err := server.Start(); err != nil {
-		log.Fatalf("Server error: %v", err)
+	tlsConfig, err := tlsFlags.ServerConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS settings: %v", err)
+	}
+	if tlsConfig != nil {
+		log.Printf("TLS enabled (client certificates required: %v)", tlsConfig.ClientCAs != nil)
+	}
+
+	config := broker.Config{}
+	if *dataDir != "" {
+		policy, err := broker.ParseSyncPolicy(*fsync)
+		if err != nil {
+			log.Fatalf("Invalid -fsync: %v", err)
+		}
+		config.Log = &broker.LogConfig{Dir: *dataDir, SegmentBytes: *segmentBytes, Sync: policy}
+		log.Printf("Persisting topics to %s (fsync %s)", *dataDir, policy)
+	}
+	b, err := broker.Open(config)
+	if err != nil {
+		log.Fatalf("Failed to open broker: %v", err)
+	}
+	defer b.Close()
+
+	// Announce the broker only once it is ready
+	if *registryAddr != "" {
+		reg, err := registry.NewClient(*registryAddr).Register(context.Background(), registry.Instance{
+			Service: ServiceName,
+			Addr:    registry.AdvertiseAddr(Port),
+		}, registry.DefaultTTL)
+		if err != nil {
+			b.Close()
+			log.Fatalf("Failed to register with registry: %v", err)
+		}
+		defer reg.Close()
+		log.Printf("Announced %s to registry %s", ServiceName, *registryAddr)
+	}
+
+	// On Ctrl+C stop accepting and return rather than exit, so the
+	// deferred deregistration runs and the logs are flushed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := NewBrokerServer(b, tlsConfig)
+	if err := server.Start(ctx); err != nil {
+		log.Printf("Server error: %v", err)
 	}
 }
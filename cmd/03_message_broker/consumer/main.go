@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -9,34 +12,113 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/registry"
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/tlsconfig"
 )
 
 const (
 	BrokerAddr = "localhost:9200"
 )
 
+// brokerAddr is the broker to talk to; main may replace it with an address
+// discovered through the registry
+var brokerAddr = BrokerAddr
+
+// tlsConfig is set from the -tls-* flags; nil means plain TCP
+var tlsConfig *tls.Config
+
 // Command represents a broker command
 type Command struct {
 	Action  string      `json:"action"`
 	Topic   string      `json:"topic"`
 	Payload interface{} `json:"payload,omitempty"`
+	From    string      `json:"from,omitempty"`
+	Group   string      `json:"group,omitempty"`
+	Balance string      `json:"balance,omitempty"`
+
+	Ack           bool   `json:"ack,omitempty"`
+	AckDeadline   string `json:"ack_deadline,omitempty"`
+	MaxDeliveries int    `json:"max_deliveries,omitempty"`
+	DeadLetter    string `json:"dead_letter,omitempty"`
+	ID            string `json:"id,omitempty"`
+	Reject        bool   `json:"reject,omitempty"`
 }
 
 // Response represents a broker response
 type Response struct {
 	Status  string `json:"status"`
 	Message string `json:"message,omitempty"`
+	// ID is the message a failed ack or nack referred to
+	ID string `json:"id,omitempty"`
 }
 
 // Message represents a received message
 type Message struct {
-	Topic     string                 `json:"topic"`
-	Payload   map[string]interface{} `json:"payload"`
-	Timestamp time.Time              `json:"timestamp"`
+	ID         string                 `json:"id"`
+	Topic      string                 `json:"topic"`
+	Offset     int64                  `json:"offset"`
+	Payload    map[string]interface{} `json:"payload"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Deliveries int                    `json:"deliveries"`
+	Headers    map[string]string      `json:"headers"`
+}
+
+// dialBroker connects to brokerAddr, over TLS when tlsConfig is set
+func dialBroker() (net.Conn, error) {
+	if tlsConfig != nil {
+		return tls.Dial("tcp", brokerAddr, tlsConfig)
+	}
+	return net.Dial("tcp", brokerAddr)
+}
+
+// loadOffset returns the position after the offset recorded in path, or
+// "" if nothing has been recorded yet
+func loadOffset(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d", &offset); err != nil {
+		return "", fmt.Errorf("invalid offset file %s: %w", path, err)
+	}
+	return fmt.Sprint(offset + 1), nil
 }
 
-func subscribe(topic string, consumerID int) error {
-	conn, err := net.Dial("tcp", BrokerAddr)
+// saveOffset records the offset of the last processed message
+func saveOffset(path string, offset int64) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d\n", offset)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// options are the subscription settings taken from the flags
+type options struct {
+	from       string
+	offsetFile string
+	group      string
+	balance    string
+
+	// ack acknowledges every message after processing it; the broker
+	// redelivers those not acknowledged within ackDeadline
+	ack           bool
+	ackDeadline   string
+	maxDeliveries int
+	deadLetter    string
+	// nackEvery nacks every n-th message instead, to show redelivery, or
+	// with reject to send it to the dead-letter topic at once
+	nackEvery int
+	reject    bool
+}
+
+func subscribe(topic string, opts options, consumerID int) error {
+	conn, err := dialBroker()
 	if err != nil {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
@@ -47,8 +129,16 @@ func subscribe(topic string, consumerID int) error {
 
 	// Send subscribe command
 	cmd := Command{
-		Action: "subscribe",
-		Topic:  topic,
+		Action:  "subscribe",
+		Topic:   topic,
+		From:    opts.from,
+		Group:   opts.group,
+		Balance: opts.balance,
+
+		Ack:           opts.ack,
+		AckDeadline:   opts.ackDeadline,
+		MaxDeliveries: opts.maxDeliveries,
+		DeadLetter:    opts.deadLetter,
 	}
 
 	if err := encoder.Encode(cmd); err != nil {
@@ -65,40 +155,145 @@ func subscribe(topic string, consumerID int) error {
 		return fmt.Errorf("subscription failed: %s", resp.Message)
 	}
 
-	log.Printf("[Consumer %d] Subscribed to topic '%s'", consumerID, topic)
+	if opts.group != "" {
+		log.Printf("[Consumer %d] Joined group '%s' on topic '%s'", consumerID, opts.group, topic)
+	} else {
+		log.Printf("[Consumer %d] Subscribed to topic '%s'", consumerID, topic)
+	}
 
 	// Receive messages
 	msgCount := 0
 	for {
-		var msg Message
-		if err := decoder.Decode(&msg); err != nil {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
 			log.Printf("[Consumer %d] Connection closed: %v", consumerID, err)
 			return nil
 		}
 
+		// The broker answers a failed ack or nack between the messages
+		var resp Response
+		if err := json.Unmarshal(raw, &resp); err == nil && resp.Status != "" {
+			log.Printf("[Consumer %d] Broker rejected settling message %s: %s", consumerID, resp.ID, resp.Message)
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return fmt.Errorf("invalid message: %w", err)
+		}
+
 		msgCount++
-		log.Printf("[Consumer %d] Received message #%d on topic '%s': %v",
-			consumerID, msgCount, msg.Topic, msg.Payload)
+		log.Printf("[Consumer %d] Received message #%d (offset %d) on topic '%s': %v",
+			consumerID, msgCount, msg.Offset, msg.Topic, msg.Payload)
+		if reason := msg.Headers["failure-reason"]; reason != "" {
+			log.Printf("[Consumer %d]   dead-lettered from '%s' (%s after %s attempts)",
+				consumerID, msg.Headers["original-topic"], reason, msg.Headers["attempts"])
+		}
+
+		if opts.ack {
+			action := "ack"
+			if opts.nackEvery > 0 && msgCount%opts.nackEvery == 0 {
+				action = "nack"
+			}
+			reject := action == "nack" && opts.reject
+			if err := encoder.Encode(Command{Action: action, Topic: topic, ID: msg.ID, Reject: reject}); err != nil {
+				return fmt.Errorf("failed to %s message: %w", action, err)
+			}
+			if reject {
+				log.Printf("[Consumer %d] Rejected message %s (delivery %d)", consumerID, msg.ID, msg.Deliveries)
+				continue
+			}
+			if action == "nack" {
+				log.Printf("[Consumer %d] Nacked message %s (delivery %d)", consumerID, msg.ID, msg.Deliveries)
+				continue
+			}
+		}
+
+		if opts.offsetFile != "" {
+			if err := saveOffset(opts.offsetFile, msg.Offset); err != nil {
+				return fmt.Errorf("failed to save offset: %w", err)
+			}
+		}
 	}
 }
 
+// resolveBroker returns the broker address, looked up in the registry when
+// registryAddr is set
+func resolveBroker(registryAddr string) (string, error) {
+	if registryAddr == "" {
+		return BrokerAddr, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resolver := registry.NewResolver(registry.NewClient(registryAddr), "MessageBroker")
+	addr, err := resolver.ResolveOne(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to discover broker: %w", err)
+	}
+	log.Printf("Discovered broker at %s via registry %s", addr, registryAddr)
+	return addr, nil
+}
+
 func main() {
+	registryAddr := flag.String("registry", "", "registry address (e.g. localhost:9300); discover the broker instead of using "+BrokerAddr)
+	from := flag.String("from", "", "where to start: earliest, latest, an offset or an RFC 3339 time (default latest)")
+	offsetFile := flag.String("offset-file", "", "file recording the last processed offset; resume after it on restart")
+	group := flag.String("group", "", "consumer group to join; its members share the topic's messages")
+	balance := flag.String("balance", "", "how the group spreads messages: round-robin or least-loaded (set by its first member)")
+	ack := flag.Bool("ack", false, "acknowledge each message after processing it; unacknowledged ones are redelivered (set by the group's first member)")
+	ackDeadline := flag.String("ack-deadline", "", "how long the broker waits for an ack before redelivering (default 30s)")
+	maxDeliveries := flag.Int("max-deliveries", 0, "how often a message is delivered before the broker gives up on it (0: no limit)")
+	nackEvery := flag.Int("nack-every", 0, "with -ack, nack every n-th message to see it redelivered")
+	reject := flag.Bool("reject", false, "with -nack-every, reject those messages instead, sending them to the dead-letter topic")
+	deadLetter := flag.String("dead-letter", "", "topic receiving the messages the group gives up on, e.g. <topic>.dlq (set by the group's first member)")
+	tlsFlags := tlsconfig.RegisterFlags()
+	flag.Parse()
+
+	config, err := tlsFlags.ClientConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS settings: %v", err)
+	}
+	tlsConfig = config
+
 	log.Println("Message Broker Consumer Demo")
 	log.Println("=============================")
 
-	if len(os.Args) < 2 {
-		log.Println("Usage: go run main.go <topic> [consumer_id]")
+	args := flag.Args()
+	if len(args) < 1 {
+		log.Println("Usage: go run main.go [-registry addr] [-tls-ca file] [-from position] [-offset-file file] [-group name] [-ack] <topic> [consumer_id]")
 		log.Println("Example: go run main.go news 1")
 		log.Println("\nStarting with default topic 'news' and consumer ID 1")
-		os.Args = append(os.Args, "news", "1")
+		args = []string{"news", "1"}
 	}
 
-	topic := os.Args[1]
+	topic := args[0]
 	consumerID := 1
-	if len(os.Args) > 2 {
-		fmt.Sscanf(os.Args[2], "%d", &consumerID)
+	if len(args) > 1 {
+		fmt.Sscanf(args[1], "%d", &consumerID)
 	}
 
+	// A group's position is kept by the broker, not by one of its members
+	if *offsetFile != "" && *group != "" {
+		log.Fatalf("-offset-file cannot be used with -group; the broker commits group offsets")
+	}
+	if *offsetFile != "" && *from == "" {
+		resume, err := loadOffset(*offsetFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if resume != "" {
+			log.Printf("Resuming at offset %s from %s", resume, *offsetFile)
+			*from = resume
+		}
+	}
+
+	addr, err := resolveBroker(*registryAddr)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	brokerAddr = addr
+
 	log.Printf("Consumer %d starting...", consumerID)
 	log.Printf("Subscribing to topic: '%s'", topic)
 
@@ -110,7 +305,19 @@ func main() {
 
 	// Start subscription in a goroutine
 	go func() {
-		errChan <- subscribe(topic, consumerID)
+		errChan <- subscribe(topic, options{
+			from:       *from,
+			offsetFile: *offsetFile,
+			group:      *group,
+			balance:    *balance,
+
+			ack:           *ack,
+			ackDeadline:   *ackDeadline,
+			maxDeliveries: *maxDeliveries,
+			deadLetter:    *deadLetter,
+			nackEvery:     *nackEvery,
+			reject:        *reject,
+		}, consumerID)
 	}()
 
 	// Wait for error or shutdown signal
@@ -1,32 +1,56 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"time"
+
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/registry"
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/tlsconfig"
 )
 
 const (
 	BrokerAddr = "localhost:9200"
 )
 
+// brokerAddr is the broker to talk to; main may replace it with an address
+// discovered through the registry
+var brokerAddr = BrokerAddr
+
+// tlsConfig is set from the -tls-* flags; nil means plain TCP
+var tlsConfig *tls.Config
+
 // Command represents a broker command
 type Command struct {
 	Action  string      `json:"action"`
 	Topic   string      `json:"topic"`
 	Payload interface{} `json:"payload,omitempty"`
+	Max     int         `json:"max,omitempty"`
 }
 
 // Response represents a broker response
 type Response struct {
 	Status  string `json:"status"`
 	Message string `json:"message,omitempty"`
+	// Redriven is the number of messages a redrive moved back
+	Redriven int `json:"redriven,omitempty"`
+}
+
+// dialBroker connects to brokerAddr, over TLS when tlsConfig is set
+func dialBroker() (net.Conn, error) {
+	if tlsConfig != nil {
+		return tls.Dial("tcp", brokerAddr, tlsConfig)
+	}
+	return net.Dial("tcp", brokerAddr)
 }
 
 func publish(topic string, payload interface{}) error {
-	conn, err := net.Dial("tcp", BrokerAddr)
+	conn, err := dialBroker()
 	if err != nil {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
@@ -59,10 +83,79 @@ func publish(topic string, payload interface{}) error {
 	return nil
 }
 
+// redrive asks the broker to publish the messages of the dead-letter topic
+// dlq again to their original topics, at most max of them if max > 0
+func redrive(dlq string, max int) (int, error) {
+	conn, err := dialBroker()
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(Command{Action: "redrive", Topic: dlq, Max: max}); err != nil {
+		return 0, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return 0, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Status != "ok" {
+		return resp.Redriven, fmt.Errorf("redrive failed: %s", resp.Message)
+	}
+	return resp.Redriven, nil
+}
+
+// resolveBroker returns the broker address, looked up in the registry when
+// registryAddr is set
+func resolveBroker(registryAddr string) (string, error) {
+	if registryAddr == "" {
+		return BrokerAddr, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resolver := registry.NewResolver(registry.NewClient(registryAddr), "MessageBroker")
+	addr, err := resolver.ResolveOne(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to discover broker: %w", err)
+	}
+	log.Printf("Discovered broker at %s via registry %s", addr, registryAddr)
+	return addr, nil
+}
+
 func main() {
+	registryAddr := flag.String("registry", "", "registry address (e.g. localhost:9300); discover the broker instead of using "+BrokerAddr)
+	redriveTopic := flag.String("redrive", "", "instead of publishing, move the messages of this dead-letter topic back to their original topics")
+	redriveMax := flag.Int("redrive-max", 0, "with -redrive, move at most this many messages (0: all)")
+	tlsFlags := tlsconfig.RegisterFlags()
+	flag.Parse()
+
+	config, err := tlsFlags.ClientConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS settings: %v", err)
+	}
+	tlsConfig = config
+
 	log.Println("Message Broker Producer Demo")
 	log.Println("=============================")
 
+	addr, err := resolveBroker(*registryAddr)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	brokerAddr = addr
+
+	if *redriveTopic != "" {
+		moved, err := redrive(*redriveTopic, *redriveMax)
+		if err != nil {
+			log.Fatalf("%v (%d messages moved)", err, moved)
+		}
+		log.Printf("Redrove %d message(s) from '%s'", moved, *redriveTopic)
+		return
+	}
+
 	// Publish messages to different topics
 	log.Println("\n--- Publishing Messages ---")
 
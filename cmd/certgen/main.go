@@ -0,0 +1,119 @@
+// Command certgen writes a throwaway CA plus server and client
+// certificates for trying the TLS options of the demos:
+//
+//	ca.pem                      CA certificate (-tls-ca)
+//	server.pem, server-key.pem  server certificate for the -hosts names
+//	<name>.pem, <name>-key.pem  client certificate with common name <name>
+//
+// The certificates are for local experiments only.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func main() {
+	out := flag.String("out", "certs", "output directory")
+	hosts := flag.String("hosts", "localhost,127.0.0.1", "comma-separated DNS names and IPs for the server certificate")
+	clients := flag.String("clients", "client", "comma-separated common names to issue client certificates for")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "certificate lifetime")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *out, err)
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatalf("Failed to generate CA key: %v", err)
+	}
+	caTemplate := template("demo CA", *validFor)
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		log.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	writePEM(filepath.Join(*out, "ca.pem"), "CERTIFICATE", caDER)
+
+	server := template("server", *validFor)
+	server.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range strings.Split(*hosts, ",") {
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else if host != "" {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+	issue(*out, "server", server, caCert, caKey)
+
+	for _, name := range strings.Split(*clients, ",") {
+		if name == "" {
+			continue
+		}
+		client := template(name, *validFor)
+		client.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		issue(*out, name, client, caCert, caKey)
+	}
+
+	log.Printf("Certificates written to %s", *out)
+}
+
+// template returns the common fields of every certificate
+func template(commonName string, validFor time.Duration) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Fatalf("Failed to generate serial number: %v", err)
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+// issue signs tmpl with the CA and writes <name>.pem and <name>-key.pem
+func issue(dir, name string, tmpl, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatalf("Failed to generate key for %s: %v", name, err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		log.Fatalf("Failed to create certificate for %s: %v", name, err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		log.Fatalf("Failed to encode key for %s: %v", name, err)
+	}
+
+	writePEM(filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	writePEM(filepath.Join(dir, name+"-key.pem"), "PRIVATE KEY", keyDER)
+}
+
+func writePEM(path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		log.Fatalf("Failed to write %s: %v", path, err)
+	}
+	fmt.Println(path)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/cont1nu1ty/distributed-systems-go-demos/internal/registry"
+)
+
+const (
+	Port = ":9300"
+)
+
+func main() {
+	addr := flag.String("addr", Port, "listen address")
+	flag.Parse()
+
+	log.Println("Service Registry starting...")
+
+	reg := registry.NewRegistry()
+	defer reg.Close()
+
+	server := registry.NewServer(reg)
+	if err := server.Serve(*addr); err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+}
@@ -0,0 +1,455 @@
+// Command rpcgen generates a typed client stub and a server registration
+// helper for an internal/rpc service described by a Go interface.
+//
+// It is meant to run from go:generate in the package declaring the
+// interface:
+//
+//	//go:generate go run ../../rpcgen -type CalculatorService -client ../client/calculator_client.go -server calculator_server.go
+//
+// For an interface method such as
+//
+//	Add(a, b int) int
+//
+// the client gets
+//
+//	func (c *CalculatorClient) Add(ctx context.Context, a int, b int) (int, error)
+//
+// A leading context.Context parameter on the interface method is
+// supplied by the caller's ctx, and a trailing error result is mapped to
+// the returned error. A streaming method, one taking a trailing
+// *rpc.ServerStream, becomes a method returning the *rpc.ClientStream.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultRPCPackage = "github.com/cont1nu1ty/distributed-systems-go-demos/internal/rpc"
+
+// param is one remote parameter of a method
+type param struct {
+	name string
+	typ  string
+}
+
+// method is one interface method after signature analysis
+type method struct {
+	name       string
+	params     []param
+	resultType string // empty when the method returns only an error or nothing
+	stream     bool   // takes a trailing *rpc.ServerStream
+}
+
+// service is the parsed interface
+type service struct {
+	typeName string
+	pkgName  string
+	methods  []method
+	// imports maps package names used in signatures to import paths
+	imports map[string]string
+	// localTypes lists identifiers declared in the source package
+	localTypes []string
+}
+
+func main() {
+	typeName := flag.String("type", "", "name of the service interface (required)")
+	serviceName := flag.String("service", "", "name the service is registered under (default: -type)")
+	clientOut := flag.String("client", "", "output file for the typed client stub")
+	clientPkg := flag.String("client-package", "", "package name of the client output (default: detected from its directory)")
+	serverOut := flag.String("server", "", "output file for the server registration helper")
+	rpcPkg := flag.String("rpc", defaultRPCPackage, "import path of the rpc package")
+	flag.Parse()
+
+	log.SetFlags(0)
+	log.SetPrefix("rpcgen: ")
+
+	if *typeName == "" || (*clientOut == "" && *serverOut == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *serviceName == "" {
+		*serviceName = *typeName
+	}
+
+	svc, err := parseService(".", *typeName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *clientOut != "" {
+		pkg := *clientPkg
+		if pkg == "" {
+			pkg = detectPackage(filepath.Dir(*clientOut))
+		}
+		src, err := generateClient(svc, *serviceName, pkg, *rpcPkg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(*clientOut, src, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *serverOut != "" {
+		src, err := generateServer(svc, *serviceName, *rpcPkg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(*serverOut, src, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// parseService finds the interface typeName among the Go files in dir
+func parseService(dir, typeName string) (*service, error) {
+	fset := token.NewFileSet()
+	files, err := parseDir(fset, dir, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		iface := findInterface(file, typeName)
+		if iface == nil {
+			continue
+		}
+
+		svc := &service{
+			typeName:   typeName,
+			pkgName:    file.Name.Name,
+			imports:    fileImports(file),
+			localTypes: declaredTypes(files),
+		}
+		if err := svc.addMethods(fset, iface); err != nil {
+			return nil, fmt.Errorf("%s: %w", typeName, err)
+		}
+		return svc, nil
+	}
+
+	return nil, fmt.Errorf("interface %s not found in %s", typeName, dir)
+}
+
+// parseDir parses the non-test Go files in dir
+func parseDir(fset *token.FileSet, dir string, mode parser.Mode) ([]*ast.File, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*ast.File
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, mode)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// findInterface returns the interface type declared as name in file
+func findInterface(file *ast.File, name string) *ast.InterfaceType {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Name.Name != name {
+				continue
+			}
+			if iface, ok := ts.Type.(*ast.InterfaceType); ok {
+				return iface
+			}
+		}
+	}
+	return nil
+}
+
+// fileImports maps the names a file uses for its imports to their paths
+func fileImports(file *ast.File) map[string]string {
+	imports := make(map[string]string)
+	for _, imp := range file.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		name := filepath.Base(path)
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		imports[name] = path
+	}
+	return imports
+}
+
+// declaredTypes lists the type names declared anywhere in files
+func declaredTypes(files []*ast.File) []string {
+	var names []string
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				names = append(names, spec.(*ast.TypeSpec).Name.Name)
+			}
+		}
+	}
+	return names
+}
+
+// addMethods analyses every method signature of iface
+func (svc *service) addMethods(fset *token.FileSet, iface *ast.InterfaceType) error {
+	for _, field := range iface.Methods.List {
+		if len(field.Names) == 0 {
+			return fmt.Errorf("embedded interfaces are not supported")
+		}
+		ftype := field.Type.(*ast.FuncType)
+		m := method{name: field.Names[0].Name}
+
+		params := flattenFields(fset, ftype.Params)
+		if len(params) > 0 && params[0].typ == "context.Context" {
+			params = params[1:]
+		}
+		if n := len(params); n > 0 && isServerStream(params[n-1].typ) {
+			m.stream = true
+			params = params[:n-1]
+		}
+		for i, p := range params {
+			if strings.HasPrefix(p.typ, "...") {
+				return fmt.Errorf("method %s: variadic parameters are not supported", m.name)
+			}
+			if p.name == "" || p.name == "_" || p.name == "ctx" || p.name == "c" {
+				p.name = fmt.Sprintf("arg%d", i)
+			}
+			m.params = append(m.params, p)
+		}
+
+		results := flattenFields(fset, ftype.Results)
+		if m.stream && (len(results) != 1 || results[0].typ != "error") {
+			return fmt.Errorf("method %s: streaming methods must return only error", m.name)
+		}
+		if n := len(results); n > 0 && results[n-1].typ == "error" {
+			results = results[:n-1]
+		}
+		switch len(results) {
+		case 0:
+		case 1:
+			m.resultType = results[0].typ
+		default:
+			return fmt.Errorf("method %s: at most one non-error result is supported", m.name)
+		}
+
+		svc.methods = append(svc.methods, m)
+	}
+	return nil
+}
+
+// isServerStream reports whether typ is *rpc.ServerStream under whatever
+// name the rpc package was imported
+func isServerStream(typ string) bool {
+	return strings.HasPrefix(typ, "*") && strings.HasSuffix(typ, ".ServerStream")
+}
+
+// flattenFields expands grouped declarations such as "a, b int"
+func flattenFields(fset *token.FileSet, fields *ast.FieldList) []param {
+	if fields == nil {
+		return nil
+	}
+	var params []param
+	for _, field := range fields.List {
+		typ := exprString(fset, field.Type)
+		if len(field.Names) == 0 {
+			params = append(params, param{typ: typ})
+			continue
+		}
+		for _, name := range field.Names {
+			params = append(params, param{name: name.Name, typ: typ})
+		}
+	}
+	return params
+}
+
+func exprString(fset *token.FileSet, expr ast.Expr) string {
+	var buf bytes.Buffer
+	format.Node(&buf, fset, expr)
+	return buf.String()
+}
+
+// typeRefs returns the package qualifiers and unqualified identifiers used
+// in the method signatures
+func (svc *service) typeRefs() (qualifiers, idents map[string]bool) {
+	qualifiers = make(map[string]bool)
+	idents = make(map[string]bool)
+
+	var types []string
+	for _, m := range svc.methods {
+		for _, p := range m.params {
+			types = append(types, p.typ)
+		}
+		if m.resultType != "" {
+			types = append(types, m.resultType)
+		}
+	}
+
+	for _, typ := range types {
+		expr, err := parser.ParseExpr(typ)
+		if err != nil {
+			continue
+		}
+		ast.Inspect(expr, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.SelectorExpr:
+				if x, ok := n.X.(*ast.Ident); ok {
+					qualifiers[x.Name] = true
+				}
+				return false
+			case *ast.Ident:
+				idents[n.Name] = true
+			}
+			return true
+		})
+	}
+	return qualifiers, idents
+}
+
+// clientImports resolves the imports needed by the client stub and checks
+// that it does not reference types only visible in the source package
+func (svc *service) clientImports() ([]string, error) {
+	qualifiers, idents := svc.typeRefs()
+
+	// The client lives in another package, so it can only use predeclared
+	// and imported types
+	for ident := range idents {
+		if contains(svc.localTypes, ident) {
+			return nil, fmt.Errorf("type %s is declared next to %s; move it to a shared package so the client can use it", ident, svc.typeName)
+		}
+		if types.Universe.Lookup(ident) == nil {
+			return nil, fmt.Errorf("unknown type %s", ident)
+		}
+	}
+
+	var paths []string
+	for qualifier := range qualifiers {
+		path, ok := svc.imports[qualifier]
+		if !ok {
+			return nil, fmt.Errorf("no import for package %s", qualifier)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// clientTypeName derives e.g. CalculatorClient from CalculatorService
+func clientTypeName(typeName string) string {
+	return strings.TrimSuffix(typeName, "Service") + "Client"
+}
+
+func generateClient(svc *service, serviceName, pkgName, rpcPkg string) ([]byte, error) {
+	extraImports, err := svc.clientImports()
+	if err != nil {
+		return nil, err
+	}
+	clientType := clientTypeName(svc.typeName)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by rpcgen; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", pkgName)
+	fmt.Fprintf(&buf, "import (\n\t\"context\"\n")
+	for _, path := range extraImports {
+		fmt.Fprintf(&buf, "\t%q\n", path)
+	}
+	fmt.Fprintf(&buf, "\n\t%q\n)\n\n", rpcPkg)
+
+	fmt.Fprintf(&buf, "// %s is a typed client for the %s service\n", clientType, serviceName)
+	fmt.Fprintf(&buf, "type %s struct {\n\tinvoker rpc.Invoker\n}\n\n", clientType)
+	fmt.Fprintf(&buf, "// New%s wraps invoker, typically an *rpc.Client\n", clientType)
+	fmt.Fprintf(&buf, "func New%s(invoker rpc.Invoker) *%s {\n\treturn &%s{invoker: invoker}\n}\n", clientType, clientType, clientType)
+
+	for _, m := range svc.methods {
+		var decl, args []string
+		decl = append(decl, "ctx context.Context")
+		for _, p := range m.params {
+			decl = append(decl, p.name+" "+p.typ)
+			args = append(args, p.name)
+		}
+		callArgs := ""
+		if len(args) > 0 {
+			callArgs = ", " + strings.Join(args, ", ")
+		}
+
+		if m.stream {
+			fmt.Fprintf(&buf, "\n// %s opens the %s.%s stream\n", m.name, serviceName, m.name)
+			fmt.Fprintf(&buf, "func (c *%s) %s(%s) (*rpc.ClientStream, error) {\n", clientType, m.name, strings.Join(decl, ", "))
+			fmt.Fprintf(&buf, "\treturn rpc.OpenStream(ctx, c.invoker, %q, %q%s)\n}\n", serviceName, m.name, callArgs)
+			continue
+		}
+
+		fmt.Fprintf(&buf, "\n// %s calls %s.%s\n", m.name, serviceName, m.name)
+		if m.resultType == "" {
+			fmt.Fprintf(&buf, "func (c *%s) %s(%s) error {\n", clientType, m.name, strings.Join(decl, ", "))
+			fmt.Fprintf(&buf, "\treturn c.invoker.Invoke(ctx, %q, %q, nil%s)\n}\n", serviceName, m.name, callArgs)
+			continue
+		}
+		fmt.Fprintf(&buf, "func (c *%s) %s(%s) (%s, error) {\n", clientType, m.name, strings.Join(decl, ", "), m.resultType)
+		fmt.Fprintf(&buf, "\tvar reply %s\n", m.resultType)
+		fmt.Fprintf(&buf, "\terr := c.invoker.Invoke(ctx, %q, %q, &reply%s)\n", serviceName, m.name, callArgs)
+		fmt.Fprintf(&buf, "\treturn reply, err\n}\n")
+	}
+
+	return format.Source(buf.Bytes())
+}
+
+func generateServer(svc *service, serviceName, rpcPkg string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by rpcgen; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", svc.pkgName)
+	fmt.Fprintf(&buf, "import %q\n\n", rpcPkg)
+	fmt.Fprintf(&buf, "// Register%s registers impl as the %q service.\n", svc.typeName, serviceName)
+	fmt.Fprintf(&buf, "// Taking a %s makes the compiler check the implementation.\n", svc.typeName)
+	fmt.Fprintf(&buf, "func Register%s(s *rpc.Server, impl %s, opts ...rpc.RegisterOption) error {\n", svc.typeName, svc.typeName)
+	fmt.Fprintf(&buf, "\treturn s.Register(%q, impl, opts...)\n}\n", serviceName)
+
+	return format.Source(buf.Bytes())
+}
+
+// detectPackage reads the package clause of an existing file in dir,
+// falling back to the directory name
+func detectPackage(dir string) string {
+	files, err := parseDir(token.NewFileSet(), dir, parser.PackageClauseOnly)
+	if err == nil && len(files) > 0 {
+		return files[0].Name.Name
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "main"
+	}
+	return filepath.Base(abs)
+}
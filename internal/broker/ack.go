@@ -0,0 +1,297 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultAckDeadline is how long a member has to acknowledge a
+	// message before it is redelivered
+	DefaultAckDeadline = 30 * time.Second
+	// DefaultMaxInFlight is the number of unacknowledged messages a group
+	// hands out before it waits for acknowledgements; it matches the
+	// buffer of a subscriber's channel
+	DefaultMaxInFlight = 100
+)
+
+// ErrNotAwaitingAck is returned by Ack and Nack for a message the
+// subscriber does not hold: it was acknowledged already, its deadline
+// passed, or it was delivered to someone else
+var ErrNotAwaitingAck = errors.New("message is not awaiting acknowledgement from this subscriber")
+
+// AckPolicy makes a group deliver at least once: every message it hands
+// out must be acknowledged with Ack, and is delivered again, to the same
+// or another member, if it is Nacked, if its deadline passes first or if
+// its member leaves.
+type AckPolicy struct {
+	// Deadline is how long a member has to Ack a message after receiving
+	// it; DefaultAckDeadline if zero
+	Deadline time.Duration
+	// MaxDeliveries is how often a message is delivered before the group
+	// gives up on it; zero means no limit
+	MaxDeliveries int
+	// MaxInFlight is the number of unacknowledged messages after which
+	// the group waits before delivering more; DefaultMaxInFlight if zero
+	MaxInFlight int
+	// DeadLetter, if set, is the topic receiving the messages the group
+	// gives up on, usually DeadLetterTopic of the topic read
+	DeadLetter string
+	// GiveUp, if set, receives every message the group gives up on, after
+	// MaxDeliveries or because it was rejected, with Deliveries set to the
+	// deliveries made and reason one of the Reason* constants. It runs
+	// after the message was dead-lettered, on the dispatcher or the
+	// goroutine calling Reject.
+	GiveUp func(msg Message, reason string)
+}
+
+func (p AckPolicy) withDefaults() AckPolicy {
+	if p.Deadline <= 0 {
+		p.Deadline = DefaultAckDeadline
+	}
+	if p.MaxInFlight <= 0 {
+		p.MaxInFlight = DefaultMaxInFlight
+	}
+	return p
+}
+
+// WithAck makes the subscription's group deliver at least once, as the
+// policy says, instead of forgetting messages once they are handed out.
+// Only the member creating the group decides.
+func WithAck(policy AckPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		policy = policy.withDefaults()
+		o.ack = &policy
+	}
+}
+
+// newMessageID returns a random ID for a new message
+func newMessageID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// delivery is a message handed out by a group and not yet acknowledged
+type delivery struct {
+	msg      Message
+	member   *member // nil until the message is in a member's channel
+	deadline time.Time
+}
+
+// Ack acknowledges the message with the given ID, received on ch from a
+// subscription made WithAck, so that it is not delivered again
+func (b *Broker) Ack(topicName string, ch <-chan Message, id string) error {
+	g, m, err := b.subscription(topicName, ch)
+	if err != nil {
+		return err
+	}
+	_, err = g.settle(m, id, false)
+	return err
+}
+
+// Nack hands the message with the given ID, received on ch from a
+// subscription made WithAck, back to its group to be delivered again
+// right away
+func (b *Broker) Nack(topicName string, ch <-chan Message, id string) error {
+	g, m, err := b.subscription(topicName, ch)
+	if err != nil {
+		return err
+	}
+	_, err = g.settle(m, id, true)
+	return err
+}
+
+// Reject gives up on the message with the given ID, received on ch from a
+// subscription made WithAck, at once: it is not delivered again but moved
+// to the group's dead-letter topic, if it has one
+func (b *Broker) Reject(topicName string, ch <-chan Message, id string) error {
+	g, m, err := b.subscription(topicName, ch)
+	if err != nil {
+		return err
+	}
+	msg, err := g.settle(m, id, false)
+	if err != nil {
+		return err
+	}
+	g.giveUp(g, msg, ReasonRejected)
+	return nil
+}
+
+// subscription returns the group and member receiving on ch, which must
+// use acknowledgements
+func (b *Broker) subscription(topicName string, ch <-chan Message) (*group, *member, error) {
+	b.mu.RLock()
+	t, ok := b.topics[topicName]
+	var g *group
+	var m *member
+	if ok {
+		g, m = t.memberOf(ch)
+	}
+	b.mu.RUnlock()
+
+	if m == nil {
+		return nil, nil, fmt.Errorf("not subscribed to topic '%s'", topicName)
+	}
+	if g.ack == nil {
+		return nil, nil, fmt.Errorf("subscription to topic '%s' does not use acknowledgements", topicName)
+	}
+	return g, m, nil
+}
+
+// memberOf returns the group and member receiving on ch; Broker.mu must
+// be held
+func (t *topic) memberOf(ch <-chan Message) (*group, *member) {
+	for _, g := range t.groups {
+		if m := g.member(ch); m != nil {
+			return g, m
+		}
+	}
+	return nil, nil
+}
+
+// member returns the member receiving on ch, or nil
+func (g *group) member(ch <-chan Message) *member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, m := range g.members {
+		if m.ch == ch {
+			return m
+		}
+	}
+	return nil
+}
+
+// settle removes the message with the given ID from those m holds and
+// returns it, queueing it for redelivery if asked to
+func (g *group) settle(m *member, id string, redeliver bool) (Message, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	d, ok := g.inflight[id]
+	if !ok || d.member != m {
+		return Message{}, ErrNotAwaitingAck
+	}
+	delete(g.inflight, id)
+	if redeliver {
+		g.pending = append(g.pending, d.msg)
+	}
+	// Wake the dispatcher: there is room for another message, or one to
+	// send again
+	g.notifyLocked()
+	return d.msg, nil
+}
+
+// track records msg as handed out before it is sent, so that an Ack
+// arriving right after the send finds it
+func (g *group) track(msg Message) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight[msg.ID] = &delivery{msg: msg}
+}
+
+// waitForRoom waits until fewer than MaxInFlight messages await
+// acknowledgement, redelivering those whose deadline passes meanwhile.
+// It returns false if the dispatcher must stop instead.
+func (g *group) waitForRoom(closed <-chan struct{}) bool {
+	for {
+		if !g.reap() {
+			return false
+		}
+
+		g.mu.Lock()
+		room := len(g.inflight) < g.ack.MaxInFlight
+		changed := g.changed
+		expiry := g.expiryLocked()
+		g.mu.Unlock()
+
+		if room {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-expiry:
+			g.expire()
+		case <-closed:
+			g.shutdown()
+			return false
+		}
+	}
+}
+
+// expiryLocked returns a channel that fires at the earliest deadline of
+// the messages handed out, or nil if there are none
+func (g *group) expiryLocked() <-chan time.Time {
+	var earliest time.Time
+	for _, d := range g.inflight {
+		if d.member != nil && (earliest.IsZero() || d.deadline.Before(earliest)) {
+			earliest = d.deadline
+		}
+	}
+	if earliest.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(earliest))
+}
+
+// expire queues the messages whose deadline has passed for redelivery
+func (g *group) expire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	var expired []*delivery
+	for id, d := range g.inflight {
+		if d.member != nil && !now.Before(d.deadline) {
+			expired = append(expired, d)
+			delete(g.inflight, id)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	g.requeueLocked(expired)
+	log.Printf("Redelivering %d message(s) on topic '%s' whose ack deadline passed", len(expired), g.topic.name)
+}
+
+// requeueHeldLocked queues the messages m holds for redelivery when it
+// leaves; unread lists the IDs still in its channel, which do not count
+// as a delivery
+func (g *group) requeueHeldLocked(m *member, unread map[string]bool) {
+	var held []*delivery
+	for id, d := range g.inflight {
+		if d.member == m {
+			if unread[id] {
+				d.msg.Deliveries--
+			}
+			held = append(held, d)
+			delete(g.inflight, id)
+		}
+	}
+	g.requeueLocked(held)
+}
+
+// requeueLocked appends ds to the pending messages in offset order
+func (g *group) requeueLocked(ds []*delivery) {
+	sort.Slice(ds, func(i, j int) bool { return ds[i].msg.Offset < ds[j].msg.Offset })
+	for _, d := range ds {
+		g.pending = append(g.pending, d.msg)
+	}
+}
+
+// exhausted reports whether msg, about to be delivered, has reached the
+// policy's MaxDeliveries already, and gives up on it if so
+func (g *group) exhausted(msg Message) bool {
+	if g.ack.MaxDeliveries <= 0 || msg.Deliveries <= g.ack.MaxDeliveries {
+		return false
+	}
+	msg.Deliveries--
+	g.giveUp(g, msg, ReasonMaxDeliveries)
+	return true
+}
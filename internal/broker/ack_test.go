@@ -0,0 +1,187 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// receive returns the next message on ch, failing the test if none
+// arrives within a second
+func receive(t *testing.T, ch <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed")
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+	return Message{}
+}
+
+// expectNothing fails the test if a message arrives on ch within d
+func expectNothing(t *testing.T, ch <-chan Message, d time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		t.Fatalf("unexpected message %s (delivery %d)", msg.ID, msg.Deliveries)
+	case <-time.After(d):
+	}
+}
+
+func TestAckRemovesMessage(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	ch, err := b.Subscribe("jobs", WithAck(AckPolicy{Deadline: 50 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("jobs", "a")
+
+	msg := receive(t, ch)
+	if msg.ID == "" || msg.Deliveries != 1 {
+		t.Fatalf("got ID %q, delivery %d; want an ID and delivery 1", msg.ID, msg.Deliveries)
+	}
+	if err := b.Ack("jobs", ch, msg.ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := b.Ack("jobs", ch, msg.ID); !errors.Is(err, ErrNotAwaitingAck) {
+		t.Fatalf("second Ack = %v, want ErrNotAwaitingAck", err)
+	}
+	expectNothing(t, ch, 150*time.Millisecond)
+}
+
+func TestNackRedeliversAndDeadlineRedeliversAgain(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	ch, err := b.Subscribe("jobs", WithAck(AckPolicy{Deadline: 100 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("jobs", "a")
+
+	msg := receive(t, ch)
+	if err := b.Nack("jobs", ch, msg.ID); err != nil {
+		t.Fatalf("Nack: %v", err)
+	}
+	again := receive(t, ch)
+	if again.ID != msg.ID || again.Deliveries != 2 {
+		t.Fatalf("after Nack got %s delivery %d, want %s delivery 2", again.ID, again.Deliveries, msg.ID)
+	}
+
+	// Nothing else is in flight, so only the deadline of the redelivered
+	// message can wake the group
+	start := time.Now()
+	expired := receive(t, ch)
+	if expired.ID != msg.ID || expired.Deliveries != 3 {
+		t.Fatalf("after deadline got %s delivery %d, want %s delivery 3", expired.ID, expired.Deliveries, msg.ID)
+	}
+	if waited := time.Since(start); waited < 80*time.Millisecond {
+		t.Fatalf("redelivered after %v, before the deadline", waited)
+	}
+}
+
+func TestMaxDeliveriesGivesUp(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	given := make(chan Message, 1)
+	ch, err := b.Subscribe("jobs", WithAck(AckPolicy{
+		MaxDeliveries: 2,
+		GiveUp: func(msg Message, reason string) {
+			if reason != ReasonMaxDeliveries {
+				t.Errorf("reason %q, want %q", reason, ReasonMaxDeliveries)
+			}
+			given <- msg
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("jobs", "poison")
+
+	for i := 1; i <= 2; i++ {
+		msg := receive(t, ch)
+		if msg.Deliveries != i {
+			t.Fatalf("delivery %d, want %d", msg.Deliveries, i)
+		}
+		b.Nack("jobs", ch, msg.ID)
+	}
+	select {
+	case msg := <-given:
+		if msg.Deliveries != 2 {
+			t.Fatalf("gave up with %d deliveries, want 2", msg.Deliveries)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GiveUp not called")
+	}
+	expectNothing(t, ch, 100*time.Millisecond)
+}
+
+func TestLeavingMemberHandsMessagesToGroup(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	first, err := b.Subscribe("jobs", WithGroup("workers"), WithAck(AckPolicy{Deadline: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("jobs", "a")
+	held := receive(t, first)
+
+	second, err := b.Subscribe("jobs", WithGroup("workers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Unsubscribe("jobs", first)
+
+	msg := receive(t, second)
+	if msg.ID != held.ID || msg.Deliveries != 2 {
+		t.Fatalf("got %s delivery %d, want %s delivery 2", msg.ID, msg.Deliveries, held.ID)
+	}
+	if err := b.Ack("jobs", second, msg.ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+}
+
+func TestMaxInFlightLimitsUnackedMessages(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	ch, err := b.Subscribe("jobs", WithAck(AckPolicy{MaxInFlight: 2, Deadline: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		b.Publish("jobs", i)
+	}
+
+	first := receive(t, ch)
+	receive(t, ch)
+	expectNothing(t, ch, 100*time.Millisecond)
+
+	b.Ack("jobs", ch, first.ID)
+	if msg := receive(t, ch); msg.Offset != 2 {
+		t.Fatalf("got offset %d after Ack, want 2", msg.Offset)
+	}
+}
+
+func TestAckWithoutPolicyFails(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	ch, err := b.Subscribe("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("news", "a")
+	msg := receive(t, ch)
+	if err := b.Ack("news", ch, msg.ID); err == nil {
+		t.Fatal("Ack on a subscription without acknowledgements succeeded")
+	}
+}
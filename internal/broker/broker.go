@@ -3,107 +3,373 @@ package broker
 import (
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
 
 // Message represents a message in the broker
 type Message struct {
-	Topic     string      `json:"topic"`
+	// ID identifies the message in Ack and Nack
+	ID    string `json:"id"`
+	Topic string `json:"topic"`
+	// Offset is the message's position in its topic, counting from 0
+	Offset    int64       `json:"offset"`
 	Payload   interface{} `json:"payload"`
 	Timestamp time.Time   `json:"timestamp"`
+	// Deliveries counts how often the message has been handed out,
+	// including this time; only set by groups using acknowledgements
+	Deliveries int `json:"deliveries,omitempty"`
+	// Headers describe the message; dead-lettered messages carry the
+	// Header* keys
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
-// Broker is an in-memory pub/sub message broker
+// Broker is a pub/sub message broker. Every topic stores its messages,
+// in memory or, if the broker was opened with a LogConfig, in a log on
+// disk, and each subscriber, or consumer group sharing the work, reads
+// them from its own offset onwards.
 type Broker struct {
-	mu          sync.RWMutex
-	subscribers map[string][]chan Message
-	subCounter  int
-	closed      bool
-	closeChan   chan struct{}
+	mu         sync.RWMutex
+	topics     map[string]*topic
+	subCounter int
+	closed     bool
+	closeChan  chan struct{}
+	cursors    sync.WaitGroup // group dispatchers
+	commitDone chan struct{}  // closed when commitLoop returns; nil in memory
+
+	config Config
+}
+
+// Config configures a Broker created with Open
+type Config struct {
+	// Log makes the broker durable; nil keeps messages in memory only
+	Log *LogConfig
+	// MemoryRetention is the number of messages an in-memory topic keeps
+	// for subscribers starting in the past; DefaultMemoryRetention if zero
+	MemoryRetention int
+}
+
+// topic is a named stream of messages and the groups reading it
+type topic struct {
+	name    string
+	store   store
+	offsets *offsetStore // named group positions; nil in memory
+
+	mu       sync.Mutex    // serializes appends
+	appended chan struct{} // closed and replaced after every append
+
+	groups []*group // guarded by Broker.mu
+
+	redriveMu sync.Mutex   // serializes Redrive
+	redriven  int64        // where the next Redrive of this topic starts
+	redrive   *offsetStore // commits redriven; nil in memory
 }
 
-// NewBroker creates a new message broker
+// NewBroker creates a new in-memory message broker
 func NewBroker() *Broker {
-	return &Broker{
-		subscribers: make(map[string][]chan Message),
-		closeChan:   make(chan struct{}),
+	b, _ := Open(Config{})
+	return b
+}
+
+// Open creates a broker as configured. With a LogConfig, the logs of the
+// topics found in its directory are recovered before Open returns.
+func Open(config Config) (*Broker, error) {
+	b := &Broker{
+		topics:    make(map[string]*topic),
+		closeChan: make(chan struct{}),
+		config:    config,
+	}
+	if config.Log == nil {
+		return b, nil
+	}
+
+	logConfig := config.Log.withDefaults()
+	b.config.Log = &logConfig
+	if err := os.MkdirAll(logConfig.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(logConfig.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list topics: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || validateTopic(entry.Name()) != nil {
+			continue
+		}
+		t, err := b.openTopic(entry.Name())
+		if err != nil {
+			b.closeTopics()
+			return nil, fmt.Errorf("failed to recover topic '%s': %w", entry.Name(), err)
+		}
+		b.topics[entry.Name()] = t
+		log.Printf("Recovered topic '%s' (%d messages)", entry.Name(), t.store.NextOffset())
+	}
+
+	b.commitDone = make(chan struct{})
+	go b.commitLoop(logConfig.SyncEvery)
+	return b, nil
+}
+
+// validateTopic rejects topic names that cannot be used as directory names
+func validateTopic(topic string) error {
+	if topic == "" || topic == "." || topic == ".." {
+		return fmt.Errorf("invalid topic name '%s'", topic)
+	}
+	for _, r := range topic {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return fmt.Errorf("invalid topic name '%s': only letters, digits, '.', '_' and '-' are allowed", topic)
+		}
+	}
+	return nil
+}
+
+func newTopic(name string, st store) *topic {
+	return &topic{name: name, store: st, appended: make(chan struct{})}
+}
+
+// append stores a new message carrying payload and wakes the subscribers.
+// Timestamps are taken under the lock, so they grow with the offsets.
+func (t *topic) append(payload interface{}, headers map[string]string) (Message, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	msg := Message{
+		ID:        newMessageID(),
+		Topic:     t.name,
+		Payload:   payload,
+		Timestamp: time.Now(),
+		Headers:   headers,
+	}
+	offset, err := t.store.Append(msg)
+	if err != nil {
+		return Message{}, err
 	}
+	msg.Offset = offset
+
+	close(t.appended)
+	t.appended = make(chan struct{})
+	return msg, nil
+}
+
+// appendedSignal returns a channel closed by the next append
+func (t *topic) appendedSignal() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.appended
 }
 
-// Subscribe subscribes to a topic and returns a channel for receiving messages
-func (b *Broker) Subscribe(topic string) (<-chan Message, error) {
+// topic returns the topic called name, creating it on first use
+func (b *Broker) topic(name string) (*topic, error) {
+	b.mu.RLock()
+	t, ok := b.topics[name]
+	closed := b.closed
+	b.mu.RUnlock()
+
+	if closed {
+		return nil, fmt.Errorf("broker is closed")
+	}
+	if ok {
+		return t, nil
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
 	if b.closed {
 		return nil, fmt.Errorf("broker is closed")
 	}
+	if t, ok := b.topics[name]; ok {
+		return t, nil
+	}
 
-	// Create a buffered channel for the subscriber
-	ch := make(chan Message, 100)
+	if b.config.Log == nil {
+		t = newTopic(name, newMemoryStore(b.config.MemoryRetention))
+		b.topics[name] = t
+		return t, nil
+	}
 
-	b.subscribers[topic] = append(b.subscribers[topic], ch)
-	b.subCounter++
+	if err := validateTopic(name); err != nil {
+		return nil, err
+	}
+	t, err := b.openTopic(name)
+	if err != nil {
+		return nil, err
+	}
+	b.topics[name] = t
+	return t, nil
+}
 
-	log.Printf("New subscriber for topic '%s' (total subscribers: %d)", topic, len(b.subscribers[topic]))
+// openTopic opens the log of a durable topic and the positions committed
+// next to it
+func (b *Broker) openTopic(name string) (*topic, error) {
+	dir := filepath.Join(b.config.Log.Dir, name)
+	topicLog, err := OpenLog(dir, *b.config.Log)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := openOffsetStore(filepath.Join(dir, groupOffsetsFile))
+	if err != nil {
+		topicLog.Close()
+		return nil, err
+	}
+	redrive, err := openOffsetStore(filepath.Join(dir, redriveFile))
+	if err != nil {
+		topicLog.Close()
+		return nil, err
+	}
 
-	return ch, nil
+	t := newTopic(name, topicLog)
+	t.offsets = offsets
+	t.redrive = redrive
+	t.redriven, _ = redrive.get(redrivenKey)
+	return t, nil
 }
 
-// Publish publishes a message to a topic
-func (b *Broker) Publish(topic string, payload interface{}) error {
+// Subscribe subscribes to a topic and returns a channel for receiving
+// messages. It starts at Latest unless StartAt says otherwise; with
+// WithGroup the subscriber shares the messages with the group's other
+// members, and WithAck makes it acknowledge every message.
+func (b *Broker) Subscribe(topicName string, opts ...SubscribeOption) (<-chan Message, error) {
+	options := subscribeOptions{start: Latest}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	t, err := b.topic(topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	// A group that exists already decided where it starts, and so did one
+	// whose position was committed before the broker restarted
 	b.mu.RLock()
-	defer b.mu.RUnlock()
+	g := t.group(options.group)
+	b.mu.RUnlock()
+
+	var start int64
+	if g == nil {
+		position := options.start
+		if committed, ok := t.committedOffset(options.group); ok {
+			log.Printf("Group '%s' resumes topic '%s' at committed offset %d", options.group, topicName, committed)
+			position = AtOffset(committed)
+		}
+		if start, err = position.resolve(t.store); err != nil {
+			return nil, fmt.Errorf("failed to find start position: %w", err)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
 	if b.closed {
-		return fmt.Errorf("broker is closed")
+		return nil, fmt.Errorf("broker is closed")
 	}
 
-	msg := Message{
-		Topic:     topic,
-		Payload:   payload,
-		Timestamp: time.Now(),
+	if g = t.group(options.group); g == nil {
+		g = newGroup(t, options.group, options.balance, options.ack, start)
+		g.giveUp = b.giveUp
+		t.groups = append(t.groups, g)
 	}
 
-	subscribers := b.subscribers[topic]
-	if len(subscribers) == 0 {
-		log.Printf("No subscribers for topic '%s'", topic)
-		return nil
+	// Create a buffered channel for the subscriber
+	m := &member{ch: make(chan Message, 100)}
+	g.join(m, b.closeChan, &b.cursors)
+	b.subCounter++
+
+	if g.name == "" {
+		log.Printf("New subscriber for topic '%s' from offset %d (total subscribers: %d)", topicName, start, t.subscriberCount())
+	} else {
+		log.Printf("New member of group '%s' on topic '%s' (%d members, %s)", g.name, topicName, g.memberCount(), g.balance)
 	}
 
-	log.Printf("Publishing message to topic '%s' (%d subscribers)", topic, len(subscribers))
+	return m.ch, nil
+}
 
-	// Send to all subscribers concurrently without blocking
-	for _, ch := range subscribers {
-		// Use select with default to avoid blocking if subscriber is slow
-		select {
-		case ch <- msg:
-			// Message sent successfully
-		default:
-			// Channel is full, log warning but don't block
-			log.Printf("Warning: subscriber channel full for topic '%s', message dropped", topic)
-		}
+// committedOffset returns the position committed for the named group on
+// a durable topic
+func (t *topic) committedOffset(name string) (int64, bool) {
+	if name == "" || t.offsets == nil {
+		return 0, false
 	}
+	return t.offsets.get(name)
+}
 
+// group returns the named group, or nil for "" or a group that does not
+// exist yet; Broker.mu must be held
+func (t *topic) group(name string) *group {
+	if name == "" {
+		return nil
+	}
+	for _, g := range t.groups {
+		if g.name == name {
+			return g
+		}
+	}
 	return nil
 }
 
-// Unsubscribe removes a subscriber channel
-func (b *Broker) Unsubscribe(topic string, ch <-chan Message) {
+// subscriberCount returns the members of all groups; Broker.mu must be held
+func (t *topic) subscriberCount() int {
+	count := 0
+	for _, g := range t.groups {
+		count += g.memberCount()
+	}
+	return count
+}
+
+// Publish publishes a message to a topic. The message is stored, and on a
+// durable broker written to the topic's log, before any subscriber sees it.
+func (b *Broker) Publish(topicName string, payload interface{}) error {
+	_, err := b.publish(topicName, payload, nil)
+	return err
+}
+
+// publish stores a message with the given headers and returns it
+func (b *Broker) publish(topicName string, payload interface{}, headers map[string]string) (Message, error) {
+	t, err := b.topic(topicName)
+	if err != nil {
+		return Message{}, err
+	}
+
+	msg, err := t.append(payload, headers)
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to store message: %w", err)
+	}
+
+	b.mu.RLock()
+	subscribers := t.subscriberCount()
+	b.mu.RUnlock()
+
+	if subscribers == 0 {
+		log.Printf("No subscribers for topic '%s' (stored at offset %d)", topicName, msg.Offset)
+		return msg, nil
+	}
+
+	log.Printf("Publishing message %d to topic '%s' (%d subscribers)", msg.Offset, topicName, subscribers)
+	return msg, nil
+}
+
+// Unsubscribe removes a subscriber channel. The channel is closed by its
+// group's dispatcher shortly after; messages still waiting in it go to
+// the group's other members.
+func (b *Broker) Unsubscribe(topicName string, ch <-chan Message) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	subscribers := b.subscribers[topic]
-	for i, subCh := range subscribers {
-		if subCh == ch {
-			// Remove from slice first to avoid race condition
-			b.subscribers[topic] = append(subscribers[:i], subscribers[i+1:]...)
-			// Close after removing from list to prevent panic
-			go func() {
-				close(subCh)
-			}()
-			log.Printf("Unsubscribed from topic '%s'", topic)
+	t, ok := b.topics[topicName]
+	if !ok {
+		return
+	}
+	for i, g := range t.groups {
+		if g.leave(ch) {
+			// Named groups outlive their members to keep their position
+			if g.name == "" {
+				t.groups = append(t.groups[:i], t.groups[i+1:]...)
+			}
+			log.Printf("Unsubscribed from topic '%s'", topicName)
 			break
 		}
 	}
@@ -114,40 +380,55 @@ func (b *Broker) GetTopics() []string {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	topics := make([]string, 0, len(b.subscribers))
-	for topic := range b.subscribers {
-		topics = append(topics, topic)
+	topics := make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		topics = append(topics, name)
 	}
 	return topics
 }
 
 // GetSubscriberCount returns the number of subscribers for a topic
-func (b *Broker) GetSubscriberCount(topic string) int {
+func (b *Broker) GetSubscriberCount(topicName string) int {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	return len(b.subscribers[topic])
+	if t, ok := b.topics[topicName]; ok {
+		return t.subscriberCount()
+	}
+	return 0
 }
 
 // Close closes the broker and all subscriber channels
 func (b *Broker) Close() {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-
 	if b.closed {
+		b.mu.Unlock()
 		return
 	}
-
 	b.closed = true
 	close(b.closeChan)
+	b.mu.Unlock()
 
-	// Close all subscriber channels
-	for topic, subscribers := range b.subscribers {
-		for _, ch := range subscribers {
-			close(ch)
-		}
-		delete(b.subscribers, topic)
+	// Subscription goroutines close their channels on the way out; wait
+	// for them before closing the stores they read
+	b.cursors.Wait()
+	if b.commitDone != nil {
+		<-b.commitDone
+		b.commitOffsets()
 	}
-
+	b.closeTopics()
 	log.Println("Broker closed")
 }
+
+// closeTopics closes the store of every topic
+func (b *Broker) closeTopics() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for name, t := range b.topics {
+		if err := t.store.Close(); err != nil {
+			log.Printf("Failed to close topic '%s': %v", name, err)
+		}
+		delete(b.topics, name)
+	}
+}
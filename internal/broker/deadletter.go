@@ -0,0 +1,141 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// Reasons a group gives up on a message, recorded in HeaderFailureReason
+const (
+	// ReasonMaxDeliveries means the message was delivered
+	// AckPolicy.MaxDeliveries times without being acknowledged
+	ReasonMaxDeliveries = "max-deliveries"
+	// ReasonRejected means a member rejected the message with Reject
+	ReasonRejected = "rejected"
+)
+
+// Headers of a dead-lettered message
+const (
+	// HeaderOriginalTopic is the topic the message was published to;
+	// Redrive publishes it there again
+	HeaderOriginalTopic = "original-topic"
+	// HeaderOriginalOffset and HeaderOriginalID locate the message in its
+	// original topic
+	HeaderOriginalOffset = "original-offset"
+	HeaderOriginalID     = "original-id"
+	// HeaderFailureReason is ReasonMaxDeliveries or ReasonRejected
+	HeaderFailureReason = "failure-reason"
+	// HeaderAttempts is the number of times the message was delivered
+	HeaderAttempts = "attempts"
+	// HeaderRedrivenFrom is set by Redrive to the dead-letter topic the
+	// message came back from
+	HeaderRedrivenFrom = "redriven-from"
+)
+
+// DeadLetterTopic returns the conventional dead-letter topic of topic,
+// "<topic>.dlq"
+func DeadLetterTopic(topic string) string {
+	return topic + ".dlq"
+}
+
+// giveUp is called when g gives up on msg: it moves msg to the group's
+// dead-letter topic, if any, and passes it to the policy's GiveUp hook
+func (b *Broker) giveUp(g *group, msg Message, reason string) {
+	if g.ack.DeadLetter == "" {
+		log.Printf("Dropping message %s (offset %d) of topic '%s' after %d deliveries (%s)",
+			msg.ID, msg.Offset, g.topic.name, msg.Deliveries, reason)
+	} else {
+		headers := map[string]string{
+			HeaderOriginalTopic:  g.topic.name,
+			HeaderOriginalOffset: strconv.FormatInt(msg.Offset, 10),
+			HeaderOriginalID:     msg.ID,
+			HeaderFailureReason:  reason,
+			HeaderAttempts:       strconv.Itoa(msg.Deliveries),
+		}
+		dead, err := b.publish(g.ack.DeadLetter, msg.Payload, headers)
+		if err != nil {
+			log.Printf("Failed to dead-letter message %s of topic '%s' to '%s': %v",
+				msg.ID, g.topic.name, g.ack.DeadLetter, err)
+		} else {
+			log.Printf("Dead-lettered message %s (offset %d) of topic '%s' to '%s' at offset %d (%s, %d deliveries)",
+				msg.ID, msg.Offset, g.topic.name, g.ack.DeadLetter, dead.Offset, reason, msg.Deliveries)
+		}
+	}
+
+	if g.ack.GiveUp != nil {
+		g.ack.GiveUp(msg, reason)
+	}
+}
+
+// Redrive publishes the messages of the dead-letter topic dlq again to the
+// topics named in their HeaderOriginalTopic, at most max of them if max
+// is positive, and returns how many it moved. Each call continues after
+// the last message an earlier call moved, so no message is redriven
+// twice; a durable broker commits that position next to the log, and
+// only a crash during the call redrives its messages again. Messages
+// without the header are skipped.
+func (b *Broker) Redrive(dlq string, max int) (int, error) {
+	b.mu.RLock()
+	t, ok := b.topics[dlq]
+	closed := b.closed
+	b.mu.RUnlock()
+
+	if closed {
+		return 0, fmt.Errorf("broker is closed")
+	}
+	if !ok {
+		return 0, fmt.Errorf("unknown topic '%s'", dlq)
+	}
+
+	t.redriveMu.Lock()
+	defer t.redriveMu.Unlock()
+
+	// Collect first: publishing must not happen while reading the store.
+	// Skipped messages do not count towards max.
+	var messages []Message
+	movable := 0
+	end := t.store.NextOffset()
+	err := t.store.ReadFrom(t.redriven, func(offset int64, msg Message) bool {
+		if offset >= end || (max > 0 && movable == max) {
+			return false
+		}
+		messages = append(messages, msg)
+		if msg.Headers[HeaderOriginalTopic] != "" {
+			movable++
+		}
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read topic '%s': %w", dlq, err)
+	}
+
+	moved := 0
+	defer t.commitRedriven()
+	for _, msg := range messages {
+		original := msg.Headers[HeaderOriginalTopic]
+		if original == "" {
+			log.Printf("Skipping message %d of '%s' without %s header", msg.Offset, dlq, HeaderOriginalTopic)
+		} else {
+			if _, err := b.publish(original, msg.Payload, map[string]string{HeaderRedrivenFrom: dlq}); err != nil {
+				return moved, fmt.Errorf("failed to redrive message %d of '%s' to '%s': %w", msg.Offset, dlq, original, err)
+			}
+			moved++
+		}
+		t.redriven = msg.Offset + 1
+	}
+
+	log.Printf("Redrove %d message(s) from '%s'", moved, dlq)
+	return moved, nil
+}
+
+// commitRedriven commits where the next Redrive of a durable topic
+// starts; t.redriveMu must be held
+func (t *topic) commitRedriven() {
+	if t.redrive == nil {
+		return
+	}
+	if err := t.redrive.commit(map[string]int64{redrivenKey: t.redriven}); err != nil {
+		log.Printf("Failed to commit the redrive position of topic '%s': %v", t.name, err)
+	}
+}
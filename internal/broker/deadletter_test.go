@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExhaustedMessageIsDeadLettered(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	dlq, err := b.Subscribe(DeadLetterTopic("jobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := b.Subscribe("jobs", WithAck(AckPolicy{MaxDeliveries: 2, DeadLetter: DeadLetterTopic("jobs")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("jobs", "poison")
+
+	var original Message
+	for i := 0; i < 2; i++ {
+		original = receive(t, ch)
+		b.Nack("jobs", ch, original.ID)
+	}
+
+	dead := receive(t, dlq)
+	want := map[string]string{
+		HeaderOriginalTopic:  "jobs",
+		HeaderOriginalOffset: "0",
+		HeaderOriginalID:     original.ID,
+		HeaderFailureReason:  ReasonMaxDeliveries,
+		HeaderAttempts:       "2",
+	}
+	for key, value := range want {
+		if dead.Headers[key] != value {
+			t.Errorf("header %s = %q, want %q", key, dead.Headers[key], value)
+		}
+	}
+	if dead.Payload != "poison" {
+		t.Errorf("payload %v, want poison", dead.Payload)
+	}
+}
+
+func TestRejectDeadLettersAtOnce(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	dlq, err := b.Subscribe("jobs.failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := b.Subscribe("jobs", WithAck(AckPolicy{DeadLetter: "jobs.failed"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("jobs", "bad")
+
+	msg := receive(t, ch)
+	if err := b.Reject("jobs", ch, msg.ID); err != nil {
+		t.Fatalf("Reject: %v", err)
+	}
+	dead := receive(t, dlq)
+	if dead.Headers[HeaderFailureReason] != ReasonRejected || dead.Headers[HeaderAttempts] != "1" {
+		t.Fatalf("headers %v, want reason %s after 1 attempt", dead.Headers, ReasonRejected)
+	}
+	expectNothing(t, ch, 100*time.Millisecond)
+}
+
+func TestRedriveMovesEachMessageOnce(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	ch, err := b.Subscribe("jobs", WithAck(AckPolicy{DeadLetter: DeadLetterTopic("jobs")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"a", "b", "c"} {
+		b.Publish("jobs", payload)
+		msg := receive(t, ch)
+		b.Reject("jobs", ch, msg.ID)
+	}
+	// Not dead-lettered by the broker, so it has nowhere to go back to
+	b.Publish(DeadLetterTopic("jobs"), "stray")
+
+	moved, err := b.Redrive(DeadLetterTopic("jobs"), 2)
+	if err != nil || moved != 2 {
+		t.Fatalf("Redrive = %d, %v; want 2", moved, err)
+	}
+	for _, want := range []string{"a", "b"} {
+		msg := receive(t, ch)
+		if msg.Payload != want || msg.Headers[HeaderRedrivenFrom] != DeadLetterTopic("jobs") {
+			t.Fatalf("got %v with headers %v, want %s redriven from the DLQ", msg.Payload, msg.Headers, want)
+		}
+		b.Ack("jobs", ch, msg.ID)
+	}
+
+	moved, err = b.Redrive(DeadLetterTopic("jobs"), 0)
+	if err != nil || moved != 1 {
+		t.Fatalf("second Redrive = %d, %v; want 1", moved, err)
+	}
+	if msg := receive(t, ch); msg.Payload != "c" {
+		t.Fatalf("got %v, want c", msg.Payload)
+	}
+
+	if moved, err := b.Redrive(DeadLetterTopic("jobs"), 0); err != nil || moved != 0 {
+		t.Fatalf("third Redrive = %d, %v; want 0", moved, err)
+	}
+	if _, err := b.Redrive("missing.dlq", 0); err == nil {
+		t.Fatal("Redrive of an unknown topic succeeded")
+	}
+}
+
+func TestRedrivePositionSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	b := openDurable(t, dir)
+
+	dlq := DeadLetterTopic("jobs")
+	headers := map[string]string{HeaderOriginalTopic: "jobs"}
+	b.publish(dlq, "stray", nil)
+	for _, payload := range []string{"a", "b", "c"} {
+		if _, err := b.publish(dlq, payload, headers); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The stray message is skipped and not counted
+	if moved, err := b.Redrive(dlq, 2); err != nil || moved != 2 {
+		t.Fatalf("Redrive = %d, %v; want 2", moved, err)
+	}
+	b.Close()
+
+	b = openDurable(t, dir)
+	defer b.Close()
+	if moved, err := b.Redrive(dlq, 0); err != nil || moved != 1 {
+		t.Fatalf("Redrive after restart = %d, %v; want 1", moved, err)
+	}
+
+	ch, err := b.Subscribe("jobs", StartAt(Earliest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		if msg := receive(t, ch); msg.Payload != want {
+			t.Fatalf("got %v, want %s", msg.Payload, want)
+		}
+	}
+	expectNothing(t, ch, 50*time.Millisecond)
+}
@@ -0,0 +1,374 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Balance decides which member of a group receives a message
+type Balance int
+
+const (
+	// RoundRobin hands messages to the members in turn, skipping members
+	// whose channel is full
+	RoundRobin Balance = iota
+	// LeastLoaded hands each message to the member with the fewest
+	// messages waiting in its channel
+	LeastLoaded
+)
+
+// String returns the name ParseBalance accepts
+func (b Balance) String() string {
+	if b == LeastLoaded {
+		return "least-loaded"
+	}
+	return "round-robin"
+}
+
+// ParseBalance parses "round-robin" or "least-loaded"
+func ParseBalance(s string) (Balance, error) {
+	for _, b := range []Balance{RoundRobin, LeastLoaded} {
+		if b.String() == s {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown balance %q", s)
+}
+
+// group is a cursor into a topic shared by its members: its dispatcher
+// goroutine reads the topic's store from next on and hands each message
+// to one member. A plain subscriber is the only member of an anonymous
+// group. A slow group falls behind rather than losing messages, and one
+// that starts in the past catches up before it sees new ones.
+//
+// A named group keeps its position while it has no members, so workers
+// that restart resume where the group left off. On a durable broker the
+// position is also committed next to the topic's log, so the group
+// resumes there after the broker restarts too; in memory it is lost with
+// the broker, and a group that falls more than MemoryRetention messages
+// behind skips the ones dropped meanwhile.
+//
+// With an AckPolicy the group also remembers every message it handed out
+// until a member acknowledges it, and sends it again otherwise.
+type group struct {
+	topic   *topic
+	name    string // "" for a plain subscriber
+	balance Balance
+	ack     *AckPolicy // nil forgets messages once they are handed out
+	giveUp  func(g *group, msg Message, reason string)
+
+	mu       sync.Mutex
+	next     int64 // where the dispatcher reads on; only it writes, under mu
+	members  []*member
+	leaving  []*member            // removed, but their channels not yet closed
+	pending  []Message            // unread by members that left, or to be redelivered; sent before next
+	inflight map[string]*delivery // handed out and not yet acknowledged, by message ID
+	turn     int                  // where RoundRobin continues
+	changed  chan struct{}        // closed and replaced when members join or leave, or a message is settled
+	running  bool                 // the dispatcher is active
+}
+
+// member is one subscriber of a group
+type member struct {
+	ch chan Message
+}
+
+func newGroup(t *topic, name string, balance Balance, ack *AckPolicy, start int64) *group {
+	return &group{
+		topic:    t,
+		name:     name,
+		balance:  balance,
+		ack:      ack,
+		next:     start,
+		inflight: make(map[string]*delivery),
+		changed:  make(chan struct{}),
+	}
+}
+
+// join adds m, starting the dispatcher if it is not running
+func (g *group) join(m *member, closed <-chan struct{}, wg *sync.WaitGroup) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.members = append(g.members, m)
+	g.notifyLocked()
+
+	if !g.running {
+		g.running = true
+		wg.Add(1)
+		go g.run(closed, wg)
+	}
+}
+
+// leave removes the member receiving on ch; the dispatcher closes ch. It
+// reports whether ch belonged to the group.
+func (g *group) leave(ch <-chan Message) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, m := range g.members {
+		if m.ch == ch {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			g.leaving = append(g.leaving, m)
+			g.notifyLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// position returns the offset the group would resume at if it were
+// restarted: the oldest message it handed out and still owes a member
+// for, or else the next one it reads
+func (g *group) position() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	position := g.next
+	for _, msg := range g.pending {
+		if msg.Offset < position {
+			position = msg.Offset
+		}
+	}
+	for _, d := range g.inflight {
+		if d.msg.Offset < position {
+			position = d.msg.Offset
+		}
+	}
+	return position
+}
+
+// memberCount returns the number of members
+func (g *group) memberCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.members)
+}
+
+func (g *group) notifyLocked() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// run is the dispatcher. It returns when the group has no members left or
+// the broker is closed.
+func (g *group) run(closed <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		// Take the signals before reading so no append slips in between
+		appended := g.topic.appendedSignal()
+		g.mu.Lock()
+		changed := g.changed
+		g.mu.Unlock()
+
+		if !g.deliverPending(closed) {
+			return
+		}
+
+		stopped := false
+		err := g.topic.store.ReadFrom(g.next, func(offset int64, msg Message) bool {
+			// Logs written before messages had IDs
+			if msg.ID == "" {
+				msg.ID = fmt.Sprintf("%s-%d", g.topic.name, offset)
+			}
+			// Redeliveries go before new messages
+			if !g.deliverPending(closed) || !g.deliver(msg, closed) {
+				stopped = true
+				return false
+			}
+			g.mu.Lock()
+			g.next = offset + 1
+			g.mu.Unlock()
+			return true
+		})
+		if stopped {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read topic '%s' at offset %d: %v", g.topic.name, g.next, err)
+		}
+
+		// Only now, with the messages just handed out among them, is the
+		// earliest deadline known
+		g.mu.Lock()
+		expiry := g.expiryLocked()
+		g.mu.Unlock()
+
+		select {
+		case <-appended:
+		case <-changed:
+			if !g.reap() {
+				return
+			}
+		case <-expiry:
+			g.expire()
+		case <-closed:
+			g.shutdown()
+			return
+		}
+	}
+}
+
+// deliverPending sends the messages handed back by members that left or
+// due for redelivery
+func (g *group) deliverPending(closed <-chan struct{}) bool {
+	for {
+		g.mu.Lock()
+		if len(g.pending) == 0 {
+			g.mu.Unlock()
+			return true
+		}
+		msg := g.pending[0]
+		g.mu.Unlock()
+
+		if !g.deliver(msg, closed) {
+			return false
+		}
+
+		g.mu.Lock()
+		g.pending = g.pending[1:]
+		g.mu.Unlock()
+	}
+}
+
+// deliver hands msg to one member, waiting while every member's channel
+// is full, or, with acknowledgements, while too many messages await them.
+// It returns false if the dispatcher must stop instead.
+func (g *group) deliver(msg Message, closed <-chan struct{}) bool {
+	if g.ack != nil {
+		msg.Deliveries++
+		if g.exhausted(msg) {
+			return true
+		}
+		if !g.waitForRoom(closed) {
+			return false
+		}
+		g.track(msg)
+	}
+
+	for {
+		if !g.reap() {
+			return false
+		}
+
+		g.mu.Lock()
+		order := g.preferenceLocked()
+		changed := g.changed
+		g.mu.Unlock()
+
+		for _, m := range order {
+			select {
+			case m.ch <- msg:
+				g.delivered(m, msg)
+				return true
+			default:
+			}
+		}
+
+		// All full: the first member with room gets it
+		cases := make([]reflect.SelectCase, 0, len(order)+2)
+		for _, m := range order {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(m.ch), Send: reflect.ValueOf(msg)})
+		}
+		cases = append(cases,
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(changed)},
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(closed)},
+		)
+
+		chosen, _, _ := reflect.Select(cases)
+		switch {
+		case chosen < len(order):
+			g.delivered(order[chosen], msg)
+			return true
+		case chosen == len(order)+1:
+			g.shutdown()
+			return false
+		}
+		// Members changed; choose again
+	}
+}
+
+// preferenceLocked returns the members in the order the balance prefers
+func (g *group) preferenceLocked() []*member {
+	n := len(g.members)
+	order := make([]*member, 0, n)
+	for i := 0; i < n; i++ {
+		order = append(order, g.members[(g.turn+i)%n])
+	}
+	if g.balance == LeastLoaded {
+		sort.SliceStable(order, func(i, j int) bool { return len(order[i].ch) < len(order[j].ch) })
+	}
+	return order
+}
+
+// delivered moves the round-robin turn past m and, with
+// acknowledgements, starts the deadline of msg
+func (g *group) delivered(m *member, msg Message) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if d, ok := g.inflight[msg.ID]; ok {
+		d.member = m
+		d.deadline = time.Now().Add(g.ack.Deadline)
+	}
+	for i, candidate := range g.members {
+		if candidate == m {
+			g.turn = i + 1
+			return
+		}
+	}
+}
+
+// reap closes the channels of members that left, keeping what they had
+// not read, and with acknowledgements what they had not acknowledged, for
+// the others. It returns false, and marks the dispatcher as stopped, once
+// the group has no members.
+func (g *group) reap() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, m := range g.leaving {
+		unread := make(map[string]bool)
+	drain:
+		for {
+			select {
+			case msg := <-m.ch:
+				if g.ack == nil {
+					g.pending = append(g.pending, msg)
+				}
+				unread[msg.ID] = true
+			default:
+				break drain
+			}
+		}
+		close(m.ch)
+		if g.ack != nil {
+			g.requeueHeldLocked(m, unread)
+		}
+	}
+	g.leaving = nil
+
+	if len(g.members) == 0 {
+		g.running = false
+		return false
+	}
+	return true
+}
+
+// shutdown closes every member's channel when the broker closes
+func (g *group) shutdown() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, m := range append(g.members, g.leaving...) {
+		close(m.ch)
+	}
+	g.members = nil
+	g.leaving = nil
+	g.running = false
+}
@@ -0,0 +1,154 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNamedGroupResumesAfterMembersLeave(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	ch, err := b.Subscribe("jobs", WithGroup("workers"), StartAt(Earliest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishN(t, b, "jobs", 3)
+	for i := 0; i < 3; i++ {
+		receive(t, ch)
+	}
+	b.Unsubscribe("jobs", ch)
+	publishN(t, b, "jobs", 2)
+
+	// The group kept its position; StartAt only applies to a new group
+	ch, err = b.Subscribe("jobs", WithGroup("workers"), StartAt(Earliest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := int64(3); want < 5; want++ {
+		if msg := receive(t, ch); msg.Offset != want {
+			t.Fatalf("got offset %d, want %d", msg.Offset, want)
+		}
+	}
+	expectNothing(t, ch, 50*time.Millisecond)
+}
+
+// subscribeAll subscribes n members with opts and fails the test on error
+func subscribeAll(t *testing.T, b *Broker, topic string, n int, opts ...SubscribeOption) []<-chan Message {
+	t.Helper()
+
+	chans := make([]<-chan Message, n)
+	for i := range chans {
+		ch, err := b.Subscribe(topic, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chans[i] = ch
+	}
+	return chans
+}
+
+func TestGroupRoundRobin(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	members := subscribeAll(t, b, "jobs", 3, WithGroup("workers"))
+	publishN(t, b, "jobs", 6)
+
+	for i, ch := range members {
+		for _, want := range []int64{int64(i), int64(i + 3)} {
+			if msg := receive(t, ch); msg.Offset != want {
+				t.Fatalf("member %d got offset %d, want %d", i, msg.Offset, want)
+			}
+		}
+		expectNothing(t, ch, 20*time.Millisecond)
+	}
+}
+
+func TestGroupLeastLoaded(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	// The first member never reads the 5 messages it gets alone
+	busy, err := b.Subscribe("jobs", WithGroup("workers"), WithBalance(LeastLoaded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishN(t, b, "jobs", 5)
+	waitFor(t, func() bool { return len(busy) == 5 })
+
+	idle, err := b.Subscribe("jobs", WithGroup("workers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishN(t, b, "jobs", 4)
+	for want := int64(5); want < 9; want++ {
+		if msg := receive(t, idle); msg.Offset != want {
+			t.Fatalf("idle member got offset %d, want %d", msg.Offset, want)
+		}
+	}
+	if len(busy) != 5 {
+		t.Fatalf("busy member has %d messages waiting, want 5: new ones go to the idle member", len(busy))
+	}
+}
+
+func TestGroupsEachGetACopy(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	workers := subscribeAll(t, b, "jobs", 2, WithGroup("workers"))
+	audit := subscribeAll(t, b, "jobs", 1, WithGroup("audit"))[0]
+	plain := subscribeAll(t, b, "jobs", 1)[0]
+	publishN(t, b, "jobs", 4)
+
+	for _, ch := range []<-chan Message{audit, plain} {
+		for want := int64(0); want < 4; want++ {
+			if msg := receive(t, ch); msg.Offset != want {
+				t.Fatalf("got offset %d, want %d", msg.Offset, want)
+			}
+		}
+	}
+	for _, ch := range workers {
+		receive(t, ch)
+		receive(t, ch)
+		expectNothing(t, ch, 20*time.Millisecond)
+	}
+}
+
+func TestGroupRebalancesWhenMemberLeaves(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	members := subscribeAll(t, b, "jobs", 2, WithGroup("workers"))
+	publishN(t, b, "jobs", 4)
+	waitFor(t, func() bool { return len(members[0]) == 2 && len(members[1]) == 2 })
+
+	// The messages the leaving member did not read go to the other one
+	b.Unsubscribe("jobs", members[1])
+	got := map[int64]bool{}
+	for i := 0; i < 4; i++ {
+		got[receive(t, members[0]).Offset] = true
+	}
+	if len(got) != 4 {
+		t.Fatalf("remaining member got offsets %v, want 0..3 once each", got)
+	}
+	expectNothing(t, members[0], 50*time.Millisecond)
+
+	publishN(t, b, "jobs", 1)
+	if msg := receive(t, members[0]); msg.Offset != 4 {
+		t.Fatalf("got offset %d, want 4", msg.Offset)
+	}
+}
+
+// waitFor fails the test if cond does not hold within a second
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,590 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when appended records reach stable storage
+type SyncPolicy int
+
+const (
+	// SyncInterval fsyncs in the background every LogConfig.SyncEvery; a
+	// crash loses at most that much
+	SyncInterval SyncPolicy = iota
+	// SyncAlways fsyncs before Append returns
+	SyncAlways
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+// String returns the policy's flag name
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncNever:
+		return "never"
+	default:
+		return "interval"
+	}
+}
+
+// ParseSyncPolicy parses "always", "interval" or "never"
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q", s)
+}
+
+// Defaults for LogConfig fields left at zero
+const (
+	DefaultSegmentBytes = 16 << 20
+	DefaultSyncEvery    = time.Second
+)
+
+// maxRecordBytes bounds a record body; larger sizes mean corruption
+const maxRecordBytes = 64 << 20
+
+// recordHeaderSize is the body size and CRC in front of every record
+const recordHeaderSize = 8
+
+// indexInterval is the number of segment bytes between two entries of a
+// segment's sparse index
+const indexInterval = 4 << 10
+
+// crcTable is CRC-32C, which has hardware support on common CPUs
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupt marks a record that fails validation
+var errCorrupt = errors.New("corrupt record")
+
+// LogConfig configures the on-disk log of a durable broker
+type LogConfig struct {
+	// Dir holds one subdirectory of segment files per topic
+	Dir string
+	// SegmentBytes is the size at which a new segment is started
+	SegmentBytes int64
+	// Sync is the fsync policy
+	Sync SyncPolicy
+	// SyncEvery is the fsync period of SyncInterval
+	SyncEvery time.Duration
+}
+
+// withDefaults fills in zero fields
+func (c LogConfig) withDefaults() LogConfig {
+	if c.SegmentBytes <= 0 {
+		c.SegmentBytes = DefaultSegmentBytes
+	}
+	if c.SyncEvery <= 0 {
+		c.SyncEvery = DefaultSyncEvery
+	}
+	return c
+}
+
+// Log is the append-only log of one topic. It is split into segment files
+// named after the offset of their first record:
+//
+//	<dir>/00000000000000000000.log
+//	<dir>/00000000000000052113.log
+//
+// Each record is framed as
+//
+//	size   uint32  length of the body
+//	crc    uint32  CRC-32C of the body
+//	body   offset int64 | timestamp int64 (Unix ns) | JSON Message
+//
+// all big-endian. Opening a log scans every segment; a torn or corrupt
+// tail of the newest segment, as left by a crash mid-write, is truncated.
+// The scan also builds a sparse in-memory index per segment, so reads
+// seek close to their start offset instead of scanning the segment.
+type Log struct {
+	dir    string
+	config LogConfig
+
+	mu       sync.Mutex
+	segments []*segment // ordered by base offset; the last one is active
+	next     int64      // offset of the next record
+	dirty    bool       // written since the last fsync
+	closed   bool
+	failed   error // a failed append that could not be undone
+
+	stopSync chan struct{}
+	syncDone chan struct{}
+}
+
+// segment is one file of a Log
+type segment struct {
+	base  int64
+	path  string
+	file  segmentFile // open for appending
+	size  int64
+	index []indexEntry // one record every indexInterval bytes, guarded by Log.mu
+}
+
+// indexEntry is the byte position of the record with an offset
+type indexEntry struct {
+	offset   int64
+	position int64
+}
+
+// noteRecord adds the record at position to the sparse index if it is
+// far enough from the last entry; Log.mu must be held
+func (s *segment) noteRecord(offset, position int64) {
+	if n := len(s.index); n == 0 || position-s.index[n-1].position >= indexInterval {
+		s.index = append(s.index, indexEntry{offset: offset, position: position})
+	}
+}
+
+// seek returns the last index entry at or before offset, or the start of
+// the segment; Log.mu must be held
+func (s *segment) seek(offset int64) indexEntry {
+	i := sort.Search(len(s.index), func(i int) bool { return s.index[i].offset > offset }) - 1
+	if i < 0 {
+		return indexEntry{offset: s.base}
+	}
+	return s.index[i]
+}
+
+// segmentFile is the part of *os.File a segment writes through
+type segmentFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+// OpenLog opens or creates the log in dir, recovering its segments
+func OpenLog(dir string, config LogConfig) (*Log, error) {
+	config = config.withDefaults()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	l := &Log{dir: dir, config: config}
+	if err := l.recover(); err != nil {
+		l.closeFiles()
+		return nil, err
+	}
+
+	if config.Sync == SyncInterval {
+		l.stopSync = make(chan struct{})
+		l.syncDone = make(chan struct{})
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+// recover opens the existing segments, validating every record, and
+// creates the first segment of a new log
+func (l *Log) recover() error {
+	bases, err := segmentBases(l.dir)
+	if err != nil {
+		return err
+	}
+
+	for i, base := range bases {
+		path := filepath.Join(l.dir, segmentName(base))
+		if base != l.next && i > 0 {
+			return fmt.Errorf("%s: expected segment starting at offset %d", path, l.next)
+		}
+		l.next = base
+
+		seg := &segment{base: base, path: path}
+		valid, next, err := scanSegment(path, indexEntry{offset: base}, func(offset, position int64, _ []byte) bool {
+			seg.noteRecord(offset, position)
+			return true
+		})
+		if err != nil && !errors.Is(err, errCorrupt) {
+			return err
+		}
+		if err != nil {
+			if i < len(bases)-1 {
+				return fmt.Errorf("%s: %w at byte %d", path, err, valid)
+			}
+			// A crash can leave a partly written record behind
+			log.Printf("Truncating %s at byte %d: %v", path, valid, err)
+			if err := os.Truncate(path, valid); err != nil {
+				return fmt.Errorf("failed to truncate %s: %w", path, err)
+			}
+		}
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open segment: %w", err)
+		}
+		seg.file, seg.size = file, valid
+		l.segments = append(l.segments, seg)
+		l.next = next
+	}
+
+	if len(l.segments) == 0 {
+		return l.roll()
+	}
+	return nil
+}
+
+// Append writes msg as the next record and returns its offset. Whether it
+// is on stable storage when Append returns depends on the SyncPolicy. If
+// it fails nothing was appended, so a retry gets the same offset.
+func (l *Log) Append(msg Message) (int64, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, errors.New("log is closed")
+	}
+	if l.failed != nil {
+		return 0, l.failed
+	}
+
+	offset := l.next
+	record := encodeRecord(offset, msg.Timestamp, data)
+
+	active := l.segments[len(l.segments)-1]
+	if active.size > 0 && active.size+int64(len(record)) > l.config.SegmentBytes {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+		active = l.segments[len(l.segments)-1]
+	}
+
+	if n, err := active.file.Write(record); err != nil {
+		if n > 0 {
+			// Cut off the partial record so the next append starts cleanly
+			l.undoWrite(active)
+		}
+		return 0, fmt.Errorf("failed to write record: %w", err)
+	}
+
+	switch l.config.Sync {
+	case SyncAlways:
+		if err := active.file.Sync(); err != nil {
+			// The caller sees a failure and may retry; the record must
+			// not stay behind to be read twice
+			l.undoWrite(active)
+			return 0, fmt.Errorf("failed to sync log: %w", err)
+		}
+	case SyncInterval:
+		l.dirty = true
+	}
+
+	active.noteRecord(offset, active.size)
+	active.size += int64(len(record))
+	l.next++
+	return offset, nil
+}
+
+// undoWrite cuts the active segment back to the size before the failed
+// append. If that fails too, the record's fate is unknown and the log
+// refuses further appends. l.mu must be held.
+func (l *Log) undoWrite(active *segment) {
+	if err := active.file.Truncate(active.size); err != nil {
+		l.failed = fmt.Errorf("log unusable after failed append: %w", err)
+		log.Printf("Failed to truncate %s after a failed append: %v", active.path, err)
+	}
+}
+
+// roll starts a new segment at the next offset; l.mu must be held
+func (l *Log) roll() error {
+	if n := len(l.segments); n > 0 {
+		// The old segment will not be written again
+		if err := l.segments[n-1].file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync segment: %w", err)
+		}
+	}
+
+	path := filepath.Join(l.dir, segmentName(l.next))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+	l.segments = append(l.segments, &segment{base: l.next, path: path, file: file})
+	return syncDir(l.dir)
+}
+
+// ReadFrom calls fn for every record from offset on, in order, until fn
+// returns false or the end of the log is reached. It seeks to the nearest
+// index entry before offset and decodes only the records it passes to fn.
+func (l *Log) ReadFrom(offset int64, fn func(offset int64, msg Message) bool) error {
+	l.mu.Lock()
+	segments := append([]*segment(nil), l.segments...)
+	end := l.next
+	// Start with the last segment beginning at or before offset
+	first := sort.Search(len(segments), func(i int) bool { return segments[i].base > offset }) - 1
+	if first < 0 {
+		first = 0
+	}
+	start := segments[first].seek(offset)
+	l.mu.Unlock()
+
+	for i, seg := range segments[first:] {
+		if i > 0 {
+			start = indexEntry{offset: seg.base}
+		}
+
+		stopped := false
+		var decodeErr error
+		_, next, err := scanSegment(seg.path, start, func(o, _ int64, data []byte) bool {
+			if o >= end {
+				return false
+			}
+			if o < offset {
+				return true
+			}
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				decodeErr = fmt.Errorf("%w: offset %d: %v", errCorrupt, o, err)
+				return false
+			}
+			msg.Offset = o
+			if !fn(o, msg) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return nil
+		}
+		if decodeErr != nil {
+			return decodeErr
+		}
+		// A record being appended right now may look cut short; everything
+		// before end was complete
+		if err != nil && !errors.Is(err, errStopScan) && next < end {
+			return err
+		}
+	}
+	return nil
+}
+
+// NextOffset returns the offset the next appended record will get
+func (l *Log) NextOffset() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next
+}
+
+// OldestOffset returns the offset of the first record in the log
+func (l *Log) OldestOffset() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.segments[0].base
+}
+
+// OffsetForTime returns the offset of the first record with a timestamp at
+// or after t, or NextOffset if there is none. It scans the log from the
+// start, which is fine for the occasional replay by time.
+func (l *Log) OffsetForTime(t time.Time) (int64, error) {
+	found := l.NextOffset()
+	err := l.ReadFrom(l.OldestOffset(), func(offset int64, msg Message) bool {
+		if msg.Timestamp.Before(t) {
+			return true
+		}
+		found = offset
+		return false
+	})
+	return found, err
+}
+
+// Sync flushes the active segment to stable storage
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncLocked()
+}
+
+func (l *Log) syncLocked() error {
+	if l.closed || !l.dirty {
+		return nil
+	}
+	if err := l.segments[len(l.segments)-1].file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync log: %w", err)
+	}
+	l.dirty = false
+	return nil
+}
+
+// syncLoop implements SyncInterval
+func (l *Log) syncLoop() {
+	defer close(l.syncDone)
+
+	ticker := time.NewTicker(l.config.SyncEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Sync(); err != nil {
+				log.Printf("Background sync of %s failed: %v", l.dir, err)
+			}
+		case <-l.stopSync:
+			return
+		}
+	}
+}
+
+// Close flushes and closes the log
+func (l *Log) Close() error {
+	if l.stopSync != nil {
+		close(l.stopSync)
+		<-l.syncDone
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.dirty = true
+	err := l.syncLocked()
+	l.closed = true
+	l.closeFiles()
+	return err
+}
+
+func (l *Log) closeFiles() {
+	for _, seg := range l.segments {
+		seg.file.Close()
+	}
+}
+
+// encodeRecord frames one record
+func encodeRecord(offset int64, timestamp time.Time, data []byte) []byte {
+	bodySize := 16 + len(data)
+	record := make([]byte, recordHeaderSize+bodySize)
+
+	body := record[recordHeaderSize:]
+	binary.BigEndian.PutUint64(body[0:8], uint64(offset))
+	binary.BigEndian.PutUint64(body[8:16], uint64(timestamp.UnixNano()))
+	copy(body[16:], data)
+
+	binary.BigEndian.PutUint32(record[0:4], uint32(bodySize))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(body, crcTable))
+	return record
+}
+
+// errStopScan is returned by scanSegment when fn asked to stop
+var errStopScan = errors.New("scan stopped")
+
+// scanSegment reads the segment at path from the record at
+// start.position, whose offset is start.offset, validating each record
+// and passing its offset, position and JSON message to visit if visit is
+// not nil. The message is only valid during the call. It returns the end
+// of the valid records and the offset after them. A record that is cut
+// short or fails validation yields an error wrapping errCorrupt.
+func scanSegment(path string, start indexEntry, visit func(offset, position int64, data []byte) bool) (valid int64, next int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, start.offset, fmt.Errorf("failed to open segment: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(start.position, io.SeekStart); err != nil {
+		return 0, start.offset, fmt.Errorf("failed to seek segment: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	valid, next = start.position, start.offset
+	var header [recordHeaderSize]byte
+	var body []byte
+
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err == io.EOF {
+				return valid, next, nil
+			}
+			return valid, next, fmt.Errorf("%w: truncated header", errCorrupt)
+		}
+
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size < 16 || size > maxRecordBytes {
+			return valid, next, fmt.Errorf("%w: bad size %d", errCorrupt, size)
+		}
+
+		if cap(body) < int(size) {
+			body = make([]byte, size)
+		}
+		body = body[:size]
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return valid, next, fmt.Errorf("%w: truncated body", errCorrupt)
+		}
+		if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return valid, next, fmt.Errorf("%w: checksum mismatch", errCorrupt)
+		}
+
+		offset := int64(binary.BigEndian.Uint64(body[0:8]))
+		if offset != next {
+			return valid, next, fmt.Errorf("%w: offset %d, expected %d", errCorrupt, offset, next)
+		}
+
+		if visit != nil && !visit(offset, valid, body[16:]) {
+			return valid, next, errStopScan
+		}
+
+		valid += int64(recordHeaderSize) + int64(size)
+		next++
+	}
+}
+
+// segmentName is the file name of the segment starting at base
+func segmentName(base int64) string {
+	return fmt.Sprintf("%020d.log", base)
+}
+
+// segmentBases lists the base offsets of the segments in dir, in order
+func segmentBases(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list segments: %w", err)
+	}
+
+	var bases []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		var base int64
+		if _, err := fmt.Sscanf(name, "%020d.log", &base); err != nil || segmentName(base) != name {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return bases, nil
+}
+
+// syncDir makes a new file's directory entry durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openLog opens a log in dir that is closed when the test ends
+func openLog(t *testing.T, dir string, config LogConfig) *Log {
+	t.Helper()
+
+	config.Dir = dir
+	l, err := OpenLog(dir, config)
+	if err != nil {
+		t.Fatalf("OpenLog: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// appendN appends messages with payloads "m<offset>"
+func appendN(t *testing.T, l *Log, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		offset := l.NextOffset()
+		got, err := l.Append(Message{Payload: fmt.Sprintf("m%d", offset), Timestamp: time.Now()})
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		if got != offset {
+			t.Fatalf("Append returned offset %d, want %d", got, offset)
+		}
+	}
+}
+
+// readAll returns the payloads from offset on and checks their offsets
+func readAll(t *testing.T, l *Log, offset int64) []string {
+	t.Helper()
+
+	var payloads []string
+	want := offset
+	err := l.ReadFrom(offset, func(o int64, msg Message) bool {
+		if o != want || msg.Offset != o {
+			t.Fatalf("record at offset %d (message says %d), want %d", o, msg.Offset, want)
+		}
+		want++
+		payloads = append(payloads, msg.Payload.(string))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ReadFrom(%d): %v", offset, err)
+	}
+	return payloads
+}
+
+func TestLogAppendReadAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, LogConfig{SegmentBytes: 256, Sync: SyncNever})
+	appendN(t, l, 20)
+
+	if len(l.segments) < 2 {
+		t.Fatalf("%d segments; want the log to roll at 256 bytes", len(l.segments))
+	}
+	if got := readAll(t, l, 13); len(got) != 7 || got[0] != "m13" || got[6] != "m19" {
+		t.Fatalf("ReadFrom(13) = %v", got)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	l = openLog(t, dir, LogConfig{SegmentBytes: 256, Sync: SyncNever})
+	if l.NextOffset() != 20 || l.OldestOffset() != 0 {
+		t.Fatalf("reopened log spans %d..%d, want 0..20", l.OldestOffset(), l.NextOffset())
+	}
+	appendN(t, l, 1)
+	if got := readAll(t, l, 0); len(got) != 21 || got[20] != "m20" {
+		t.Fatalf("ReadFrom(0) after reopen = %v", got)
+	}
+}
+
+func TestLogTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, LogConfig{Sync: SyncNever})
+	appendN(t, l, 3)
+	path := l.segments[0].path
+	l.Close()
+
+	// A crash halfway through the fourth record
+	record := encodeRecord(3, time.Now(), []byte(`{"payload":"m3"}`))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(record[:len(record)/2])
+	file.Close()
+
+	l = openLog(t, dir, LogConfig{Sync: SyncNever})
+	if l.NextOffset() != 3 {
+		t.Fatalf("NextOffset = %d after recovery, want 3", l.NextOffset())
+	}
+	appendN(t, l, 1)
+	if got := readAll(t, l, 0); len(got) != 4 || got[3] != "m3" {
+		t.Fatalf("ReadFrom(0) = %v", got)
+	}
+}
+
+func TestLogRejectsCorruptOlderSegment(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, LogConfig{SegmentBytes: 128, Sync: SyncNever})
+	appendN(t, l, 6)
+	first := l.segments[0].path
+	l.Close()
+
+	data, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(first, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenLog(dir, LogConfig{Dir: dir}); err == nil || !errors.Is(err, errCorrupt) {
+		t.Fatalf("OpenLog = %v, want a corrupt record error", err)
+	}
+}
+
+// failingSync fails the next Sync calls
+type failingSync struct {
+	*os.File
+	failures int
+}
+
+func (f *failingSync) Sync() error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("injected fsync failure")
+	}
+	return f.File.Sync()
+}
+
+func TestLogSyncFailureLeavesNoRecord(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, LogConfig{Sync: SyncAlways})
+	appendN(t, l, 2)
+
+	active := l.segments[len(l.segments)-1]
+	active.file = &failingSync{File: active.file.(*os.File), failures: 1}
+	size := active.size
+
+	if _, err := l.Append(Message{Payload: "m2", Timestamp: time.Now()}); err == nil {
+		t.Fatal("Append succeeded despite the fsync failure")
+	}
+	if l.NextOffset() != 2 {
+		t.Fatalf("NextOffset = %d after a failed append, want 2", l.NextOffset())
+	}
+	if info, err := os.Stat(active.path); err != nil || info.Size() != size {
+		t.Fatalf("segment is %d bytes (%v), want it cut back to %d", info.Size(), err, size)
+	}
+
+	// The retry gets the same offset and the record appears once
+	appendN(t, l, 2)
+	l.Close()
+
+	l = openLog(t, dir, LogConfig{Sync: SyncAlways})
+	if got := readAll(t, l, 0); len(got) != 4 || got[2] != "m2" || got[3] != "m3" {
+		t.Fatalf("ReadFrom(0) after reopen = %v", got)
+	}
+}
+
+func TestLogOffsetForTime(t *testing.T) {
+	l := openLog(t, t.TempDir(), LogConfig{Sync: SyncNever})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := l.Append(Message{Payload: "m", Timestamp: start.Add(time.Duration(i) * time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		at   time.Time
+		want int64
+	}{
+		{start.Add(-time.Hour), 0},
+		{start.Add(2 * time.Second), 2},
+		{start.Add(2500 * time.Millisecond), 3},
+		{start.Add(time.Hour), 5},
+	} {
+		if got, err := l.OffsetForTime(tt.at); err != nil || got != tt.want {
+			t.Errorf("OffsetForTime(%v) = %d, %v; want %d", tt.at.Sub(start), got, err, tt.want)
+		}
+	}
+}
+
+func TestSegmentBasesIgnoresOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{segmentName(7), segmentName(0), "offsets.json", "7.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bases, err := segmentBases(dir)
+	if err != nil || len(bases) != 2 || bases[0] != 0 || bases[1] != 7 {
+		t.Fatalf("segmentBases = %v, %v; want [0 7]", bases, err)
+	}
+}
+
+func TestLogReadFromSeeksPastEarlierRecords(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, LogConfig{Sync: SyncNever})
+	appendN(t, l, 2000)
+
+	seg := l.segments[0]
+	if len(seg.index) < 2 {
+		t.Fatalf("index has %d entries for %d bytes", len(seg.index), seg.size)
+	}
+	// Every record is larger than its header, which bounds how far back
+	// the nearest entry can be
+	entry := seg.seek(1500)
+	if entry.offset > 1500 || 1500-entry.offset > indexInterval/recordHeaderSize {
+		t.Fatalf("seek(1500) = %+v, not near the offset", entry)
+	}
+
+	// Damage the first record: reads starting past it never look at it
+	file, err := os.OpenFile(seg.path, os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0xff}, recordHeaderSize+20)
+	file.Close()
+
+	if got := readAll(t, l, 1500); len(got) != 500 || got[0] != "m1500" {
+		t.Fatalf("ReadFrom(1500) = %d messages starting %v", len(got), got[:1])
+	}
+	if err := l.ReadFrom(0, func(int64, Message) bool { return true }); !errors.Is(err, errCorrupt) {
+		t.Fatalf("ReadFrom(0) over the damaged record = %v, want errCorrupt", err)
+	}
+}
+
+func TestLogIndexRebuiltOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, LogConfig{Sync: SyncNever})
+	appendN(t, l, 500)
+	index := append([]indexEntry(nil), l.segments[0].index...)
+	l.Close()
+
+	l = openLog(t, dir, LogConfig{Sync: SyncNever})
+	if fmt.Sprint(l.segments[0].index) != fmt.Sprint(index) {
+		t.Fatalf("index after reopen = %v, want %v", l.segments[0].index, index)
+	}
+}
+
+func BenchmarkLogReadTail(b *testing.B) {
+	l, err := OpenLog(b.TempDir(), LogConfig{Sync: SyncNever})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 100000; i++ {
+		if _, err := l.Append(Message{Payload: "payload", Timestamp: time.Now()}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.ReadFrom(l.NextOffset()-10, func(int64, Message) bool { return true })
+	}
+}
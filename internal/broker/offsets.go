@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Files next to a durable topic's log segments holding committed
+// positions
+const (
+	// groupOffsetsFile holds the positions of the topic's named groups
+	groupOffsetsFile = "groups.json"
+	// redriveFile holds, under redrivenKey, where the next Redrive of the
+	// topic starts
+	redriveFile = "redrive.json"
+	redrivenKey = "redriven"
+)
+
+// offsetStore commits named positions in a topic: those of its named
+// groups, or how far Redrive got. A crash loses at most the progress
+// since the last commit, which is then done again.
+type offsetStore struct {
+	path string
+
+	mu        sync.Mutex
+	committed map[string]int64 // name -> offset it resumes at
+}
+
+// openOffsetStore loads the positions committed in the file at path, if
+// it exists
+func openOffsetStore(path string) (*offsetStore, error) {
+	s := &offsetStore{
+		path:      path,
+		committed: make(map[string]int64),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read committed offsets: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.committed); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", s.path, err)
+	}
+	return s, nil
+}
+
+// get returns the committed position of the named group
+func (s *offsetStore) get(name string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, ok := s.committed[name]
+	return offset, ok
+}
+
+// commit records positions, keeping those of groups not listed, and
+// replaces the file atomically if anything changed
+func (s *offsetStore) commit(positions map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for name, offset := range positions {
+		if old, ok := s.committed[name]; !ok || old != offset {
+			s.committed[name] = offset
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.committed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode committed offsets: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write committed offsets: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write committed offsets: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync committed offsets: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write committed offsets: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace committed offsets: %w", err)
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+// commitOffsets commits the position of every named group of the
+// durable topics
+func (b *Broker) commitOffsets() {
+	type commit struct {
+		topic     *topic
+		positions map[string]int64
+	}
+
+	b.mu.RLock()
+	var commits []commit
+	for _, t := range b.topics {
+		if t.offsets == nil {
+			continue
+		}
+		positions := make(map[string]int64)
+		for _, g := range t.groups {
+			if g.name != "" {
+				positions[g.name] = g.position()
+			}
+		}
+		if len(positions) > 0 {
+			commits = append(commits, commit{t, positions})
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, c := range commits {
+		if err := c.topic.offsets.commit(c.positions); err != nil {
+			log.Printf("Failed to commit group offsets of topic '%s': %v", c.topic.name, err)
+		}
+	}
+}
+
+// commitLoop commits group positions every interval until the broker is
+// closed
+func (b *Broker) commitLoop(interval time.Duration) {
+	defer close(b.commitDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.commitOffsets()
+		case <-b.closeChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package broker
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openDurable opens a broker logging to dir that commits group offsets
+// every 20ms
+func openDurable(t *testing.T, dir string) *Broker {
+	t.Helper()
+
+	b, err := Open(Config{Log: &LogConfig{Dir: dir, Sync: SyncInterval, SyncEvery: 20 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return b
+}
+
+func TestGroupOffsetsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	b := openDurable(t, dir)
+
+	workers, err := b.Subscribe("jobs", WithGroup("workers"), WithAck(AckPolicy{}), StartAt(Earliest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := b.Subscribe("jobs", WithGroup("audit"), StartAt(Earliest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishN(t, b, "jobs", 5)
+
+	// Offsets 3 and 4 are received but never acknowledged
+	for i := 0; i < 5; i++ {
+		msg := receive(t, workers)
+		if msg.Offset < 3 {
+			if err := b.Ack("jobs", workers, msg.ID); err != nil {
+				t.Fatalf("Ack: %v", err)
+			}
+		}
+		receive(t, audit)
+	}
+	b.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, "jobs", groupOffsetsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var committed map[string]int64
+	if err := json.Unmarshal(data, &committed); err != nil || committed["workers"] != 3 || committed["audit"] != 5 {
+		t.Fatalf("committed %s (%v), want workers at 3 and audit at 5", data, err)
+	}
+
+	b = openDurable(t, dir)
+	defer b.Close()
+
+	// The committed position wins over StartAt
+	workers, err = b.Subscribe("jobs", WithGroup("workers"), WithAck(AckPolicy{}), StartAt(Latest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := int64(3); want < 5; want++ {
+		if msg := receive(t, workers); msg.Offset != want {
+			t.Fatalf("workers got offset %d after restart, want %d", msg.Offset, want)
+		}
+	}
+
+	audit, err = b.Subscribe("jobs", WithGroup("audit"), StartAt(Earliest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, audit, 50*time.Millisecond)
+	publishN(t, b, "jobs", 1)
+	if msg := receive(t, audit); msg.Offset != 5 {
+		t.Fatalf("audit got offset %d after restart, want 5", msg.Offset)
+	}
+
+	// A group never seen before still starts where it asks to
+	fresh, err := b.Subscribe("jobs", WithGroup("fresh"), StartAt(Earliest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, fresh); msg.Offset != 0 {
+		t.Fatalf("new group got offset %d, want 0", msg.Offset)
+	}
+}
+
+func TestGroupOffsetsCommittedPeriodically(t *testing.T) {
+	dir := t.TempDir()
+	b := openDurable(t, dir)
+	defer b.Close()
+
+	ch, err := b.Subscribe("jobs", WithGroup("workers"), StartAt(Earliest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishN(t, b, "jobs", 2)
+	receive(t, ch)
+	receive(t, ch)
+
+	// Without Close, as after a crash
+	deadline := time.Now().Add(time.Second)
+	for {
+		s, err := openOffsetStore(filepath.Join(dir, "jobs", groupOffsetsFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, ok := s.get("workers")
+		if ok && offset == 2 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("workers at %d (%v) a second after reading, want 2", offset, ok)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOffsetStoreCommit(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openOffsetStore(filepath.Join(dir, groupOffsetsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.get("a"); ok {
+		t.Fatal("empty store has a position for a")
+	}
+
+	if err := s.commit(map[string]int64{"a": 1, "b": 2}); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := s.commit(map[string]int64{"a": 5}); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// An unchanged commit does not rewrite the file
+	path := filepath.Join(dir, groupOffsetsFile)
+	before, _ := os.Stat(path)
+	if err := s.commit(map[string]int64{"a": 5, "b": 2}); err != nil {
+		t.Fatalf("unchanged commit: %v", err)
+	}
+	if after, _ := os.Stat(path); !os.SameFile(before, after) {
+		t.Fatal("unchanged commit replaced the file")
+	}
+
+	s, err = openOffsetStore(filepath.Join(dir, groupOffsetsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := s.get("a"); a != 5 {
+		t.Fatalf("a at %d after reopen, want 5", a)
+	}
+	if b, _ := s.get("b"); b != 2 {
+		t.Fatalf("b at %d after reopen, want 2: commits keep groups they do not list", b)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openOffsetStore(filepath.Join(dir, groupOffsetsFile)); err == nil {
+		t.Fatal("openOffsetStore accepted a damaged file")
+	}
+}
@@ -0,0 +1,131 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultMemoryRetention is the number of messages an in-memory topic
+// keeps for replay
+const DefaultMemoryRetention = 10000
+
+// store holds the messages of one topic, each at its own offset. Offsets
+// start at 0 and grow by one per message. Log is the durable store;
+// memoryStore keeps only the newest messages.
+type store interface {
+	// Append stores msg at the next offset and returns that offset
+	Append(msg Message) (int64, error)
+	// ReadFrom calls fn for every stored message from offset on, in
+	// order, until fn returns false or the end is reached
+	ReadFrom(offset int64, fn func(offset int64, msg Message) bool) error
+	// OldestOffset is the offset of the oldest message still stored
+	OldestOffset() int64
+	// NextOffset is the offset the next message will get
+	NextOffset() int64
+	// OffsetForTime is the offset of the first message with a timestamp
+	// at or after t, or NextOffset if there is none
+	OffsetForTime(t time.Time) (int64, error)
+	Close() error
+}
+
+// memoryStore is a store keeping the newest capacity messages in a ring
+type memoryStore struct {
+	mu     sync.RWMutex
+	ring   []Message // the message at offset o is ring[o % len(ring)]
+	next   int64
+	closed bool
+}
+
+// newMemoryStore creates a memoryStore retaining capacity messages
+func newMemoryStore(capacity int) *memoryStore {
+	if capacity <= 0 {
+		capacity = DefaultMemoryRetention
+	}
+	return &memoryStore{ring: make([]Message, capacity)}
+}
+
+// Append implements store
+func (s *memoryStore) Append(msg Message) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, errors.New("store is closed")
+	}
+
+	offset := s.next
+	msg.Offset = offset
+	s.ring[offset%int64(len(s.ring))] = msg
+	s.next++
+	return offset, nil
+}
+
+// ReadFrom implements store. Messages overwritten while it runs are
+// skipped.
+func (s *memoryStore) ReadFrom(offset int64, fn func(offset int64, msg Message) bool) error {
+	for {
+		s.mu.RLock()
+		if oldest := s.oldestLocked(); offset < oldest {
+			offset = oldest
+		}
+		if offset >= s.next {
+			s.mu.RUnlock()
+			return nil
+		}
+		msg := s.ring[offset%int64(len(s.ring))]
+		s.mu.RUnlock()
+
+		if !fn(offset, msg) {
+			return nil
+		}
+		offset++
+	}
+}
+
+// OldestOffset implements store
+func (s *memoryStore) OldestOffset() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.oldestLocked()
+}
+
+func (s *memoryStore) oldestLocked() int64 {
+	if oldest := s.next - int64(len(s.ring)); oldest > 0 {
+		return oldest
+	}
+	return 0
+}
+
+// NextOffset implements store
+func (s *memoryStore) NextOffset() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.next
+}
+
+// OffsetForTime implements store by binary search, since messages are
+// appended in timestamp order
+func (s *memoryStore) OffsetForTime(t time.Time) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lo, hi := s.oldestLocked(), s.next
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if s.ring[mid%int64(len(s.ring))].Timestamp.Before(t) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// Close implements store
+func (s *memoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Position is where a subscription starts reading its topic
+type Position struct {
+	kind   positionKind
+	offset int64
+	time   time.Time
+}
+
+type positionKind int
+
+const (
+	positionLatest positionKind = iota
+	positionEarliest
+	positionOffset
+	positionTime
+)
+
+var (
+	// Latest starts after the newest message, so only messages published
+	// from now on are received. It is the default.
+	Latest = Position{kind: positionLatest}
+	// Earliest starts at the oldest message the topic still stores
+	Earliest = Position{kind: positionEarliest}
+)
+
+// AtOffset starts at the message with the given offset. An offset that
+// is no longer stored starts at the oldest message; one beyond the end
+// starts at the next message published.
+func AtOffset(offset int64) Position {
+	return Position{kind: positionOffset, offset: offset}
+}
+
+// AtTime starts at the first message published at or after t
+func AtTime(t time.Time) Position {
+	return Position{kind: positionTime, time: t}
+}
+
+// ParsePosition parses "earliest", "latest", an offset or an RFC 3339
+// time. The empty string means Latest.
+func ParsePosition(s string) (Position, error) {
+	switch s {
+	case "", "latest":
+		return Latest, nil
+	case "earliest":
+		return Earliest, nil
+	}
+	if offset, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if offset < 0 {
+			return Position{}, fmt.Errorf("negative offset %d", offset)
+		}
+		return AtOffset(offset), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return AtTime(t), nil
+	}
+	return Position{}, fmt.Errorf("invalid position %q: want earliest, latest, an offset or an RFC 3339 time", s)
+}
+
+// String returns the position in the form ParsePosition accepts
+func (p Position) String() string {
+	switch p.kind {
+	case positionEarliest:
+		return "earliest"
+	case positionOffset:
+		return strconv.FormatInt(p.offset, 10)
+	case positionTime:
+		return p.time.Format(time.RFC3339Nano)
+	default:
+		return "latest"
+	}
+}
+
+// resolve returns the offset p stands for in st
+func (p Position) resolve(st store) (int64, error) {
+	switch p.kind {
+	case positionEarliest:
+		return st.OldestOffset(), nil
+	case positionOffset:
+		if oldest := st.OldestOffset(); p.offset < oldest {
+			return oldest, nil
+		}
+		if next := st.NextOffset(); p.offset > next {
+			return next, nil
+		}
+		return p.offset, nil
+	case positionTime:
+		return st.OffsetForTime(p.time)
+	default:
+		return st.NextOffset(), nil
+	}
+}
+
+// SubscribeOption customizes a subscription
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	start   Position
+	group   string
+	balance Balance
+	ack     *AckPolicy
+}
+
+// StartAt makes the subscription start at p instead of Latest. In a group
+// only the member creating the group decides where it starts, and a group
+// with a committed position on a durable broker resumes there instead.
+func StartAt(p Position) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.start = p
+	}
+}
+
+// WithGroup makes the subscriber a member of the named consumer group.
+// Each message of the topic goes to one member of every group, so the
+// members share the work while different groups each see every message.
+func WithGroup(name string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.group = name
+	}
+}
+
+// WithBalance picks how a group spreads messages over its members;
+// RoundRobin if not given. Only the member creating the group decides.
+func WithBalance(balance Balance) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.balance = balance
+	}
+}
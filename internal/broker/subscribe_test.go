@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+// publishN publishes payloads 0..n-1 to topic
+func publishN(t *testing.T, b *Broker, topic string, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if err := b.Publish(topic, i); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+}
+
+func TestSubscribeStartPositions(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	publishN(t, b, "news", 5)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	publishN(t, b, "news", 2)
+
+	tests := []struct {
+		start Position
+		want  int64
+	}{
+		{Earliest, 0},
+		{AtOffset(3), 3},
+		{AtTime(cutoff), 5},
+		{Latest, 7},
+		{AtOffset(100), 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.start.String(), func(t *testing.T) {
+			ch, err := b.Subscribe("news", StartAt(tt.start))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Unsubscribe("news", ch)
+
+			if tt.want < 7 {
+				if msg := receive(t, ch); msg.Offset != tt.want {
+					t.Fatalf("first message at offset %d, want %d", msg.Offset, tt.want)
+				}
+				return
+			}
+			expectNothing(t, ch, 50*time.Millisecond)
+			b.Publish("news", "new")
+			if msg := receive(t, ch); msg.Payload != "new" {
+				t.Fatalf("got %v, want the message published after subscribing", msg.Payload)
+			}
+		})
+	}
+}
+
+func TestMemoryRetentionSkipsDroppedMessages(t *testing.T) {
+	b, err := Open(Config{MemoryRetention: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	publishN(t, b, "news", 5)
+	ch, err := b.Subscribe("news", StartAt(AtOffset(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := int64(2); want < 5; want++ {
+		if msg := receive(t, ch); msg.Offset != want {
+			t.Fatalf("got offset %d, want %d: only the newest 3 are kept", msg.Offset, want)
+		}
+	}
+}
+
+func TestParsePosition(t *testing.T) {
+	for _, s := range []string{"earliest", "latest", "42", "2024-05-01T10:00:00Z"} {
+		p, err := ParsePosition(s)
+		if err != nil || p.String() != s {
+			t.Errorf("ParsePosition(%q) = %v, %v", s, p, err)
+		}
+	}
+	for _, s := range []string{"-1", "yesterday"} {
+		if _, err := ParsePosition(s); err == nil {
+			t.Errorf("ParsePosition(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTTL is the lease used by Register when none is given
+const DefaultTTL = 10 * time.Second
+
+// Client talks to a registry server. Each command uses its own short-lived
+// connection, so a Client is safe for concurrent use.
+type Client struct {
+	addr string
+}
+
+// NewClient creates a client for the registry at addr
+func NewClient(addr string) *Client {
+	return &Client{addr: addr}
+}
+
+// do sends one command and reads its response
+func (c *Client) do(ctx context.Context, cmd Command) (*Response, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to registry: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(conn).Encode(cmd); err != nil {
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return &resp, nil
+}
+
+// Lookup returns the live instances of service
+func (c *Client) Lookup(ctx context.Context, service string) ([]Instance, error) {
+	resp, err := c.do(ctx, Command{Action: "lookup", Service: service})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != "ok" {
+		return nil, fmt.Errorf("lookup failed: %s", resp.Message)
+	}
+	return resp.Instances, nil
+}
+
+// Registration keeps an instance registered by sending heartbeats
+type Registration struct {
+	client   *Client
+	instance Instance
+	ttl      time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Register registers inst with the given TTL (DefaultTTL if zero) and keeps
+// it alive with heartbeats every ttl/3 until the Registration is closed.
+// An empty inst.ID is filled in from the host name and address.
+func (c *Client) Register(ctx context.Context, inst Instance, ttl time.Duration) (*Registration, error) {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if inst.ID == "" {
+		host, _ := os.Hostname()
+		inst.ID = host + "-" + inst.Addr
+	}
+
+	reg := &Registration{
+		client:   c,
+		instance: inst,
+		ttl:      ttl,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := reg.register(ctx); err != nil {
+		return nil, err
+	}
+
+	go reg.heartbeatLoop()
+	return reg, nil
+}
+
+// register sends the register command
+func (r *Registration) register(ctx context.Context) error {
+	resp, err := r.client.do(ctx, Command{
+		Action:   "register",
+		Service:  r.instance.Service,
+		ID:       r.instance.ID,
+		Addr:     r.instance.Addr,
+		TTLMS:    int(r.ttl / time.Millisecond),
+		Metadata: r.instance.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Status != "ok" {
+		return fmt.Errorf("register failed: %s", resp.Message)
+	}
+	return nil
+}
+
+// heartbeatLoop renews the lease, registering again if the registry
+// forgot the instance (for example after it restarted)
+func (r *Registration) heartbeatLoop() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.ttl/3)
+		resp, err := r.client.do(ctx, Command{
+			Action:  "heartbeat",
+			Service: r.instance.Service,
+			ID:      r.instance.ID,
+			TTLMS:   int(r.ttl / time.Millisecond),
+		})
+		if err == nil && resp.Status == "not_found" {
+			err = r.register(ctx)
+		}
+		cancel()
+
+		if err != nil {
+			log.Printf("Heartbeat for %s/%s failed: %v", r.instance.Service, r.instance.ID, err)
+		}
+	}
+}
+
+// Close stops heartbeats and deregisters the instance
+func (r *Registration) Close() error {
+	var err error
+	r.once.Do(func() {
+		close(r.stop)
+		<-r.done
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err = r.client.do(ctx, Command{
+			Action:  "deregister",
+			Service: r.instance.Service,
+			ID:      r.instance.ID,
+		})
+	})
+	return err
+}
+
+// Watch streams changes to service's instances, starting with the current
+// ones as EventAdded. The channel is closed when ctx is done or the
+// connection to the registry fails.
+func (c *Client) Watch(ctx context.Context, service string) (<-chan Event, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to registry: %w", err)
+	}
+
+	decoder := json.NewDecoder(conn)
+	if err := json.NewEncoder(conn).Encode(Command{Action: "watch", Service: service}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	var resp Response
+	if err := decoder.Decode(&resp); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Status != "watching" {
+		conn.Close()
+		return nil, fmt.Errorf("watch failed: %s", resp.Message)
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer conn.Close()
+
+		// Unblock Decode when the caller stops watching
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+
+		for {
+			var event Event
+			if err := decoder.Decode(&event); err != nil {
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// AdvertiseAddr turns a listen address such as ":9100" into one other
+// processes can dial, using localhost when no host is given
+func AdvertiseAddr(listenAddr string) string {
+	if strings.HasPrefix(listenAddr, ":") {
+		return "localhost" + listenAddr
+	}
+	return listenAddr
+}
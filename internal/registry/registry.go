@@ -0,0 +1,262 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Instance is one live endpoint of a named service
+type Instance struct {
+	Service   string            `json:"service"`
+	ID        string            `json:"id"`
+	Addr      string            `json:"addr"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// EventType says whether an instance appeared or went away
+type EventType string
+
+// Watch event types
+const (
+	EventAdded   EventType = "added"
+	EventRemoved EventType = "removed"
+)
+
+// Event is a change to the instances of a watched service
+type Event struct {
+	Type     EventType `json:"type"`
+	Instance Instance  `json:"instance"`
+}
+
+// ErrNotRegistered is returned by Heartbeat for an instance the registry
+// does not know, e.g. because its lease ran out or the registry restarted
+var ErrNotRegistered = errors.New("instance not registered")
+
+// Registry is an in-memory service registry. Instances stay registered
+// while they keep sending heartbeats within their TTL.
+type Registry struct {
+	mu       sync.Mutex
+	services map[string]map[string]*Instance // service -> instance ID -> instance
+	watchers map[string][]chan Event
+	closed   bool
+	done     chan struct{}
+}
+
+// sweepInterval is how often expired instances are removed
+const sweepInterval = time.Second
+
+// watchBuffer is how many events a watcher may lag behind
+const watchBuffer = 100
+
+// NewRegistry creates a registry and starts expiring stale instances
+func NewRegistry() *Registry {
+	r := &Registry{
+		services: make(map[string]map[string]*Instance),
+		watchers: make(map[string][]chan Event),
+		done:     make(chan struct{}),
+	}
+	go r.sweepLoop()
+	return r
+}
+
+// Register adds or refreshes an instance for ttl
+func (r *Registry) Register(inst Instance, ttl time.Duration) error {
+	if inst.Service == "" || inst.ID == "" || inst.Addr == "" {
+		return fmt.Errorf("service, id and addr are required")
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return fmt.Errorf("registry is closed")
+	}
+
+	inst.ExpiresAt = time.Now().Add(ttl)
+
+	instances := r.services[inst.Service]
+	if instances == nil {
+		instances = make(map[string]*Instance)
+		r.services[inst.Service] = instances
+	}
+
+	existing, exists := instances[inst.ID]
+	instances[inst.ID] = &inst
+
+	// An address change is seen by watchers as remove + add
+	if exists && existing.Addr != inst.Addr {
+		r.notify(Event{Type: EventRemoved, Instance: *existing})
+		exists = false
+	}
+	if !exists {
+		log.Printf("Registered %s/%s at %s (ttl %v)", inst.Service, inst.ID, inst.Addr, ttl)
+		r.notify(Event{Type: EventAdded, Instance: inst})
+	}
+	return nil
+}
+
+// Heartbeat extends an instance's lease to ttl from now. It fails with
+// ErrNotRegistered for unknown instances so the caller knows to register
+// again, e.g. after a registry restart.
+func (r *Registry) Heartbeat(service, id string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	inst, ok := r.services[service][id]
+	if !ok {
+		return fmt.Errorf("instance %s/%s: %w", service, id, ErrNotRegistered)
+	}
+	inst.ExpiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+// Deregister removes an instance immediately
+func (r *Registry) Deregister(service, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.remove(service, id, "deregistered")
+}
+
+// Lookup returns the live instances of a service, ordered by ID
+func (r *Registry) Lookup(service string) []Instance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.snapshot(service)
+}
+
+// Watch streams changes to a service's instances. The current instances
+// are delivered first as EventAdded. Call cancel to stop watching.
+// A watcher that falls more than watchBuffer events behind has its
+// channel closed instead of silently missing events; it must watch again
+// to get a fresh snapshot.
+func (r *Registry) Watch(service string) (events <-chan Event, cancel func(), err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, nil, fmt.Errorf("registry is closed")
+	}
+
+	current := r.snapshot(service)
+	ch := make(chan Event, len(current)+watchBuffer)
+	for _, inst := range current {
+		ch <- Event{Type: EventAdded, Instance: inst}
+	}
+	r.watchers[service] = append(r.watchers[service], ch)
+
+	cancel = func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		watchers := r.watchers[service]
+		for i, w := range watchers {
+			if w == ch {
+				r.watchers[service] = append(watchers[:i], watchers[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, cancel, nil
+}
+
+// Close stops expiry and ends every watch
+func (r *Registry) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.done)
+
+	for service, watchers := range r.watchers {
+		for _, ch := range watchers {
+			close(ch)
+		}
+		delete(r.watchers, service)
+	}
+}
+
+// snapshot copies a service's instances; r.mu must be held
+func (r *Registry) snapshot(service string) []Instance {
+	instances := make([]Instance, 0, len(r.services[service]))
+	for _, inst := range r.services[service] {
+		instances = append(instances, *inst)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances
+}
+
+// remove deletes an instance and tells watchers; r.mu must be held
+func (r *Registry) remove(service, id, reason string) {
+	inst, ok := r.services[service][id]
+	if !ok {
+		return
+	}
+
+	delete(r.services[service], id)
+	if len(r.services[service]) == 0 {
+		delete(r.services, service)
+	}
+
+	log.Printf("Removed %s/%s at %s (%s)", service, id, inst.Addr, reason)
+	r.notify(Event{Type: EventRemoved, Instance: *inst})
+}
+
+// notify delivers an event to the service's watchers without blocking.
+// A watcher whose channel is full is closed and dropped, so that it
+// resyncs from a new snapshot rather than keep a view missing the event.
+// r.mu must be held.
+func (r *Registry) notify(event Event) {
+	service := event.Instance.Service
+	watchers := r.watchers[service][:0]
+	for _, ch := range r.watchers[service] {
+		select {
+		case ch <- event:
+			watchers = append(watchers, ch)
+		default:
+			log.Printf("Warning: watcher of service '%s' fell behind, closing it to force a resync", service)
+			close(ch)
+		}
+	}
+	r.watchers[service] = watchers
+}
+
+// sweepLoop removes instances whose lease ran out
+func (r *Registry) sweepLoop() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.mu.Lock()
+			for service, instances := range r.services {
+				for id, inst := range instances {
+					if now.After(inst.ExpiresAt) {
+						r.remove(service, id, "ttl expired")
+					}
+				}
+			}
+			r.mu.Unlock()
+		case <-r.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newRegistry(t *testing.T) *Registry {
+	t.Helper()
+
+	r := NewRegistry()
+	t.Cleanup(r.Close)
+	return r
+}
+
+func register(t *testing.T, r *Registry, id, addr string, ttl time.Duration) {
+	t.Helper()
+
+	if err := r.Register(Instance{Service: "svc", ID: id, Addr: addr}, ttl); err != nil {
+		t.Fatalf("Register %s: %v", id, err)
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("watch channel closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event within 5s")
+	}
+	return Event{}
+}
+
+func TestRegisterAndLookup(t *testing.T) {
+	r := newRegistry(t)
+	register(t, r, "b", "host:2", time.Minute)
+	register(t, r, "a", "host:1", time.Minute)
+
+	instances := r.Lookup("svc")
+	if len(instances) != 2 || instances[0].ID != "a" || instances[1].ID != "b" {
+		t.Fatalf("Lookup = %+v, want a and b in ID order", instances)
+	}
+
+	r.Deregister("svc", "a")
+	if instances := r.Lookup("svc"); len(instances) != 1 || instances[0].ID != "b" {
+		t.Fatalf("Lookup after Deregister = %+v", instances)
+	}
+
+	if err := r.Register(Instance{Service: "svc", ID: "c"}, time.Minute); err == nil {
+		t.Fatal("Register without an address succeeded")
+	}
+}
+
+func TestLeaseExpiresWithoutHeartbeat(t *testing.T) {
+	r := newRegistry(t)
+	register(t, r, "short", "host:1", 200*time.Millisecond)
+	register(t, r, "renewed", "host:2", 200*time.Millisecond)
+
+	deadline := time.Now().Add(sweepInterval + time.Second)
+	for time.Now().Before(deadline) {
+		if err := r.Heartbeat("svc", "renewed", 200*time.Millisecond); err != nil {
+			t.Fatalf("Heartbeat: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	instances := r.Lookup("svc")
+	if len(instances) != 1 || instances[0].ID != "renewed" {
+		t.Fatalf("Lookup = %+v, want only the renewed instance", instances)
+	}
+	if err := r.Heartbeat("svc", "short", time.Minute); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("Heartbeat of an expired instance = %v, want ErrNotRegistered", err)
+	}
+}
+
+func TestHeartbeatRejectsNonPositiveTTL(t *testing.T) {
+	r := newRegistry(t)
+	register(t, r, "a", "host:1", time.Minute)
+
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		err := r.Heartbeat("svc", "a", ttl)
+		if err == nil || errors.Is(err, ErrNotRegistered) {
+			t.Fatalf("Heartbeat with ttl %v = %v, want a ttl error", ttl, err)
+		}
+	}
+	if instances := r.Lookup("svc"); len(instances) != 1 || time.Until(instances[0].ExpiresAt) < 30*time.Second {
+		t.Fatalf("rejected heartbeat changed the lease: %+v", instances)
+	}
+}
+
+func TestWatchSnapshotAndChanges(t *testing.T) {
+	r := newRegistry(t)
+	register(t, r, "a", "host:1", time.Minute)
+
+	events, cancel, err := r.Watch("svc")
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer cancel()
+
+	if event := nextEvent(t, events); event.Type != EventAdded || event.Instance.ID != "a" {
+		t.Fatalf("snapshot event = %+v", event)
+	}
+
+	register(t, r, "b", "host:2", time.Minute)
+	if event := nextEvent(t, events); event.Type != EventAdded || event.Instance.ID != "b" {
+		t.Fatalf("event = %+v, want b added", event)
+	}
+
+	// A new address is a remove followed by an add
+	register(t, r, "a", "host:3", time.Minute)
+	if event := nextEvent(t, events); event.Type != EventRemoved || event.Instance.Addr != "host:1" {
+		t.Fatalf("event = %+v, want host:1 removed", event)
+	}
+	if event := nextEvent(t, events); event.Type != EventAdded || event.Instance.Addr != "host:3" {
+		t.Fatalf("event = %+v, want host:3 added", event)
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("channel still open after cancel")
+	}
+	cancel() // second call is harmless
+}
+
+func TestSlowWatcherIsClosedInsteadOfMissingEvents(t *testing.T) {
+	r := newRegistry(t)
+
+	slow, cancelSlow, err := r.Watch("svc")
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer cancelSlow() // harmless after the registry closed it
+
+	for i := 0; i <= watchBuffer; i++ {
+		register(t, r, fmt.Sprintf("i%03d", i), "host:1", time.Minute)
+	}
+
+	// Every buffered event arrives, then the channel ends
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != watchBuffer {
+		t.Fatalf("received %d events before the close, want %d", received, watchBuffer)
+	}
+
+	// Watching again starts from a complete snapshot
+	events, cancel, err := r.Watch("svc")
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer cancel()
+	if len(events) != watchBuffer+1 {
+		t.Fatalf("new snapshot has %d events, want %d", len(events), watchBuffer+1)
+	}
+}
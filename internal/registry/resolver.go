@@ -0,0 +1,116 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Resolver looks up the addresses of one service. It satisfies the
+// rpc.Resolver and rpc.WatchResolver interfaces and can be used directly
+// by anything that needs a service address.
+type Resolver struct {
+	client  *Client
+	service string
+}
+
+// NewResolver creates a resolver for service
+func NewResolver(client *Client, service string) *Resolver {
+	return &Resolver{client: client, service: service}
+}
+
+// Resolve returns the addresses of the live instances
+func (r *Resolver) Resolve(ctx context.Context) ([]string, error) {
+	instances, err := r.client.Lookup(ctx, r.service)
+	if err != nil {
+		return nil, err
+	}
+	return addrs(instances), nil
+}
+
+// ResolveOne returns the address of one live instance
+func (r *Resolver) ResolveOne(ctx context.Context) (string, error) {
+	addrs, err := r.Resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no live instances of %s", r.service)
+	}
+	return addrs[0], nil
+}
+
+// watchRetryDelay is the pause before re-establishing a failed watch
+const watchRetryDelay = time.Second
+
+// Watch pushes the full address list every time an instance comes or
+// goes. A broken watch connection is re-established until ctx is done.
+func (r *Resolver) Watch(ctx context.Context) (<-chan []string, error) {
+	events, err := r.client.Watch(ctx, r.service)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make(chan []string, 1)
+	go func() {
+		defer close(updates)
+
+		current := make(map[string]Instance)
+		for {
+			for event := range events {
+				switch event.Type {
+				case EventAdded:
+					current[event.Instance.ID] = event.Instance
+				case EventRemoved:
+					delete(current, event.Instance.ID)
+				}
+				publishLatest(updates, addrsOf(current))
+			}
+
+			// Watch ended: stop if asked to, otherwise reconnect and
+			// rebuild the view from the initial snapshot
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(watchRetryDelay):
+				}
+				if events, err = r.client.Watch(ctx, r.service); err == nil {
+					current = make(map[string]Instance)
+					break
+				}
+				log.Printf("Re-watching %s failed: %v", r.service, err)
+			}
+		}
+	}()
+
+	return updates, nil
+}
+
+// publishLatest replaces any unread update so readers only see the newest list
+func publishLatest(updates chan []string, addrs []string) {
+	select {
+	case <-updates:
+	default:
+	}
+	updates <- addrs
+}
+
+func addrsOf(instances map[string]Instance) []string {
+	list := make([]Instance, 0, len(instances))
+	for _, inst := range instances {
+		list = append(list, inst)
+	}
+	return addrs(list)
+}
+
+func addrs(instances []Instance) []string {
+	result := make([]string, 0, len(instances))
+	for _, inst := range instances {
+		result = append(result, inst.Addr)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,162 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/cont1nu1ty/distributed-systems-go-demos/pkg/socket"
+)
+
+// Command is a request sent to the registry server as one JSON document
+type Command struct {
+	Action   string            `json:"action"` // "register", "heartbeat", "deregister", "lookup", "watch"
+	Service  string            `json:"service"`
+	ID       string            `json:"id,omitempty"`
+	Addr     string            `json:"addr,omitempty"`
+	TTLMS    int               `json:"ttl_ms,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Response answers a Command. A watch is acknowledged with status
+// "watching" and then followed by a stream of Event documents.
+type Response struct {
+	Status    string     `json:"status"`
+	Message   string     `json:"message,omitempty"`
+	Instances []Instance `json:"instances,omitempty"`
+}
+
+// Server exposes a Registry over TCP
+type Server struct {
+	registry *Registry
+}
+
+// NewServer creates a server for registry
+func NewServer(registry *Registry) *Server {
+	return &Server{registry: registry}
+}
+
+// Serve accepts connections on addr
+func (s *Server) Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	log.Printf("Registry listening on %s", addr)
+	return s.ServeListener(listener)
+}
+
+// ServeListener accepts connections from listener until it is closed,
+// and closes it when it returns
+func (s *Server) ServeListener(listener net.Listener) error {
+	defer listener.Close()
+	return socket.Serve(listener, s.handleConnection)
+}
+
+// handleConnection processes commands until the client disconnects
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+
+	for {
+		var cmd Command
+		if err := decoder.Decode(&cmd); err != nil {
+			if err != io.EOF {
+				log.Printf("Decode error: %v", err)
+			}
+			return
+		}
+
+		if cmd.Action == "watch" {
+			s.handleWatch(conn, cmd.Service, encoder)
+			return // Watch is long-lived, exit after handling
+		}
+
+		if err := encoder.Encode(s.execute(cmd)); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs a request/response command
+func (s *Server) execute(cmd Command) Response {
+	ttl := time.Duration(cmd.TTLMS) * time.Millisecond
+
+	switch cmd.Action {
+	case "register":
+		inst := Instance{
+			Service:  cmd.Service,
+			ID:       cmd.ID,
+			Addr:     cmd.Addr,
+			Metadata: cmd.Metadata,
+		}
+		if err := s.registry.Register(inst, ttl); err != nil {
+			return Response{Status: "error", Message: err.Error()}
+		}
+
+	case "heartbeat":
+		if err := s.registry.Heartbeat(cmd.Service, cmd.ID, ttl); err != nil {
+			if errors.Is(err, ErrNotRegistered) {
+				return Response{Status: "not_found", Message: err.Error()}
+			}
+			return Response{Status: "error", Message: err.Error()}
+		}
+
+	case "deregister":
+		s.registry.Deregister(cmd.Service, cmd.ID)
+
+	case "lookup":
+		return Response{Status: "ok", Instances: s.registry.Lookup(cmd.Service)}
+
+	default:
+		return Response{Status: "error", Message: "unknown action"}
+	}
+
+	return Response{Status: "ok"}
+}
+
+// handleWatch streams instance changes for service until the client goes away
+func (s *Server) handleWatch(conn net.Conn, service string, encoder *json.Encoder) {
+	events, cancel, err := s.registry.Watch(service)
+	if err != nil {
+		encoder.Encode(Response{Status: "error", Message: err.Error()})
+		return
+	}
+	defer cancel()
+
+	if err := encoder.Encode(Response{Status: "watching"}); err != nil {
+		return
+	}
+
+	// The client sends nothing after the watch command, so a read only
+	// returns once the connection is closed
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	log.Printf("Client %s watching service '%s'", conn.RemoteAddr(), service)
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+		case <-gone:
+			log.Printf("Watch ended for service '%s'", service)
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startServer serves a fresh registry on a loopback listener
+func startServer(t *testing.T) (*Registry, *Client) {
+	t.Helper()
+
+	r := newRegistry(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- NewServer(r).ServeListener(listener) }()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+	return r, NewClient(listener.Addr().String())
+}
+
+func TestServeListenerStopsWhenListenerCloses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- NewServer(newRegistry(t)).ServeListener(listener) }()
+
+	listener.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("ServeListener = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeListener kept running on a closed listener")
+	}
+}
+
+func TestClientRegisterLookupAndClose(t *testing.T) {
+	_, client := startServer(t)
+	ctx := context.Background()
+
+	reg, err := client.Register(ctx, Instance{Service: "svc", ID: "a", Addr: "host:1"}, 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	// Heartbeats keep the instance past its TTL
+	time.Sleep(sweepInterval + 500*time.Millisecond)
+	instances, err := client.Lookup(ctx, "svc")
+	if err != nil || len(instances) != 1 || instances[0].Addr != "host:1" {
+		t.Fatalf("Lookup = %+v, %v", instances, err)
+	}
+
+	if err := reg.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if instances, _ := client.Lookup(ctx, "svc"); len(instances) != 0 {
+		t.Fatalf("Lookup after Close = %+v", instances)
+	}
+}
+
+func TestServerHeartbeatStatuses(t *testing.T) {
+	r, client := startServer(t)
+	register(t, r, "a", "host:1", time.Minute)
+	ctx := context.Background()
+
+	resp, err := client.do(ctx, Command{Action: "heartbeat", Service: "svc", ID: "a"})
+	if err != nil || resp.Status != "error" {
+		t.Fatalf("heartbeat without ttl = %+v, %v; want status error", resp, err)
+	}
+	resp, err = client.do(ctx, Command{Action: "heartbeat", Service: "svc", ID: "zz", TTLMS: 1000})
+	if err != nil || resp.Status != "not_found" {
+		t.Fatalf("heartbeat of unknown instance = %+v, %v; want not_found", resp, err)
+	}
+}
+
+func TestResolverWatchFollowsInstances(t *testing.T) {
+	r, client := startServer(t)
+	register(t, r, "a", "host:1", time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := NewResolver(client, "svc").Watch(ctx)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+
+	waitFor := func(want []string) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			select {
+			case addrs := <-updates:
+				if reflect.DeepEqual(addrs, want) {
+					return
+				}
+			case <-deadline:
+				t.Fatalf("no update with %v", want)
+			}
+		}
+	}
+
+	waitFor([]string{"host:1"})
+	register(t, r, "b", "host:2", time.Minute)
+	waitFor([]string{"host:1", "host:2"})
+	r.Deregister("svc", "a")
+	waitFor([]string{"host:2"})
+}
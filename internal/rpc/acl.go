@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"context"
+	"path"
+	"sync"
+)
+
+// ACL maps principals to the methods they may call. Patterns have the
+// form "Service.Method" and may use path.Match wildcards, e.g.
+// "CalculatorService.*" or "*". Rules only grant access; a principal with
+// no matching rule is denied.
+type ACL struct {
+	mu    sync.RWMutex
+	rules map[string][]string // principal name ("*" for anyone) -> patterns
+}
+
+// NewACL creates an ACL that denies everything
+func NewACL() *ACL {
+	return &ACL{rules: make(map[string][]string)}
+}
+
+// Allow grants principal the methods matching patterns. The principal "*"
+// stands for every authenticated caller. It returns the ACL so rules can
+// be chained.
+func (a *ACL) Allow(principal string, patterns ...string) *ACL {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.rules[principal] = append(a.rules[principal], patterns...)
+	return a
+}
+
+// Allowed reports whether principal may call service.method. The built-in
+// DescribeService is open to everyone, since clients need it to learn
+// which methods they may retry.
+func (a *ACL) Allowed(principal, service, method string) bool {
+	if service == DescribeService {
+		return true
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	name := service + "." + method
+	for _, who := range []string{principal, "*"} {
+		for _, pattern := range a.rules[who] {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Interceptor enforces the ACL for the Principal set by AuthInterceptor,
+// which must come earlier in the chain. Denied calls fail with
+// CodePermissionDenied.
+func (a *ACL) Interceptor() ServerInterceptor {
+	return func(ctx context.Context, req *Request, next Handler) (interface{}, error) {
+		principal, ok := PrincipalFromContext(ctx)
+		if !ok {
+			return nil, Errorf(CodeUnauthenticated, "%s.%s requires credentials", req.Service, req.Method)
+		}
+		if !a.Allowed(principal.Name, req.Service, req.Method) {
+			return nil, Errorf(CodePermissionDenied, "%s may not call %s.%s", principal.Name, req.Service, req.Method)
+		}
+		return next(ctx, req)
+	}
+}
@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Call is an asynchronous call started by Client.Go. Once it completes,
+// Result or Error is set and the Call is sent on Done.
+type Call struct {
+	Service string
+	Method  string
+	Params  []interface{}
+	Result  interface{} // decoded generically, as by CallContext
+	Error   error
+	Done    chan *Call // receives the Call once, buffered
+}
+
+// Go starts a call bounded by DefaultCallTimeout and returns without
+// waiting for it, like net/rpc's Client.Go
+func (c *Client) Go(service, method string, params ...interface{}) *Call {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCallTimeout)
+	return c.startCall(ctx, cancel, service, method, params)
+}
+
+// GoContext starts a call that gives up when ctx is done and returns
+// without waiting for it. Many calls can be in flight at once; their
+// responses are matched by ID as for synchronous calls.
+func (c *Client) GoContext(ctx context.Context, service, method string, params ...interface{}) *Call {
+	return c.startCall(ctx, func() {}, service, method, params)
+}
+
+// startCall runs the call in its own goroutine and releases ctx with
+// cancel once it is done
+func (c *Client) startCall(ctx context.Context, cancel context.CancelFunc, service, method string, params []interface{}) *Call {
+	call := &Call{
+		Service: service,
+		Method:  method,
+		Params:  params,
+		Done:    make(chan *Call, 1),
+	}
+
+	go func() {
+		defer cancel()
+		call.Result, call.Error = c.CallContext(ctx, service, method, params...)
+		call.Done <- call
+	}()
+	return call
+}
+
+// Notify sends a one-way request: the server runs the method but writes no
+// response, so neither the result nor remote errors are reported. The
+// returned error only covers failures to send. Interceptors run as for
+// other calls; retries and circuit breaking do not apply since there is no
+// outcome to judge.
+func (c *Client) Notify(ctx context.Context, service, method string, params ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	encodedParams, err := encodeParams(c.payload, params)
+	if err != nil {
+		return err
+	}
+
+	req := &Request{
+		Service:  service,
+		Method:   method,
+		Params:   encodedParams,
+		Metadata: requestMetadata(ctx),
+		NoReply:  true,
+	}
+	return c.notifyHandler(ctx, req, nil)
+}
+
+// sendNoReply is the innermost CallHandler for Notify
+func (c *Client) sendNoReply(ctx context.Context, req *Request, _ interface{}) error {
+	timeoutMS, err := timeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	notification := *req
+	notification.ID = fmt.Sprintf("%s-%s-%d", req.Service, req.Method, c.seq.Add(1))
+	notification.TimeoutMS = timeoutMS
+	if err := c.addCredentials(ctx, &notification); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := c.getConn(ctx)
+		if err != nil {
+			return err
+		}
+		if err := conn.usable(); errors.Is(err, errGoingAway) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := conn.write(&notification); err != nil {
+			return fmt.Errorf("failed to send request: %w", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,75 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// eventService records the events it is given and then fails, which
+// Notify does not report
+type eventService struct {
+	events chan string
+}
+
+func (s *eventService) Record(event string) error {
+	time.Sleep(50 * time.Millisecond)
+	s.events <- event
+	return errors.New("event log is full")
+}
+
+func TestGoDeliversResultOnDone(t *testing.T) {
+	client := dialCodec(t, startServer(t), CodecJSON)
+
+	calls := []*Call{client.Go("Codec", "Add", 1, 2), client.Go("Codec", "Echo", "hi")}
+	for _, want := range []interface{}{float64(3), "hi"} {
+		call := <-calls[0].Done
+		calls = calls[1:]
+		if call.Error != nil || call.Result != want {
+			t.Fatalf("%s.%s = %v, %v; want %v", call.Service, call.Method, call.Result, call.Error, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	call := <-client.GoContext(ctx, "Codec", "Add", 1, 2).Done
+	if !errors.Is(call.Error, context.Canceled) {
+		t.Fatalf("GoContext with canceled ctx = %v; want context.Canceled", call.Error)
+	}
+}
+
+func TestNotifyRunsMethodWithoutResponse(t *testing.T) {
+	svc := &eventService{events: make(chan string, 1)}
+	server := NewServer()
+	if err := server.Register("Event", svc); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	client := dialCodec(t, serve(t, server), CodecJSON)
+
+	start := time.Now()
+	if err := client.Notify(context.Background(), "Event", "Record", "started"); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Fatalf("Notify took %v; it waited for the method", elapsed)
+	}
+
+	select {
+	case event := <-svc.events:
+		if event != "started" {
+			t.Fatalf("method got %q; want started", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notified method did not run")
+	}
+
+	// The same failure is reported to a normal call, and only to it
+	var remoteErr *RemoteError
+	if err := client.Invoke(context.Background(), "Event", "Record", nil, "second"); !errors.As(err, &remoteErr) || remoteErr.Code != CodeApplication {
+		t.Fatalf("Record = %v; want RemoteError %s", err, CodeApplication)
+	}
+	if event := <-svc.events; event != "second" {
+		t.Fatalf("method got %q; want second", event)
+	}
+}
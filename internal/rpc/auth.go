@@ -0,0 +1,261 @@
+package rpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthorizationKey is the metadata key carrying bearer and HMAC tokens
+const AuthorizationKey = "authorization"
+
+// ErrNoCredentials is returned by an Authenticator when the request does
+// not carry the kind of credential it checks, so another one may try
+var ErrNoCredentials = errors.New("no credentials")
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Name string
+	// Method names the Authenticator that vouched for it: "bearer",
+	// "hmac" or "mtls"
+	Method string
+}
+
+// Authenticator establishes who sent a request. It returns ErrNoCredentials
+// if the request has no credential of its kind and another error if the
+// credential is present but not valid.
+type Authenticator interface {
+	Authenticate(ctx context.Context, req *Request) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to Authenticator
+type AuthenticatorFunc func(ctx context.Context, req *Request) (*Principal, error)
+
+// Authenticate implements Authenticator
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, req *Request) (*Principal, error) {
+	return f(ctx, req)
+}
+
+// principalKey carries the *Principal of a server call
+type principalKey struct{}
+
+// PrincipalFromContext returns the caller established by AuthInterceptor
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// AuthInterceptor rejects requests that none of authenticators accepts
+// with CodeUnauthenticated and otherwise hands the Principal to the rest
+// of the chain through the context. The authenticators are tried in
+// order; the first one finding its kind of credential decides.
+func AuthInterceptor(authenticators ...Authenticator) ServerInterceptor {
+	return func(ctx context.Context, req *Request, next Handler) (interface{}, error) {
+		for _, auth := range authenticators {
+			principal, err := auth.Authenticate(ctx, req)
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			if err != nil {
+				return nil, Errorf(CodeUnauthenticated, "%v", err)
+			}
+			return next(context.WithValue(ctx, principalKey{}, principal), req)
+		}
+		return nil, Errorf(CodeUnauthenticated, "%s.%s requires credentials", req.Service, req.Method)
+	}
+}
+
+// BearerAuthenticator accepts "Bearer <token>" authorization metadata for
+// the tokens in tokens, which maps each token to its principal's name
+func BearerAuthenticator(tokens map[string]string) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, req *Request) (*Principal, error) {
+		token, ok := authorization(req, "Bearer")
+		if !ok {
+			return nil, ErrNoCredentials
+		}
+		for known, name := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+				return &Principal{Name: name, Method: "bearer"}, nil
+			}
+		}
+		return nil, errors.New("invalid bearer token")
+	})
+}
+
+// HMACAuthenticator accepts "HMAC <principal>:<unix time>:<nonce>:<signature>"
+// authorization metadata made by HMACCredentials with the same secret.
+// The signature covers the principal, the time, the nonce, the request
+// ID, Service.Method and a digest of the params, so a token only works
+// for the request it was made for and only for maxSkew around its time.
+// Each nonce is accepted once: a token replayed within that window is
+// rejected too.
+func HMACAuthenticator(secret []byte, maxSkew time.Duration) Authenticator {
+	nonces := &nonceCache{seen: make(map[string]time.Time)}
+
+	return AuthenticatorFunc(func(ctx context.Context, req *Request) (*Principal, error) {
+		token, ok := authorization(req, "HMAC")
+		if !ok {
+			return nil, ErrNoCredentials
+		}
+
+		parts := strings.Split(token, ":")
+		if len(parts) != 4 {
+			return nil, errors.New("malformed HMAC token")
+		}
+		name, stamp, nonce, signature := parts[0], parts[1], parts[2], parts[3]
+
+		unix, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil || nonce == "" {
+			return nil, errors.New("malformed HMAC token")
+		}
+		issued := time.Unix(unix, 0)
+		if skew := time.Since(issued); skew > maxSkew || skew < -maxSkew {
+			return nil, errors.New("HMAC token expired")
+		}
+
+		expected := signHMAC(secret, name, stamp, nonce, req)
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil, errors.New("invalid HMAC signature")
+		}
+		// Only tokens with a valid signature are remembered, so forged
+		// ones cannot fill the cache
+		if !nonces.add(name+":"+nonce, issued.Add(maxSkew)) {
+			return nil, errors.New("HMAC token replayed")
+		}
+		return &Principal{Name: name, Method: "hmac"}, nil
+	})
+}
+
+// nonceCache remembers the HMAC nonces seen until their token expires
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time // nonce -> when its token expires
+	lastPrune time.Time
+}
+
+// add records nonce and reports whether it was new. Expired nonces are
+// dropped at most once a second; their tokens fail the time check anyway.
+func (nc *nonceCache) add(nonce string, expires time.Time) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(nc.lastPrune) >= time.Second {
+		for n, exp := range nc.seen {
+			if now.After(exp) {
+				delete(nc.seen, n)
+			}
+		}
+		nc.lastPrune = now
+	}
+
+	if _, ok := nc.seen[nonce]; ok {
+		return false
+	}
+	nc.seen[nonce] = expires
+	return true
+}
+
+// MTLSAuthenticator accepts connections whose client certificate was
+// verified in a mutual TLS handshake (see WithServerTLS); the principal
+// is the certificate's common name. Unlike the token authenticators it
+// vouches for the connection, so every request on it gets the same
+// principal.
+func MTLSAuthenticator() Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, req *Request) (*Principal, error) {
+		peer, ok := PeerFromContext(ctx)
+		if !ok || peer.Identity() == "" {
+			return nil, ErrNoCredentials
+		}
+		return &Principal{Name: peer.Identity(), Method: "mtls"}, nil
+	})
+}
+
+// authorization returns the credential after "<scheme> " in req's
+// authorization metadata
+func authorization(req *Request, scheme string) (string, bool) {
+	for _, value := range req.Metadata.Values(AuthorizationKey) {
+		if len(value) > len(scheme) && strings.EqualFold(value[:len(scheme)], scheme) && value[len(scheme)] == ' ' {
+			return value[len(scheme)+1:], true
+		}
+	}
+	return "", false
+}
+
+// signHMAC computes the hex HMAC-SHA256 signature of an HMAC token for req
+func signHMAC(secret []byte, name, stamp, nonce string, req *Request) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s:%s:%s:%s:%s.%s:%s", name, stamp, nonce, req.ID, req.Service, req.Method, paramsDigest(req.Params))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// paramsDigest is the hex SHA-256 of the encoded params, each prefixed
+// with its length so that moving bytes between params changes it
+func paramsDigest(params []Payload) string {
+	h := sha256.New()
+	var size [8]byte
+	for _, p := range params {
+		binary.BigEndian.PutUint64(size[:], uint64(len(p)))
+		h.Write(size[:])
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// PerRPCCredentials supplies metadata attached to every request a client
+// sends: unary calls, streams and notifications alike. req is the request
+// as it goes on the wire, with its final ID and params; every retry
+// attempt is a request of its own.
+type PerRPCCredentials interface {
+	RequestMetadata(ctx context.Context, req *Request) (Metadata, error)
+}
+
+// WithPerRPCCredentials attaches creds to every request of the client
+func WithPerRPCCredentials(creds PerRPCCredentials) ClientOption {
+	return func(o *clientOptions) {
+		o.credentials = append(o.credentials, creds)
+	}
+}
+
+// BearerToken is a PerRPCCredentials sending a fixed bearer token, the
+// counterpart of BearerAuthenticator
+type BearerToken string
+
+// RequestMetadata implements PerRPCCredentials
+func (t BearerToken) RequestMetadata(ctx context.Context, req *Request) (Metadata, error) {
+	return NewMetadata(AuthorizationKey, "Bearer "+string(t)), nil
+}
+
+// HMACCredentials signs every request as Principal with Secret, the
+// counterpart of HMACAuthenticator
+type HMACCredentials struct {
+	Principal string
+	Secret    []byte
+}
+
+// RequestMetadata implements PerRPCCredentials
+func (h HMACCredentials) RequestMetadata(ctx context.Context, req *Request) (Metadata, error) {
+	if strings.Contains(h.Principal, ":") {
+		return nil, fmt.Errorf("HMAC principal %q must not contain ':'", h.Principal)
+	}
+
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate HMAC nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(random[:])
+	stamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	token := h.Principal + ":" + stamp + ":" + nonce + ":" + signHMAC(h.Secret, h.Principal, stamp, nonce, req)
+	return NewMetadata(AuthorizationKey, "HMAC "+token), nil
+}
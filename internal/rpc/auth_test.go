@@ -0,0 +1,179 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("secret")
+
+// startAuthServer serves nameService behind authenticators, with Name
+// declared idempotent
+func startAuthServer(t *testing.T, authenticators ...Authenticator) string {
+	t.Helper()
+
+	server := NewServer(WithServerInterceptors(AuthInterceptor(authenticators...)))
+	if err := server.Register("Name", nameService{"a"}, WithIdempotent("Name")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	return serve(t, server)
+}
+
+func dialWith(t *testing.T, addr string, opts ...ClientOption) *Client {
+	t.Helper()
+
+	client, err := NewClient(addr, opts...)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// signedRequest returns a request carrying a fresh HMAC token
+func signedRequest(t *testing.T, creds HMACCredentials) *Request {
+	t.Helper()
+
+	req := &Request{ID: "Name-Stall-1", Service: "Name", Method: "Stall", Params: []Payload{Payload("1")}}
+	md, err := creds.RequestMetadata(context.Background(), req)
+	if err != nil {
+		t.Fatalf("RequestMetadata: %v", err)
+	}
+	req.Metadata = md
+	return req
+}
+
+func TestHMACAcrossCodecs(t *testing.T) {
+	addr := startAuthServer(t, HMACAuthenticator(testSecret, time.Minute))
+	creds := HMACCredentials{Principal: "alice", Secret: testSecret}
+
+	for _, codecType := range allCodecs {
+		t.Run(codecType.String(), func(t *testing.T) {
+			client := dialWith(t, addr, WithCodec(codecType), WithPerRPCCredentials(creds))
+
+			// The params digest must match what the server decodes
+			var name string
+			if err := client.Invoke(context.Background(), "Name", "Stall", &name, 1); err != nil || name != "a" {
+				t.Fatalf("Stall = %q, %v", name, err)
+			}
+			if err := client.Notify(context.Background(), "Name", "Stall", 1); err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+		})
+	}
+
+	// Without credentials the call is rejected
+	err := dialWith(t, addr).Invoke(context.Background(), "Name", "Name", nil)
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Code != CodeUnauthenticated {
+		t.Fatalf("unsigned call = %v, want unauthenticated", err)
+	}
+}
+
+func TestHMACBindsTokenToRequest(t *testing.T) {
+	auth := HMACAuthenticator(testSecret, time.Minute)
+	creds := HMACCredentials{Principal: "alice", Secret: testSecret}
+
+	tests := []struct {
+		name   string
+		tamper func(req *Request)
+	}{
+		{"params", func(req *Request) { req.Params = []Payload{Payload("1000")} }},
+		{"split params", func(req *Request) { req.Params = []Payload{Payload(""), Payload("1")} }},
+		{"request ID", func(req *Request) { req.ID = "Name-Stall-2" }},
+		{"method", func(req *Request) { req.Method = "Name" }},
+		{"principal", func(req *Request) {
+			token := req.Metadata.Get(AuthorizationKey)
+			req.Metadata.Set(AuthorizationKey, strings.Replace(token, "HMAC alice:", "HMAC bob:", 1))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := signedRequest(t, creds)
+			tt.tamper(req)
+			if _, err := auth.Authenticate(context.Background(), req); err == nil || errors.Is(err, ErrNoCredentials) {
+				t.Fatalf("Authenticate = %v, want the tampered request rejected", err)
+			}
+		})
+	}
+
+	// Signed with another secret
+	req := signedRequest(t, HMACCredentials{Principal: "alice", Secret: []byte("other")})
+	if _, err := auth.Authenticate(context.Background(), req); err == nil {
+		t.Fatal("token signed with another secret accepted")
+	}
+}
+
+func TestHMACRejectsReplayAndExpiredTokens(t *testing.T) {
+	auth := HMACAuthenticator(testSecret, time.Minute)
+	creds := HMACCredentials{Principal: "alice", Secret: testSecret}
+
+	req := signedRequest(t, creds)
+	principal, err := auth.Authenticate(context.Background(), req)
+	if err != nil || principal.Name != "alice" || principal.Method != "hmac" {
+		t.Fatalf("Authenticate = %+v, %v", principal, err)
+	}
+	if _, err := auth.Authenticate(context.Background(), req); err == nil {
+		t.Fatal("replayed token accepted")
+	}
+
+	// The same request signed again gets a new nonce
+	if _, err := auth.Authenticate(context.Background(), signedRequest(t, creds)); err != nil {
+		t.Fatalf("freshly signed request: %v", err)
+	}
+
+	// A token older than maxSkew fails even with a valid signature
+	stale := &Request{ID: "Name-Stall-1", Service: "Name", Method: "Stall"}
+	stamp := strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+	token := "alice:" + stamp + ":n1:" + signHMAC(testSecret, "alice", stamp, "n1", stale)
+	stale.Metadata = NewMetadata(AuthorizationKey, "HMAC "+token)
+	if _, err := auth.Authenticate(context.Background(), stale); err == nil {
+		t.Fatal("expired token accepted")
+	}
+}
+
+// switchableToken sends its bearer token only while enabled
+type switchableToken struct {
+	enabled atomic.Bool
+}
+
+func (s *switchableToken) RequestMetadata(ctx context.Context, req *Request) (Metadata, error) {
+	if !s.enabled.Load() {
+		return nil, nil
+	}
+	return NewMetadata(AuthorizationKey, "Bearer tok"), nil
+}
+
+func TestIsIdempotentDoesNotCacheDescribeErrors(t *testing.T) {
+	addr := startAuthServer(t, BearerAuthenticator(map[string]string{"tok": "alice"}))
+	creds := &switchableToken{}
+	client := dialWith(t, addr, WithPerRPCCredentials(creds), WithRetry(DefaultRetryPolicy))
+	ctx := context.Background()
+
+	// Describe is rejected; that says nothing about the method
+	if client.isIdempotent(ctx, "Name", "Name") {
+		t.Fatal("method idempotent without a description")
+	}
+	if len(client.descriptions) != 0 {
+		t.Fatalf("cached %v after an unauthenticated Describe", client.descriptions)
+	}
+
+	creds.enabled.Store(true)
+	if !client.isIdempotent(ctx, "Name", "Name") {
+		t.Fatal("Name not idempotent once Describe succeeds")
+	}
+
+	// A service the server does not know is cached as having no
+	// idempotent methods
+	if client.isIdempotent(ctx, "Missing", "Name") {
+		t.Fatal("unknown service reported idempotent")
+	}
+	if _, ok := client.descriptions["Missing"]; !ok {
+		t.Fatal("not-found description was not cached")
+	}
+}
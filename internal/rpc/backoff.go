@@ -0,0 +1,46 @@
+package rpc
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff describes an exponential backoff with jitter
+type Backoff struct {
+	Initial    time.Duration // delay before the first retry
+	Max        time.Duration // upper bound for any delay
+	Multiplier float64       // growth factor per attempt
+	Jitter     float64       // fraction of each delay that is randomized, 0..1
+}
+
+// DefaultBackoff is used when a zero Backoff is configured
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        10 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Delay returns how long to wait before the given attempt, counting from 0
+func (b Backoff) Delay(attempt int) time.Duration {
+	if b.Initial <= 0 {
+		b = DefaultBackoff
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = 1
+	}
+
+	delay := float64(b.Initial)
+	for i := 0; i < attempt && (b.Max <= 0 || delay < float64(b.Max)); i++ {
+		delay *= b.Multiplier
+	}
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	// Spread retries of many clients so they do not hit the server in lockstep
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
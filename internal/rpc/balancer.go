@@ -0,0 +1,581 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resolver supplies the endpoints a BalancedClient spreads calls over
+type Resolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+// WatchResolver is a Resolver that also pushes the full endpoint list
+// whenever it changes. BalancedClient applies those updates immediately
+// instead of waiting for the next refresh.
+type WatchResolver interface {
+	Resolver
+	Watch(ctx context.Context) (<-chan []string, error)
+}
+
+// StaticResolver is a fixed list of endpoint addresses
+type StaticResolver []string
+
+// Resolve returns the fixed list
+func (r StaticResolver) Resolve(ctx context.Context) ([]string, error) {
+	return r, nil
+}
+
+// Policy selects the endpoint for each call
+type Policy int
+
+// Load balancing policies
+const (
+	// RoundRobin cycles through the healthy endpoints
+	RoundRobin Policy = iota
+	// LeastOutstanding picks the endpoint with the fewest calls in flight
+	LeastOutstanding
+	// ConsistentHash maps the key set by WithHashKey onto a hash ring, so
+	// the same key keeps hitting the same endpoint while it is healthy.
+	// Calls without a key fall back to RoundRobin.
+	ConsistentHash
+)
+
+// String returns the policy name
+func (p Policy) String() string {
+	switch p {
+	case RoundRobin:
+		return "round_robin"
+	case LeastOutstanding:
+		return "least_outstanding"
+	case ConsistentHash:
+		return "consistent_hash"
+	}
+	return "policy(" + strconv.Itoa(int(p)) + ")"
+}
+
+// hashKeyContextKey carries the ConsistentHash key through a context
+type hashKeyContextKey struct{}
+
+// WithHashKey returns a context whose calls are routed by key under the
+// ConsistentHash policy
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyContextKey{}, key)
+}
+
+// BalancerOption configures a BalancedClient
+type BalancerOption func(*balancerOptions)
+
+// balancerOptions collects the settings applied by BalancerOption
+type balancerOptions struct {
+	policy          Policy
+	clientOpts      []ClientOption
+	maxFailures     int
+	ejectionTime    time.Duration
+	endpointTimeout time.Duration
+	refreshInterval time.Duration
+}
+
+// WithPolicy selects the load balancing policy (default RoundRobin)
+func WithPolicy(policy Policy) BalancerOption {
+	return func(o *balancerOptions) {
+		o.policy = policy
+	}
+}
+
+// WithClientOptions configures the per-endpoint clients
+func WithClientOptions(opts ...ClientOption) BalancerOption {
+	return func(o *balancerOptions) {
+		o.clientOpts = append(o.clientOpts, opts...)
+	}
+}
+
+// WithEjection removes an endpoint from rotation for ejectionTime after
+// maxFailures consecutive transport failures
+func WithEjection(maxFailures int, ejectionTime time.Duration) BalancerOption {
+	return func(o *balancerOptions) {
+		o.maxFailures = maxFailures
+		o.ejectionTime = ejectionTime
+	}
+}
+
+// WithEndpointTimeout bounds every unary call to an endpoint by timeout.
+// A call that runs out of it while the caller's context still has time
+// counts as a failure of the endpoint, so hung endpoints get ejected;
+// running out of the caller's own deadline never does.
+func WithEndpointTimeout(timeout time.Duration) BalancerOption {
+	return func(o *balancerOptions) {
+		o.endpointTimeout = timeout
+	}
+}
+
+// WithRefreshInterval sets how often the resolver is consulted again
+func WithRefreshInterval(interval time.Duration) BalancerOption {
+	return func(o *balancerOptions) {
+		o.refreshInterval = interval
+	}
+}
+
+// Defaults for BalancedClient
+const (
+	DefaultMaxFailures     = 3
+	DefaultEjectionTime    = 10 * time.Second
+	DefaultRefreshInterval = 30 * time.Second
+
+	// virtualNodes is the number of ring positions per endpoint
+	virtualNodes = 100
+)
+
+// ErrNoEndpoints is returned when the resolver yields no addresses
+var ErrNoEndpoints = errors.New("no endpoints available")
+
+// endpoint is one server known to the balancer
+type endpoint struct {
+	addr string
+
+	mu           sync.Mutex
+	client       *Client // dialed lazily
+	closed       bool    // removed from the balancer, or the balancer closed
+	failures     int
+	ejectedUntil time.Time
+}
+
+// ringEntry is one position on the consistent hash ring
+type ringEntry struct {
+	hash     uint32
+	endpoint *endpoint
+}
+
+// BalancedClient spreads calls across the endpoints returned by a
+// Resolver. Endpoints that fail repeatedly at the transport level are
+// ejected for a while (passive health checking); errors returned by the
+// remote method itself do not count as failures.
+type BalancedClient struct {
+	resolver Resolver
+	opts     balancerOptions
+	next     atomic.Uint64
+
+	mu        sync.RWMutex
+	endpoints []*endpoint // sorted by address
+	ring      []ringEntry // sorted by hash
+	closed    bool
+	done      chan struct{}
+}
+
+// NewBalancedClient resolves the initial endpoints and starts refreshing them
+func NewBalancedClient(resolver Resolver, opts ...BalancerOption) (*BalancedClient, error) {
+	options := balancerOptions{
+		policy:          RoundRobin,
+		maxFailures:     DefaultMaxFailures,
+		ejectionTime:    DefaultEjectionTime,
+		refreshInterval: DefaultRefreshInterval,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	b := &BalancedClient{
+		resolver: resolver,
+		opts:     options,
+		done:     make(chan struct{}),
+	}
+
+	if err := b.refresh(context.Background()); err != nil {
+		return nil, err
+	}
+
+	go b.refreshLoop()
+
+	if watcher, ok := resolver.(WatchResolver); ok {
+		if err := b.startWatch(watcher); err != nil {
+			log.Printf("Balancer: watch unavailable, relying on refresh: %v", err)
+		}
+	}
+
+	return b, nil
+}
+
+// startWatch applies endpoint lists pushed by the resolver until Close
+func (b *BalancedClient) startWatch(watcher WatchResolver) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := watcher.Watch(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case addrs, ok := <-updates:
+				if !ok {
+					return
+				}
+				// An empty list usually means a transient gap; keep serving
+				// from the previous endpoints until the next update
+				if len(addrs) > 0 {
+					b.UpdateEndpoints(addrs)
+				}
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// refreshLoop periodically re-resolves the endpoint list
+func (b *BalancedClient) refreshLoop() {
+	ticker := time.NewTicker(b.opts.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.refresh(context.Background()); err != nil {
+				log.Printf("Balancer: resolve failed, keeping %d endpoints: %v", b.endpointCount(), err)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// refresh resolves the endpoints and applies the result
+func (b *BalancedClient) refresh(ctx context.Context) error {
+	addrs, err := b.resolver.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return ErrNoEndpoints
+	}
+	b.UpdateEndpoints(addrs)
+	return nil
+}
+
+// UpdateEndpoints replaces the endpoint set. Known endpoints keep their
+// connection and health state; removed ones are closed.
+func (b *BalancedClient) UpdateEndpoints(addrs []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	existing := make(map[string]*endpoint, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		existing[ep.addr] = ep
+	}
+
+	var endpoints []*endpoint
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		if ep, ok := existing[addr]; ok {
+			endpoints = append(endpoints, ep)
+			delete(existing, addr)
+		} else {
+			endpoints = append(endpoints, &endpoint{addr: addr})
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].addr < endpoints[j].addr })
+
+	for _, removed := range existing {
+		removed.closeClient()
+	}
+
+	b.endpoints = endpoints
+	b.ring = buildRing(endpoints)
+}
+
+// buildRing places virtualNodes positions per endpoint on the hash ring
+func buildRing(endpoints []*endpoint) []ringEntry {
+	ring := make([]ringEntry, 0, len(endpoints)*virtualNodes)
+	for _, ep := range endpoints {
+		for i := 0; i < virtualNodes; i++ {
+			hash := crc32.ChecksumIEEE([]byte(ep.addr + "#" + strconv.Itoa(i)))
+			ring = append(ring, ringEntry{hash: hash, endpoint: ep})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// endpointCount reports the number of known endpoints
+func (b *BalancedClient) endpointCount() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.endpoints)
+}
+
+// pick chooses an endpoint for a call according to the policy. If every
+// endpoint is ejected, all of them are considered again rather than
+// failing outright.
+func (b *BalancedClient) pick(ctx context.Context) (*endpoint, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil, ErrClientClosed
+	}
+	if len(b.endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	now := time.Now()
+	healthy := make([]*endpoint, 0, len(b.endpoints))
+	for _, ep := range b.endpoints {
+		if ep.available(now) {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = b.endpoints
+	}
+
+	switch b.opts.policy {
+	case LeastOutstanding:
+		// Start at a rotating offset so ties do not all land on one
+		// endpoint, and skip endpoints waiting for a reconnect
+		offset := int(b.next.Add(1) - 1)
+		var best *endpoint
+		bestPending := 0
+		for i := 0; i < len(healthy); i++ {
+			ep := healthy[(offset+i)%len(healthy)]
+			pending, live := ep.pendingCount()
+			if live && (best == nil || pending < bestPending) {
+				best, bestPending = ep, pending
+			}
+		}
+		if best == nil {
+			best = healthy[offset%len(healthy)]
+		}
+		return best, nil
+
+	case ConsistentHash:
+		if key, ok := ctx.Value(hashKeyContextKey{}).(string); ok {
+			return b.lookupRing(key, healthy), nil
+		}
+	}
+
+	return healthy[int(b.next.Add(1)-1)%len(healthy)], nil
+}
+
+// lookupRing walks clockwise from key's hash to the first endpoint in candidates
+func (b *BalancedClient) lookupRing(key string, candidates []*endpoint) *endpoint {
+	allowed := make(map[*endpoint]bool, len(candidates))
+	for _, ep := range candidates {
+		allowed[ep] = true
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+	for i := 0; i < len(b.ring); i++ {
+		entry := b.ring[(start+i)%len(b.ring)]
+		if allowed[entry.endpoint] {
+			return entry.endpoint
+		}
+	}
+	return candidates[0]
+}
+
+// Invoke implements Invoker on the endpoint chosen by the policy
+func (b *BalancedClient) Invoke(ctx context.Context, service, method string, reply interface{}, params ...interface{}) error {
+	ep, err := b.pick(ctx)
+	if err != nil {
+		return err
+	}
+
+	client, err := ep.getClient(b.opts.clientOpts)
+	if err == nil {
+		callCtx, cancel := ctx, context.CancelFunc(func() {})
+		if b.opts.endpointTimeout > 0 {
+			callCtx, cancel = context.WithTimeout(ctx, b.opts.endpointTimeout)
+		}
+		err = client.Invoke(callCtx, service, method, reply, params...)
+		cancel()
+	}
+
+	ep.report(ctx, err, b.opts.maxFailures, b.opts.ejectionTime)
+	return err
+}
+
+// Stream implements Streamer on the endpoint chosen by the policy. Only a
+// failure to open the stream counts towards the endpoint's health.
+func (b *BalancedClient) Stream(ctx context.Context, service, method string, params ...interface{}) (*ClientStream, error) {
+	ep, err := b.pick(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ep.getClient(b.opts.clientOpts)
+	if err != nil {
+		ep.report(ctx, err, b.opts.maxFailures, b.opts.ejectionTime)
+		return nil, err
+	}
+
+	stream, err := client.Stream(ctx, service, method, params...)
+	ep.report(ctx, err, b.opts.maxFailures, b.opts.ejectionTime)
+	return stream, err
+}
+
+// CallContext is Client.CallContext on the endpoint chosen by the policy
+func (b *BalancedClient) CallContext(ctx context.Context, service, method string, params ...interface{}) (interface{}, error) {
+	var result interface{}
+	if err := b.Invoke(ctx, service, method, &result, params...); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Call is Client.Call on the endpoint chosen by the policy
+func (b *BalancedClient) Call(service, method string, params ...interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCallTimeout)
+	defer cancel()
+	return b.CallContext(ctx, service, method, params...)
+}
+
+// Close stops refreshing and closes every endpoint connection
+func (b *BalancedClient) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+
+	for _, ep := range b.endpoints {
+		ep.closeClient()
+	}
+	return nil
+}
+
+// available reports whether the endpoint is not currently ejected
+func (ep *endpoint) available(now time.Time) bool {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return !now.Before(ep.ejectedUntil)
+}
+
+// pendingCount reports the calls in flight to this endpoint, and whether
+// it can take a call at once; an endpoint not dialed yet can
+func (ep *endpoint) pendingCount() (int, bool) {
+	ep.mu.Lock()
+	client := ep.client
+	ep.mu.Unlock()
+
+	if client == nil {
+		return 0, true
+	}
+	return client.pendingCount()
+}
+
+// getClient returns the endpoint's client, dialing it on first use. The
+// dial, bounded by the client's dial timeout, runs without holding ep.mu
+// so that picking endpoints never waits for a slow connect.
+func (ep *endpoint) getClient(opts []ClientOption) (*Client, error) {
+	ep.mu.Lock()
+	client, closed := ep.client, ep.closed
+	ep.mu.Unlock()
+
+	if closed {
+		return nil, ErrClientClosed
+	}
+	if client != nil {
+		return client, nil
+	}
+
+	client, err := NewClient(ep.addr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint %s: %w", ep.addr, err)
+	}
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if ep.closed {
+		client.Close()
+		return nil, ErrClientClosed
+	}
+	if ep.client != nil {
+		// Another call dialed meanwhile; use its connection
+		client.Close()
+		return ep.client, nil
+	}
+	ep.client = client
+	return client, nil
+}
+
+// report updates the endpoint's health after a call made under the
+// caller's ctx
+func (ep *endpoint) report(ctx context.Context, err error, maxFailures int, ejectionTime time.Duration) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if !isTransportError(ctx, err) {
+		ep.failures = 0
+		return
+	}
+
+	// A client that lost its only connection will not recover by itself;
+	// dial again next time. Its draining connection closes on its own
+	// once the calls still on it finish.
+	if ep.client != nil && ep.client.lost() {
+		ep.client = nil
+	}
+
+	ep.failures++
+	if maxFailures > 0 && ep.failures >= maxFailures {
+		ep.ejectedUntil = time.Now().Add(ejectionTime)
+		ep.failures = 0
+		log.Printf("Balancer: ejecting %s for %v after %d consecutive failures", ep.addr, ejectionTime, maxFailures)
+	}
+}
+
+// closeClient closes the endpoint's connection if it has one, for good
+func (ep *endpoint) closeClient() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	ep.closed = true
+	if ep.client != nil {
+		ep.client.Close()
+		ep.client = nil
+	}
+}
+
+// isTransportError reports whether err means the endpoint could not serve
+// the call, as opposed to success, an error from the remote method, a
+// local error such as a result that failed to decode, or the caller
+// giving up. It counts connection failures, deadlines that passed while
+// the caller's ctx still had time (WithEndpointTimeout, or a retry
+// policy's PerAttemptTimeout), and ErrCircuitOpen, so the balancer steers
+// around endpoints whose breaker has tripped.
+func isTransportError(ctx context.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrCircuitOpen):
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		return ctx.Err() == nil
+	}
+	return isConnectionError(err)
+}
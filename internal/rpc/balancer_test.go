@@ -0,0 +1,256 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type nameService struct {
+	name string
+}
+
+func (s nameService) Name() string { return s.name }
+
+// Stall ignores its deadline, like a hung server
+func (s nameService) Stall(ms int) string {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	return s.name
+}
+
+func (s nameService) Fail() error { return errors.New("application failure") }
+
+func startNamed(t *testing.T, name string) string {
+	t.Helper()
+
+	server := NewServer()
+	if err := server.Register("Name", nameService{name}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	return serve(t, server)
+}
+
+// deadAddr returns an address nobody listens on
+func deadAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func newBalanced(t *testing.T, addrs []string, opts ...BalancerOption) *BalancedClient {
+	t.Helper()
+
+	b, err := NewBalancedClient(StaticResolver(addrs), opts...)
+	if err != nil {
+		t.Fatalf("NewBalancedClient: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func (b *BalancedClient) endpointFor(addr string) *endpoint {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, ep := range b.endpoints {
+		if ep.addr == addr {
+			return ep
+		}
+	}
+	return nil
+}
+
+func callName(t *testing.T, b *BalancedClient, ctx context.Context) string {
+	t.Helper()
+
+	var name string
+	if err := b.Invoke(ctx, "Name", "Name", &name); err != nil {
+		t.Fatalf("Invoke: %v", err)
+	}
+	return name
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := newBalanced(t, []string{startNamed(t, "a"), startNamed(t, "b")})
+
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		counts[callName(t, b, context.Background())]++
+	}
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Fatalf("calls per endpoint = %v, want 5 each", counts)
+	}
+}
+
+func TestBalancerConsistentHashKeepsKeyOnEndpoint(t *testing.T) {
+	b := newBalanced(t, []string{startNamed(t, "a"), startNamed(t, "b"), startNamed(t, "c")},
+		WithPolicy(ConsistentHash))
+
+	ctx := WithHashKey(context.Background(), "user-42")
+	first := callName(t, b, ctx)
+	for i := 0; i < 5; i++ {
+		if name := callName(t, b, ctx); name != first {
+			t.Fatalf("key moved from %s to %s", first, name)
+		}
+	}
+}
+
+func TestBalancerLeastOutstandingSkipsReconnectingEndpoint(t *testing.T) {
+	a, b := startNamed(t, "a"), startNamed(t, "b")
+	balanced := newBalanced(t, []string{a, b}, WithPolicy(LeastOutstanding),
+		WithClientOptions(WithReconnect(Backoff{Initial: time.Minute})))
+	callName(t, balanced, context.Background())
+	callName(t, balanced, context.Background())
+
+	client, err := balanced.endpointFor(a).getClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropConn(t, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 4; i++ {
+		if name := callName(t, balanced, ctx); name != "b" {
+			t.Fatalf("call went to %s while it reconnects", name)
+		}
+	}
+}
+
+func TestBalancerEjectsFailingEndpoint(t *testing.T) {
+	dead := deadAddr(t)
+	b := newBalanced(t, []string{startNamed(t, "live"), dead}, WithEjection(2, time.Minute))
+
+	failures := 0
+	for i := 0; i < 10; i++ {
+		var name string
+		if err := b.Invoke(context.Background(), "Name", "Name", &name); err != nil {
+			failures++
+		}
+	}
+	if failures != 2 {
+		t.Fatalf("failed calls = %d, want 2 before the dead endpoint is ejected", failures)
+	}
+	if b.endpointFor(dead).available(time.Now()) {
+		t.Fatal("dead endpoint still in rotation")
+	}
+}
+
+func TestBalancerRemoteErrorsDoNotEject(t *testing.T) {
+	addr := startNamed(t, "a")
+	b := newBalanced(t, []string{addr}, WithEjection(1, time.Minute))
+
+	err := b.Invoke(context.Background(), "Name", "Fail", nil)
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Fatalf("Fail = %v, want a RemoteError", err)
+	}
+	if !b.endpointFor(addr).available(time.Now()) {
+		t.Fatal("endpoint ejected for an application error")
+	}
+}
+
+func TestBalancerCountsEndpointTimeouts(t *testing.T) {
+	addr := startNamed(t, "slow")
+	b := newBalanced(t, []string{addr}, WithEjection(2, time.Minute), WithEndpointTimeout(50*time.Millisecond))
+
+	for i := 0; i < 2; i++ {
+		err := b.Invoke(context.Background(), "Name", "Stall", nil, 300)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Stall = %v, want DeadlineExceeded", err)
+		}
+	}
+	if b.endpointFor(addr).available(time.Now()) {
+		t.Fatal("endpoint that timed out twice is still in rotation")
+	}
+}
+
+func TestBalancerIgnoresCallerErrors(t *testing.T) {
+	addr := startNamed(t, "a")
+	b := newBalanced(t, []string{addr}, WithEjection(1, time.Minute))
+
+	// The caller's own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.Invoke(ctx, "Name", "Stall", nil, 300); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stall = %v, want DeadlineExceeded", err)
+	}
+
+	// Cancellation
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := b.Invoke(ctx, "Name", "Stall", nil, 300); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Stall = %v, want Canceled", err)
+	}
+
+	// A result that does not fit the reply
+	var wrong int
+	if err := b.Invoke(context.Background(), "Name", "Name", &wrong); err == nil {
+		t.Fatal("decoding a string into an int succeeded")
+	}
+
+	if !b.endpointFor(addr).available(time.Now()) {
+		t.Fatal("endpoint ejected for the caller's errors")
+	}
+}
+
+func TestBalancerDialsOutsideLockWithTimeout(t *testing.T) {
+	// Accepts TCP but never answers the TLS handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := listener.Addr().String()
+	b := newBalanced(t, []string{addr}, WithClientOptions(
+		WithClientTLS(&tls.Config{InsecureSkipVerify: true}),
+		WithDialTimeout(300*time.Millisecond),
+	))
+
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() { result <- b.Invoke(context.Background(), "Name", "Name", nil) }()
+
+	// Picking an endpoint must not wait for the hanging dial
+	time.Sleep(50 * time.Millisecond)
+	picked := make(chan struct{})
+	go func() {
+		b.pick(context.Background())
+		close(picked)
+	}()
+	select {
+	case <-picked:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("pick blocked behind a dial")
+	}
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("Invoke succeeded against a server that never handshakes")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("dial took %v despite a 300ms timeout", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Invoke still waiting on the dial")
+	}
+}
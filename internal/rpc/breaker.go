@@ -0,0 +1,346 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting the server while the
+// circuit breaker for an endpoint and method is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+// Circuit breaker states
+const (
+	// StateClosed lets every call through and counts failures
+	StateClosed BreakerState = iota
+	// StateOpen rejects calls with ErrCircuitOpen until the cooldown ends
+	StateOpen
+	// StateHalfOpen lets a few probe calls through to test recovery
+	StateHalfOpen
+)
+
+// String returns the state name
+func (s BreakerState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half_open"
+	}
+	return "state(" + strconv.Itoa(int(s)) + ")"
+}
+
+// BreakerConfig controls when a circuit breaker trips and recovers.
+// A breaker trips when either threshold is reached. Zero fields take
+// their value from DefaultBreakerConfig; a negative ConsecutiveFailures
+// or FailureRatio disables that check.
+type BreakerConfig struct {
+	// ConsecutiveFailures trips the breaker after this many failures in a row
+	ConsecutiveFailures int
+	// FailureRatio trips the breaker when failures/requests within the
+	// current window reaches it, once MinRequests calls were seen
+	FailureRatio float64
+	MinRequests  int
+	// Window is how long closed-state counts are kept before being reset
+	Window time.Duration
+	// Cooldown is how long the breaker stays open before probing
+	Cooldown time.Duration
+	// HalfOpenMaxCalls is the number of probe calls allowed while half-open;
+	// the breaker closes once that many succeed
+	HalfOpenMaxCalls int
+	// IsFailure classifies a call result; nil means DefaultIsFailure
+	IsFailure func(err error) bool
+	// OnStateChange, if set, is called on every transition, e.g. to
+	// update a metrics gauge. It must not block.
+	OnStateChange func(name string, from, to BreakerState)
+}
+
+// DefaultBreakerConfig is a reasonable starting point for most services
+var DefaultBreakerConfig = BreakerConfig{
+	ConsecutiveFailures: 5,
+	FailureRatio:        0.5,
+	MinRequests:         20,
+	Window:              10 * time.Second,
+	Cooldown:            5 * time.Second,
+	HalfOpenMaxCalls:    1,
+}
+
+// DefaultIsFailure counts connection errors, timeouts and internal server
+// errors against the breaker. Errors the remote method returns on purpose
+// (invalid arguments, application errors), local errors such as a result
+// that failed to decode, and calls cancelled by the caller do not say
+// anything about the server's health.
+func DefaultIsFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.Code == CodeInternal || remoteErr.Code == CodeDeadlineExceeded
+	}
+	return errors.Is(err, context.DeadlineExceeded) || isConnectionError(err)
+}
+
+// BreakerStats is a snapshot of one circuit breaker for metrics
+type BreakerStats struct {
+	Name                string
+	State               BreakerState
+	Requests            int // calls in the current window
+	Failures            int // failed calls in the current window
+	ConsecutiveFailures int
+	Since               time.Time // when the breaker entered State
+}
+
+// CircuitBreaker guards one endpoint and method
+type CircuitBreaker struct {
+	name string
+	cfg  BreakerConfig
+
+	mu          sync.Mutex
+	state       BreakerState
+	since       time.Time
+	generation  uint64 // bumped on every transition so stale results are ignored
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	probes      int // half-open calls in flight
+	successes   int // half-open calls that succeeded
+}
+
+// NewCircuitBreaker creates a closed breaker; zero fields in cfg are taken
+// from DefaultBreakerConfig
+func NewCircuitBreaker(name string, cfg BreakerConfig) *CircuitBreaker {
+	if cfg.ConsecutiveFailures == 0 {
+		cfg.ConsecutiveFailures = DefaultBreakerConfig.ConsecutiveFailures
+	}
+	if cfg.FailureRatio == 0 {
+		cfg.FailureRatio = DefaultBreakerConfig.FailureRatio
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = DefaultBreakerConfig.MinRequests
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultBreakerConfig.Window
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = DefaultBreakerConfig.Cooldown
+	}
+	if cfg.HalfOpenMaxCalls <= 0 {
+		cfg.HalfOpenMaxCalls = DefaultBreakerConfig.HalfOpenMaxCalls
+	}
+	if cfg.IsFailure == nil {
+		cfg.IsFailure = DefaultIsFailure
+	}
+
+	now := time.Now()
+	return &CircuitBreaker{
+		name:        name,
+		cfg:         cfg,
+		since:       now,
+		windowStart: now,
+	}
+}
+
+// Allow asks whether a call may proceed. On success the returned done
+// func must be called with the call's result.
+func (cb *CircuitBreaker) Allow() (done func(err error), err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	switch cb.state {
+	case StateClosed:
+		if now.Sub(cb.windowStart) >= cb.cfg.Window {
+			cb.resetCounts(now)
+		}
+
+	case StateOpen:
+		if now.Sub(cb.since) < cb.cfg.Cooldown {
+			return nil, fmt.Errorf("%w: %s", ErrCircuitOpen, cb.name)
+		}
+		cb.setState(StateHalfOpen, now)
+		fallthrough
+
+	case StateHalfOpen:
+		if cb.probes >= cb.cfg.HalfOpenMaxCalls {
+			return nil, fmt.Errorf("%w: %s", ErrCircuitOpen, cb.name)
+		}
+		cb.probes++
+	}
+
+	generation := cb.generation
+	return func(err error) {
+		cb.record(generation, cb.cfg.IsFailure(err))
+	}, nil
+}
+
+// record applies one call result, unless the breaker moved on since the
+// call was allowed
+func (cb *CircuitBreaker) record(generation uint64, failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if generation != cb.generation {
+		return
+	}
+
+	now := time.Now()
+	switch cb.state {
+	case StateClosed:
+		cb.requests++
+		if !failed {
+			cb.consecutive = 0
+			return
+		}
+		cb.failures++
+		cb.consecutive++
+		if cb.shouldTrip() {
+			cb.setState(StateOpen, now)
+		}
+
+	case StateHalfOpen:
+		cb.probes--
+		if failed {
+			cb.setState(StateOpen, now)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.cfg.HalfOpenMaxCalls {
+			cb.setState(StateClosed, now)
+		}
+	}
+}
+
+// shouldTrip checks the thresholds against the closed-state counts
+func (cb *CircuitBreaker) shouldTrip() bool {
+	if cb.cfg.ConsecutiveFailures > 0 && cb.consecutive >= cb.cfg.ConsecutiveFailures {
+		return true
+	}
+	if cb.cfg.FailureRatio > 0 && cb.requests >= cb.cfg.MinRequests {
+		return float64(cb.failures)/float64(cb.requests) >= cb.cfg.FailureRatio
+	}
+	return false
+}
+
+// setState moves to state and starts a fresh generation
+func (cb *CircuitBreaker) setState(state BreakerState, now time.Time) {
+	from := cb.state
+	cb.state = state
+	cb.since = now
+	cb.generation++
+	cb.probes = 0
+	cb.successes = 0
+	cb.resetCounts(now)
+
+	if cb.cfg.OnStateChange != nil {
+		cb.cfg.OnStateChange(cb.name, from, state)
+	}
+}
+
+// resetCounts starts a new closed-state window
+func (cb *CircuitBreaker) resetCounts(now time.Time) {
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+	cb.consecutive = 0
+}
+
+// State returns the current state. An open breaker whose cooldown has
+// passed is reported as half-open, since the next call will probe.
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == StateOpen && time.Since(cb.since) >= cb.cfg.Cooldown {
+		return StateHalfOpen
+	}
+	return cb.state
+}
+
+// Stats returns a snapshot of the breaker
+func (cb *CircuitBreaker) Stats() BreakerStats {
+	state := cb.State()
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return BreakerStats{
+		Name:                cb.name,
+		State:               state,
+		Requests:            cb.requests,
+		Failures:            cb.failures,
+		ConsecutiveFailures: cb.consecutive,
+		Since:               cb.since,
+	}
+}
+
+// Breakers holds one CircuitBreaker per endpoint and method, created on
+// first use. Pass the same Breakers to several clients (a Pool, or every
+// endpoint of a BalancedClient) to share state and read it in one place.
+type Breakers struct {
+	cfg BreakerConfig
+
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// NewBreakers creates an empty set of breakers configured by cfg
+func NewBreakers(cfg BreakerConfig) *Breakers {
+	return &Breakers{
+		cfg:      cfg,
+		breakers: make(map[string]*CircuitBreaker),
+	}
+}
+
+// get returns the breaker for addr and Service.Method, creating it if needed
+func (bs *Breakers) get(addr, service, method string) *CircuitBreaker {
+	name := addr + "/" + service + "." + method
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	cb, ok := bs.breakers[name]
+	if !ok {
+		cb = NewCircuitBreaker(name, bs.cfg)
+		bs.breakers[name] = cb
+	}
+	return cb
+}
+
+// Stats returns a snapshot of every breaker, sorted by name
+func (bs *Breakers) Stats() []BreakerStats {
+	bs.mu.Lock()
+	breakers := make([]*CircuitBreaker, 0, len(bs.breakers))
+	for _, cb := range bs.breakers {
+		breakers = append(breakers, cb)
+	}
+	bs.mu.Unlock()
+
+	stats := make([]BreakerStats, 0, len(breakers))
+	for _, cb := range breakers {
+		stats = append(stats, cb.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// WithCircuitBreaker guards every call with the breaker for the client's
+// address and the called method. While it is open calls fail fast with
+// ErrCircuitOpen instead of waiting on a failing server.
+func WithCircuitBreaker(breakers *Breakers) ClientOption {
+	return func(o *clientOptions) {
+		o.breakers = breakers
+	}
+}
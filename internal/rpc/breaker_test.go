@@ -0,0 +1,127 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+var errTransport = fmt.Errorf("failed to send request: %w", io.ErrClosedPipe)
+
+// run passes n calls with result err through cb
+func run(t *testing.T, cb *CircuitBreaker, n int, err error) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		done, allowErr := cb.Allow()
+		if allowErr != nil {
+			t.Fatalf("call %d rejected: %v", i, allowErr)
+		}
+		done(err)
+	}
+}
+
+func TestBreakerZeroConfigUsesDefaults(t *testing.T) {
+	cb := NewBreakers(BreakerConfig{}).get("addr", "S", "M")
+
+	run(t, cb, DefaultBreakerConfig.ConsecutiveFailures-1, errTransport)
+	if state := cb.State(); state != StateClosed {
+		t.Fatalf("state after %d failures = %s, want closed", DefaultBreakerConfig.ConsecutiveFailures-1, state)
+	}
+	run(t, cb, 1, errTransport)
+	if state := cb.State(); state != StateOpen {
+		t.Fatalf("state after %d failures = %s, want open", DefaultBreakerConfig.ConsecutiveFailures, state)
+	}
+	if _, err := cb.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow while open = %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestBreakerRatioWaitsForMinRequests(t *testing.T) {
+	// MinRequests is left at zero and must not trip on the first failure
+	cb := NewCircuitBreaker("b", BreakerConfig{ConsecutiveFailures: -1, FailureRatio: 0.5})
+
+	run(t, cb, 1, errTransport)
+	if state := cb.State(); state != StateClosed {
+		t.Fatalf("state after one failure = %s, want closed", state)
+	}
+
+	// The 20th call, a failure, reaches the ratio at MinRequests
+	run(t, cb, 10, nil)
+	run(t, cb, 8, errTransport)
+	if state := cb.State(); state != StateClosed {
+		t.Fatalf("state after 19 calls = %s, want closed", state)
+	}
+	run(t, cb, 1, errTransport)
+	if state := cb.State(); state != StateOpen {
+		t.Fatalf("state after 20 calls, 10 failed = %s, want open", state)
+	}
+}
+
+func TestBreakerNegativeThresholdDisablesCheck(t *testing.T) {
+	cb := NewCircuitBreaker("b", BreakerConfig{ConsecutiveFailures: -1, FailureRatio: -1})
+
+	run(t, cb, 100, errTransport)
+	if state := cb.State(); state != StateClosed {
+		t.Fatalf("state with both checks disabled = %s, want closed", state)
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	var transitions []BreakerState
+	cb := NewCircuitBreaker("b", BreakerConfig{
+		ConsecutiveFailures: 2,
+		Cooldown:            50 * time.Millisecond,
+		OnStateChange: func(name string, from, to BreakerState) {
+			transitions = append(transitions, to)
+		},
+	})
+
+	run(t, cb, 2, errTransport)
+	time.Sleep(60 * time.Millisecond)
+	if state := cb.State(); state != StateHalfOpen {
+		t.Fatalf("state after cooldown = %s, want half_open", state)
+	}
+
+	// A failed probe opens again, a successful one closes
+	run(t, cb, 1, errTransport)
+	time.Sleep(60 * time.Millisecond)
+	done, err := cb.Allow()
+	if err != nil {
+		t.Fatalf("probe rejected: %v", err)
+	}
+	if _, err := cb.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second concurrent probe = %v, want ErrCircuitOpen", err)
+	}
+	done(nil)
+	if state := cb.State(); state != StateClosed {
+		t.Fatalf("state after a good probe = %s, want closed", state)
+	}
+
+	want := []BreakerState{StateOpen, StateHalfOpen, StateOpen, StateHalfOpen, StateClosed}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", transitions, want)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Fatalf("transitions = %v, want %v", transitions, want)
+		}
+	}
+}
+
+func TestBreakerIgnoresRemoteApplicationErrors(t *testing.T) {
+	cb := NewCircuitBreaker("b", BreakerConfig{ConsecutiveFailures: 1})
+
+	run(t, cb, 5, Errorf(CodeApplication, "no such user"))
+	run(t, cb, 5, Errorf(CodeInvalidArgument, "bad input"))
+	run(t, cb, 5, fmt.Errorf("failed to decode result: %w", errors.New("bad json")))
+	if state := cb.State(); state != StateClosed {
+		t.Fatalf("state after application and decode errors = %s, want closed", state)
+	}
+	run(t, cb, 1, Errorf(CodeInternal, "panic"))
+	if state := cb.State(); state != StateOpen {
+		t.Fatalf("state after an internal error = %s, want open", state)
+	}
+}
@@ -1,125 +1,490 @@
 package rpc
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"net"
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Errors returned by Client when no response can be delivered
+var (
+	ErrClientClosed   = errors.New("client is closed")
+	ErrConnectionLost = errors.New("connection lost")
+)
+
+// Invoker performs a single RPC call and decodes its result into reply.
+// Client implements it; generated stubs (see cmd/rpcgen) depend only on it.
+type Invoker interface {
+	Invoke(ctx context.Context, service, method string, reply interface{}, params ...interface{}) error
+}
+
 // Client is the RPC client (Stub)
 type Client struct {
 	addr    string
-	conn    net.Conn
-	mu      sync.Mutex
-	pending map[string]chan *Response
-	reader  *bufio.Reader
-	closed  bool
+	opts    clientOptions
+	payload PayloadCodec // encodes params and results for opts.codec
+	seq     atomic.Uint64
+
+	mu     sync.Mutex
+	conn   *clientConn   // nil while reconnecting
+	ready  chan struct{} // closed once conn is set again
+	closed bool
+	done   chan struct{} // closed by Close to stop reconnecting
+
+	descMu       sync.Mutex
+	descriptions map[string]*ServiceDescription // cached for retry decisions
+
+	handler         CallHandler // call wrapped in interceptors
+	describeHandler CallHandler // invokeOnce wrapped in interceptors
+	notifyHandler   CallHandler // sendNoReply wrapped in interceptors
+}
+
+// ClientOption configures a Client
+type ClientOption func(*clientOptions)
+
+// clientOptions collects the settings applied by ClientOption
+type clientOptions struct {
+	codec        CodecType
+	dialTimeout  time.Duration
+	reconnect    bool
+	backoff      Backoff
+	breakers     *Breakers
+	retry        *RetryPolicy
+	interceptors []ClientInterceptor
+	tlsConfig    *tls.Config
+	credentials  []PerRPCCredentials
+}
+
+// WithCodec selects the codec announced in the connection handshake
+func WithCodec(codecType CodecType) ClientOption {
+	return func(o *clientOptions) {
+		o.codec = codecType
+	}
+}
+
+// DefaultDialTimeout bounds connecting unless WithDialTimeout says otherwise
+const DefaultDialTimeout = 5 * time.Second
+
+// WithDialTimeout bounds establishing a connection, including the TLS
+// handshake, in NewClient and on every reconnect
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.dialTimeout = timeout
+	}
+}
+
+// WithReconnect makes the client redial after losing its connection or
+// receiving KindGoAway, instead of failing every later call with
+// ErrConnectionLost. Calls issued while reconnecting wait for the new
+// connection until their context is done; calls in flight when the
+// connection dropped fail with ErrConnectionLost. A zero Backoff means
+// DefaultBackoff.
+func WithReconnect(backoff Backoff) ClientOption {
+	return func(o *clientOptions) {
+		o.reconnect = true
+		o.backoff = backoff
+	}
 }
 
 // NewClient creates a new RPC client
-func NewClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect: %w", err)
+func NewClient(addr string, opts ...ClientOption) (*Client, error) {
+	options := clientOptions{codec: CodecJSON, dialTimeout: DefaultDialTimeout}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	info, ok := codecs[options.codec]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %s", options.codec)
 	}
 
 	client := &Client{
 		addr:    addr,
-		conn:    conn,
+		opts:    options,
+		payload: info.payload,
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	client.handler = chainClient(options.interceptors, client.call)
+	client.describeHandler = chainClient(options.interceptors, client.invokeOnce)
+	client.notifyHandler = chainClient(options.interceptors, client.sendNoReply)
+
+	conn, err := client.dial()
+	if err != nil {
+		return nil, err
+	}
+	client.setConn(conn)
+
+	return client, nil
+}
+
+// dial opens a connection and starts its response handler
+func (c *Client) dial() (*clientConn, error) {
+	netConn, err := dialConn(c.addr, c.opts.tlsConfig, c.opts.dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	if err := writeHandshake(netConn, c.opts.codec); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	conn := &clientConn{
+		codec:   codecs[c.opts.codec].newCodec(netConn),
 		pending: make(map[string]chan *Response),
-		reader:  bufio.NewReader(conn),
 	}
 
 	// Start response handler
-	go client.handleResponses()
+	go conn.handleResponses(c.connLost)
 
-	return client, nil
+	return conn, nil
 }
 
-// Call makes a synchronous RPC call
-func (c *Client) Call(service, method string, params ...interface{}) (interface{}, error) {
+// setConn publishes a live connection and wakes waiting callers
+func (c *Client) setConn(conn *clientConn) {
 	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.closed {
-		c.mu.Unlock()
-		return nil, fmt.Errorf("client is closed")
+		conn.close()
+		return
+	}
+	c.conn = conn
+	close(c.ready)
+}
+
+// connLost is called by a connection's response handler when it fails or
+// the server sends KindGoAway; either way no new call may use it. Without
+// WithReconnect the client keeps the connection, which refuses new calls
+// by itself while its in-flight calls finish.
+func (c *Client) connLost(conn *clientConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != conn || c.closed || !c.opts.reconnect {
+		return
 	}
 
-	// Generate request ID
-	reqID := fmt.Sprintf("%s-%s-%d", service, method, time.Now().UnixNano())
+	c.conn = nil
+	c.ready = make(chan struct{})
+	go c.reconnect()
+}
 
-	// Create response channel
-	respChan := make(chan *Response, 1)
-	c.pending[reqID] = respChan
-	c.mu.Unlock()
+// reconnect redials with exponential backoff until it succeeds or the
+// client is closed
+func (c *Client) reconnect() {
+	for attempt := 0; ; attempt++ {
+		delay := c.opts.backoff.Delay(attempt)
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			return
+		}
 
-	// Defer cleanup
-	defer func() {
+		conn, err := c.dial()
+		if err != nil {
+			log.Printf("Reconnect to %s failed (attempt %d): %v", c.addr, attempt+1, err)
+			continue
+		}
+
+		log.Printf("Reconnected to %s", c.addr)
+		c.setConn(conn)
+		return
+	}
+}
+
+// getConn returns the live connection, waiting for a reconnect if needed.
+// A client without WithReconnect whose connection failed or is going away
+// returns ErrConnectionLost.
+func (c *Client) getConn(ctx context.Context) (*clientConn, error) {
+	for {
 		c.mu.Lock()
-		delete(c.pending, reqID)
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrClientClosed
+		}
+		conn, ready := c.conn, c.ready
 		c.mu.Unlock()
-	}()
 
-	// Create request
-	req := Request{
-		ID:        reqID,
-		Service:   service,
-		Method:    method,
-		Params:    params,
-		TimeoutMS: 5000,
+		if conn != nil && !c.opts.reconnect {
+			// The only connection this client will have
+			if err := conn.usable(); errors.Is(err, errGoingAway) {
+				return nil, fmt.Errorf("%w: server is shutting down", ErrConnectionLost)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if conn != nil {
+			return conn, nil
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
+}
 
-	// Encode and send request
-	reqData, err := EncodeRequest(req)
-	if err != nil {
+// pendingCount reports the number of calls waiting for a response, and
+// whether a new call would be sent at once rather than wait for a
+// reconnect or fail
+func (c *Client) pendingCount() (int, bool) {
+	c.mu.Lock()
+	conn, closed := c.conn, c.closed
+	c.mu.Unlock()
+
+	if conn == nil || closed {
+		return 0, false
+	}
+	return conn.pendingCount(), conn.usable() == nil
+}
+
+// DefaultCallTimeout is the deadline applied by Call
+const DefaultCallTimeout = 5 * time.Second
+
+// Call makes a synchronous RPC call bounded by DefaultCallTimeout
+func (c *Client) Call(service, method string, params ...interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCallTimeout)
+	defer cancel()
+	return c.CallContext(ctx, service, method, params...)
+}
+
+// CallContext makes a synchronous RPC call that gives up when ctx is done.
+// The remaining time until ctx's deadline is sent to the server so the
+// remote method can stop working once the caller is no longer waiting.
+// Failures reported by the server are returned as *RemoteError.
+// The result is decoded generically, so numbers come back as float64;
+// use Invoke to decode into a concrete type.
+func (c *Client) CallContext(ctx context.Context, service, method string, params ...interface{}) (interface{}, error) {
+	var result interface{}
+	if err := c.Invoke(ctx, service, method, &result, params...); err != nil {
 		return nil, err
 	}
+	return result, nil
+}
+
+// Invoke makes a synchronous RPC call and decodes the result into reply,
+// which must be a pointer (or nil to discard the result).
+// With WithRetry, failed calls to methods the server declared idempotent
+// are retried according to the policy.
+func (c *Client) Invoke(ctx context.Context, service, method string, reply interface{}, params ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	encodedParams, err := encodeParams(c.payload, params)
+	if err != nil {
+		return err
+	}
+
+	req := &Request{
+		Service:  service,
+		Method:   method,
+		Params:   encodedParams,
+		Metadata: requestMetadata(ctx),
+	}
+	return c.handler(ctx, req, reply)
+}
+
+// call is the innermost CallHandler, below the interceptors
+func (c *Client) call(ctx context.Context, req *Request, reply interface{}) error {
+	if c.opts.retry != nil {
+		return c.invokeWithRetry(ctx, req, reply)
+	}
+	return c.invokeOnce(ctx, req, reply)
+}
+
+// invokeOnce sends a single attempt of req, guarded by the circuit breaker
+// if one is configured
+func (c *Client) invokeOnce(ctx context.Context, req *Request, reply interface{}) (err error) {
+	// Each attempt is its own wire request; responses may arrive out of
+	// order so the ID must be unique
+	attempt := *req
+	attempt.ID = fmt.Sprintf("%s-%s-%d", req.Service, req.Method, c.seq.Add(1))
+	if err := c.addCredentials(ctx, &attempt); err != nil {
+		return err
+	}
+
+	if c.opts.breakers != nil {
+		done, allowErr := c.opts.breakers.get(c.addr, req.Service, req.Method).Allow()
+		if allowErr != nil {
+			return allowErr
+		}
+		defer func() { done(err) }()
+	}
+
+	timeoutMS, err := timeoutFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	attempt.TimeoutMS = timeoutMS
+
+	var resp *Response
+	for {
+		conn, err := c.getConn(ctx)
+		if err != nil {
+			return err
+		}
+		resp, err = conn.roundTrip(ctx, &attempt)
+		if errors.Is(err, errGoingAway) {
+			// Not sent; the server is draining this connection
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+	captureResponseMetadata(ctx, resp)
+	if resp.Error != nil {
+		return resp.Error
+	}
+	return decodeResult(c.payload, resp.Result, reply)
+}
 
+// lost reports whether the client can make no more calls: it was closed,
+// or it has no WithReconnect and its connection failed or is going away
+func (c *Client) lost() bool {
 	c.mu.Lock()
-	_, err = c.conn.Write(reqData)
+	closed, conn := c.closed, c.conn
 	c.mu.Unlock()
 
-	if err != nil {
+	if closed {
+		return true
+	}
+	return !c.opts.reconnect && conn != nil && conn.usable() != nil
+}
+
+// Close closes the client connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	close(c.done)
+	if c.conn != nil {
+		return c.conn.close()
+	}
+	return nil
+}
+
+// clientConn is one established connection and the calls pending on it
+type clientConn struct {
+	codec   Codec
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	pending   map[string]chan *Response
+	streams   map[string]*ClientStream
+	broken    bool
+	goingAway bool // the server sent KindGoAway
+}
+
+// roundTrip sends req and waits for its response or for ctx to be done
+func (cc *clientConn) roundTrip(ctx context.Context, req *Request) (*Response, error) {
+	// Create response channel
+	respChan := make(chan *Response, 1)
+
+	cc.mu.Lock()
+	if err := cc.usableLocked(); err != nil {
+		cc.mu.Unlock()
+		return nil, err
+	}
+	cc.pending[req.ID] = respChan
+	cc.mu.Unlock()
+
+	// Defer cleanup
+	defer func() {
+		cc.mu.Lock()
+		delete(cc.pending, req.ID)
+		drained := cc.drainedLocked()
+		cc.mu.Unlock()
+
+		if drained {
+			cc.close()
+		}
+	}()
+
+	// Encode and send request
+	if err := cc.write(req); err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 
-	// Wait for response with timeout
+	// Wait for response or for the caller to give up
 	select {
-	case resp := <-respChan:
-		if resp.Error != "" {
-			return nil, fmt.Errorf("remote error: %s", resp.Error)
+	case resp, ok := <-respChan:
+		if !ok {
+			return nil, ErrConnectionLost
 		}
-		return resp.Result, nil
-	case <-time.After(5 * time.Second):
-		return nil, fmt.Errorf("request timeout")
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
-// handleResponses reads and dispatches responses
-func (c *Client) handleResponses() {
+// write sends one request frame; writes from concurrent calls and
+// streams are serialized
+func (cc *clientConn) write(req *Request) error {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+	return cc.codec.WriteRequest(req)
+}
+
+// handleResponses reads and dispatches responses until the connection
+// fails, then reports the failure through lost
+func (cc *clientConn) handleResponses(lost func(*clientConn)) {
 	for {
-		line, err := c.reader.ReadBytes('\n')
+		resp := &Response{}
+		err := cc.codec.ReadResponse(resp)
+		if isDecodeError(err) {
+			continue
+		}
 		if err != nil {
-			c.mu.Lock()
-			c.closed = true
+			cc.mu.Lock()
+			cc.broken = true
 			// Notify all pending requests
-			for _, ch := range c.pending {
+			for _, ch := range cc.pending {
 				close(ch)
 			}
-			c.pending = make(map[string]chan *Response)
-			c.mu.Unlock()
+			cc.pending = make(map[string]chan *Response)
+			streams := cc.streams
+			cc.streams = nil
+			cc.mu.Unlock()
+
+			for _, cs := range streams {
+				cs.end(ErrConnectionLost, nil)
+			}
+
+			cc.codec.Close()
+			lost(cc)
 			return
 		}
 
-		resp, err := DecodeResponse(line)
-		if err != nil {
+		if resp.Kind == KindGoAway {
+			// Detach from the client first so new calls pick another
+			// connection instead of finding this one going away
+			lost(cc)
+			cc.goAway()
+			continue
+		}
+		if resp.Kind != "" {
+			cc.routeStreamFrame(resp)
 			continue
 		}
 
-		c.mu.Lock()
-		respChan, exists := c.pending[resp.ID]
-		c.mu.Unlock()
+		cc.mu.Lock()
+		respChan, exists := cc.pending[resp.ID]
+		cc.mu.Unlock()
 
 		if exists {
 			respChan <- resp
@@ -127,15 +492,57 @@ func (c *Client) handleResponses() {
 	}
 }
 
-// Close closes the client connection
-func (c *Client) Close() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// pendingCount reports the number of calls waiting on this connection
+func (cc *clientConn) pendingCount() int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return len(cc.pending)
+}
 
-	if c.closed {
+// close closes the underlying connection; handleResponses then fails the
+// pending calls
+func (cc *clientConn) close() error {
+	return cc.codec.Close()
+}
+
+// encodeParams marshals each argument separately so the server can decode
+// it straight into the declared parameter type
+func encodeParams(payload PayloadCodec, params []interface{}) ([]Payload, error) {
+	encoded := make([]Payload, len(params))
+	for i, param := range params {
+		data, err := payload.Marshal(param)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode parameter %d: %w", i, err)
+		}
+		encoded[i] = data
+	}
+	return encoded, nil
+}
+
+// decodeResult unmarshals an encoded result into reply
+func decodeResult(payload PayloadCodec, result Payload, reply interface{}) error {
+	if reply == nil || len(result) == 0 {
 		return nil
 	}
+	if err := payload.Unmarshal(result, reply); err != nil {
+		return fmt.Errorf("failed to decode result: %w", err)
+	}
+	return nil
+}
 
-	c.closed = true
-	return c.conn.Close()
+// timeoutFromContext converts ctx's deadline into the TimeoutMS wire value.
+// Zero means the caller set no deadline.
+func timeoutFromContext(ctx context.Context) (int, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+
+	// Round up so sub-millisecond budgets are not sent as "no deadline"
+	return int((remaining + time.Millisecond - 1) / time.Millisecond), nil
 }
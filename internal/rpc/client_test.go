@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// deadlineService reports the deadline it was given and how its context
+// ended
+type deadlineService struct {
+	ended chan error
+}
+
+func (s *deadlineService) Remaining(ctx context.Context) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return -1
+	}
+	return int(time.Until(deadline) / time.Millisecond)
+}
+
+func (s *deadlineService) Wait(ctx context.Context) error {
+	<-ctx.Done()
+	s.ended <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestCallContextPropagatesDeadline(t *testing.T) {
+	svc := &deadlineService{ended: make(chan error, 1)}
+	server := NewServer()
+	if err := server.Register("Deadline", svc); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	client := dialCodec(t, serve(t, server), CodecJSON)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var remaining int
+	if err := client.Invoke(ctx, "Deadline", "Remaining", &remaining); err != nil {
+		t.Fatalf("Remaining: %v", err)
+	}
+	if remaining <= 0 || remaining > 500 {
+		t.Fatalf("server saw %dms left; want the caller's 500ms budget", remaining)
+	}
+
+	if err := client.Invoke(context.Background(), "Deadline", "Remaining", &remaining); err != nil {
+		t.Fatalf("Remaining: %v", err)
+	}
+	if remaining != -1 {
+		t.Fatalf("server saw %dms left for a call without deadline", remaining)
+	}
+}
+
+func TestCallContextTimeoutStopsServerMethod(t *testing.T) {
+	svc := &deadlineService{ended: make(chan error, 1)}
+	server := NewServer()
+	if err := server.Register("Deadline", svc); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	client := dialCodec(t, serve(t, server), CodecJSON)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.CallContext(ctx, "Deadline", "Wait"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait = %v; want context.DeadlineExceeded", err)
+	}
+
+	select {
+	case err := <-svc.ended:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("server method ended with %v; want context.DeadlineExceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server method still running after the caller's deadline")
+	}
+}
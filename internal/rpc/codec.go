@@ -1,27 +1,305 @@
 package rpc
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+
+	"github.com/cont1nu1ty/distributed-systems-go-demos/pkg/socket"
 )
 
-// Request represents an RPC request
+// Request represents an RPC request.
+// Each parameter is kept encoded until the server knows its declared type.
+// TimeoutMS is the caller's remaining deadline in milliseconds; zero means no deadline.
+// Kind is empty for unary calls and names the frame type of a stream
+// otherwise (see KindStreamOpen); Window is only used by KindStreamWindow.
+// NoReply marks a one-way request (see Client.Notify) that gets no response.
 type Request struct {
-	ID        string        `json:"id"`
-	Service   string        `json:"service"`
-	Method    string        `json:"method"`
-	Params    []interface{} `json:"params"`
-	TimeoutMS int           `json:"timeout_ms"`
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind,omitempty"`
+	Service   string    `json:"service"`
+	Method    string    `json:"method"`
+	Params    []Payload `json:"params"`
+	TimeoutMS int       `json:"timeout_ms"`
+	Metadata  Metadata  `json:"metadata,omitempty"`
+	Window    int       `json:"window,omitempty"`
+	NoReply   bool      `json:"no_reply,omitempty"`
 }
 
-// Response represents an RPC response
+// Response represents an RPC response.
+// Error is nil when the call succeeded. Kind and Window mirror Request.
 type Response struct {
-	ID     string      `json:"id"`
-	Result interface{} `json:"result"`
-	Error  string      `json:"error"`
+	ID       string       `json:"id"`
+	Kind     string       `json:"kind,omitempty"`
+	Result   Payload      `json:"result,omitempty"`
+	Error    *RemoteError `json:"error,omitempty"`
+	Metadata Metadata     `json:"metadata,omitempty"`
+	Window   int          `json:"window,omitempty"`
+}
+
+// Codec reads and writes RPC messages on one connection.
+// The server uses ReadRequest/WriteResponse and the client uses
+// WriteRequest/ReadResponse. Writes are serialized by the caller.
+type Codec interface {
+	ReadRequest(req *Request) error
+	WriteRequest(req *Request) error
+	ReadResponse(resp *Response) error
+	WriteResponse(resp *Response) error
+	Close() error
+}
+
+// CodecType identifies a codec in the connection handshake
+type CodecType byte
+
+// Built-in codecs
+const (
+	CodecJSON  CodecType = 'J'
+	CodecGob   CodecType = 'G'
+	CodecProto CodecType = 'P'
+)
+
+// MaxFrameSize bounds a single length-prefixed message of the json and
+// proto codecs
+const MaxFrameSize = 16 << 20
+
+// handshakeMagic starts every connection; the codec byte follows it.
+// A connection whose first byte is '{' is treated as legacy
+// newline-delimited JSON without a handshake.
+var handshakeMagic = [3]byte{'R', 'P', 'C'}
+
+// codecInfo is a registered codec implementation: the message codec and
+// the encoding of the parameters and results it carries
+type codecInfo struct {
+	name     string
+	newCodec func(rwc io.ReadWriteCloser) Codec
+	payload  PayloadCodec
+}
+
+var codecs = map[CodecType]codecInfo{
+	CodecJSON:  {name: "json", newCodec: NewJSONCodec, payload: jsonPayload{}},
+	CodecGob:   {name: "gob", newCodec: NewGobCodec, payload: gobPayload{}},
+	CodecProto: {name: "proto", newCodec: NewProtoCodec, payload: protoPayload{}},
+}
+
+// RegisterCodec makes a codec available under the given handshake byte,
+// with payload encoding its parameters and results.
+// It must be called before any connection uses the codec.
+func RegisterCodec(codecType CodecType, name string, newCodec func(rwc io.ReadWriteCloser) Codec, payload PayloadCodec) {
+	codecs[codecType] = codecInfo{name: name, newCodec: newCodec, payload: payload}
+}
+
+// CodecByName looks up a registered codec by its name, e.g. "gob"
+func CodecByName(name string) (CodecType, bool) {
+	for codecType, info := range codecs {
+		if info.name == name {
+			return codecType, true
+		}
+	}
+	return 0, false
+}
+
+// String returns the codec name
+func (t CodecType) String() string {
+	if info, ok := codecs[t]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("codec(%#x)", byte(t))
+}
+
+// writeHandshake announces the codec the client will speak
+func writeHandshake(w io.Writer, codecType CodecType) error {
+	if _, ok := codecs[codecType]; !ok {
+		return fmt.Errorf("unknown codec %s", codecType)
+	}
+	header := append(handshakeMagic[:], byte(codecType))
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write handshake: %w", err)
+	}
+	return nil
+}
+
+// readHandshake reads the client's codec choice and returns a codec reading
+// through r, which must already wrap the connection, and its payload codec
+func readHandshake(r *bufio.Reader, rwc io.ReadWriteCloser) (Codec, PayloadCodec, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{r, rwc, rwc}
+
+	if first[0] == '{' {
+		return newLineJSONCodec(conn), jsonPayload{}, nil
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, fmt.Errorf("failed to read handshake: %w", err)
+	}
+	if [3]byte(header[:3]) != handshakeMagic {
+		return nil, nil, fmt.Errorf("bad handshake magic %q", header[:3])
+	}
+
+	info, ok := codecs[CodecType(header[3])]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown codec %s", CodecType(header[3]))
+	}
+	return info.newCodec(conn), info.payload, nil
+}
+
+// decodeError reports a message that could not be decoded although the
+// framing is intact, so the connection can keep going
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string { return e.err.Error() }
+func (e *decodeError) Unwrap() error { return e.err }
+
+// isDecodeError reports whether err came from a single bad message
+func isDecodeError(err error) bool {
+	var de *decodeError
+	return errors.As(err, &de)
+}
+
+// jsonCodec writes each message as a JSON document in a length-prefixed
+// frame (see socket.FrameReader), so a message may contain any bytes and
+// its end is known without scanning for a delimiter
+type jsonCodec struct {
+	rwc    io.ReadWriteCloser
+	reader *socket.FrameReader
+	writer *socket.FrameWriter
+}
+
+// NewJSONCodec creates the length-prefixed JSON codec
+func NewJSONCodec(rwc io.ReadWriteCloser) Codec {
+	reader := socket.NewFrameReader(rwc)
+	reader.SetMaxFrameSize(MaxFrameSize)
+	writer := socket.NewFrameWriter(rwc)
+	writer.SetMaxFrameSize(MaxFrameSize)
+
+	return &jsonCodec{
+		rwc:    rwc,
+		reader: reader,
+		writer: writer,
+	}
+}
+
+func (c *jsonCodec) ReadRequest(req *Request) error {
+	frame, err := c.reader.ReadFrame()
+	if err != nil {
+		return err
+	}
+	decoded, err := DecodeRequest(frame)
+	if err != nil {
+		return &decodeError{err}
+	}
+	*req = *decoded
+	return nil
+}
+
+func (c *jsonCodec) WriteRequest(req *Request) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	return c.writer.WriteFrame(data)
+}
+
+func (c *jsonCodec) ReadResponse(resp *Response) error {
+	frame, err := c.reader.ReadFrame()
+	if err != nil {
+		return err
+	}
+	decoded, err := DecodeResponse(frame)
+	if err != nil {
+		return &decodeError{err}
+	}
+	*resp = *decoded
+	return nil
+}
+
+func (c *jsonCodec) WriteResponse(resp *Response) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to encode response: %w", err)
+	}
+	return c.writer.WriteFrame(data)
+}
+
+func (c *jsonCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// lineJSONCodec speaks newline-delimited JSON, one message per line. It
+// serves legacy clients that send no handshake.
+type lineJSONCodec struct {
+	rwc    io.ReadWriteCloser
+	reader *bufio.Reader
+}
+
+func newLineJSONCodec(rwc io.ReadWriteCloser) Codec {
+	return &lineJSONCodec{
+		rwc:    rwc,
+		reader: bufio.NewReader(rwc),
+	}
+}
+
+func (c *lineJSONCodec) ReadRequest(req *Request) error {
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	decoded, err := DecodeRequest(line)
+	if err != nil {
+		return &decodeError{err}
+	}
+	*req = *decoded
+	return nil
+}
+
+func (c *lineJSONCodec) WriteRequest(req *Request) error {
+	data, err := EncodeRequest(*req)
+	if err != nil {
+		return err
+	}
+	_, err = c.rwc.Write(data)
+	return err
+}
+
+func (c *lineJSONCodec) ReadResponse(resp *Response) error {
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	decoded, err := DecodeResponse(line)
+	if err != nil {
+		return &decodeError{err}
+	}
+	*resp = *decoded
+	return nil
+}
+
+func (c *lineJSONCodec) WriteResponse(resp *Response) error {
+	data, err := EncodeResponse(*resp)
+	if err != nil {
+		return err
+	}
+	_, err = c.rwc.Write(data)
+	return err
+}
+
+func (c *lineJSONCodec) Close() error {
+	return c.rwc.Close()
 }
 
-// EncodeRequest encodes a request to JSON
+// EncodeRequest encodes a request to newline-terminated JSON
 func EncodeRequest(req Request) ([]byte, error) {
 	data, err := json.Marshal(req)
 	if err != nil {
@@ -39,7 +317,7 @@ func DecodeRequest(data []byte) (*Request, error) {
 	return &req, nil
 }
 
-// EncodeResponse encodes a response to JSON
+// EncodeResponse encodes a response to newline-terminated JSON
 func EncodeResponse(resp Response) ([]byte, error) {
 	data, err := json.Marshal(resp)
 	if err != nil {
@@ -0,0 +1,56 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+)
+
+// gobCodec streams messages with encoding/gob. Type information is sent
+// once per connection, so repeated calls are cheaper than JSON.
+type gobCodec struct {
+	rwc     io.ReadWriteCloser
+	decoder *gob.Decoder
+	encoder *gob.Encoder
+	writer  *bufio.Writer
+}
+
+// NewGobCodec creates the encoding/gob codec
+func NewGobCodec(rwc io.ReadWriteCloser) Codec {
+	writer := bufio.NewWriter(rwc)
+	return &gobCodec{
+		rwc:     rwc,
+		decoder: gob.NewDecoder(rwc),
+		encoder: gob.NewEncoder(writer),
+		writer:  writer,
+	}
+}
+
+func (c *gobCodec) ReadRequest(req *Request) error {
+	return c.decoder.Decode(req)
+}
+
+func (c *gobCodec) WriteRequest(req *Request) error {
+	return c.encodeAndFlush(req)
+}
+
+func (c *gobCodec) ReadResponse(resp *Response) error {
+	return c.decoder.Decode(resp)
+}
+
+func (c *gobCodec) WriteResponse(resp *Response) error {
+	return c.encodeAndFlush(resp)
+}
+
+// encodeAndFlush writes one message; a gob stream cannot resynchronize
+// after a failed encode, so the error is returned for the caller to close
+func (c *gobCodec) encodeAndFlush(v interface{}) error {
+	if err := c.encoder.Encode(v); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *gobCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,511 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/cont1nu1ty/distributed-systems-go-demos/pkg/socket"
+)
+
+// protoCodec writes each message as a 4-byte big-endian length followed by
+// a protobuf encoding of the schema in api/proto/rpc.proto. The envelope
+// is encoded field by field with protowire, so no generated code is
+// needed, and non-Go peers can use the .proto file directly.
+// It is the compact binary codec in place of MessagePack, which would need
+// a third-party package and has no schema for non-Go peers to share.
+type protoCodec struct {
+	rwc    io.ReadWriteCloser
+	reader *socket.FrameReader
+	writer *socket.FrameWriter
+	wbuf   []byte
+}
+
+// NewProtoCodec creates the length-prefixed protobuf codec
+func NewProtoCodec(rwc io.ReadWriteCloser) Codec {
+	reader := socket.NewFrameReader(rwc)
+	reader.SetMaxFrameSize(MaxFrameSize)
+	writer := socket.NewFrameWriter(rwc)
+	writer.SetMaxFrameSize(MaxFrameSize)
+
+	return &protoCodec{
+		rwc:    rwc,
+		reader: reader,
+		writer: writer,
+	}
+}
+
+func (c *protoCodec) ReadRequest(req *Request) error {
+	frame, err := c.reader.ReadFrame()
+	if err != nil {
+		return err
+	}
+	*req = Request{}
+	if err := unmarshalRequest(frame, req); err != nil {
+		return &decodeError{fmt.Errorf("failed to decode request: %w", err)}
+	}
+	return nil
+}
+
+func (c *protoCodec) WriteRequest(req *Request) error {
+	c.wbuf = appendRequest(c.wbuf[:0], req)
+	return c.writer.WriteFrame(c.wbuf)
+}
+
+func (c *protoCodec) ReadResponse(resp *Response) error {
+	frame, err := c.reader.ReadFrame()
+	if err != nil {
+		return err
+	}
+	*resp = Response{}
+	if err := unmarshalResponse(frame, resp); err != nil {
+		return &decodeError{fmt.Errorf("failed to decode response: %w", err)}
+	}
+	return nil
+}
+
+func (c *protoCodec) WriteResponse(resp *Response) error {
+	c.wbuf = appendResponse(c.wbuf[:0], resp)
+	return c.writer.WriteFrame(c.wbuf)
+}
+
+func (c *protoCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// Field numbers from api/proto/rpc.proto
+const (
+	reqFieldID        protowire.Number = 1
+	reqFieldService   protowire.Number = 2
+	reqFieldMethod    protowire.Number = 3
+	reqFieldParams    protowire.Number = 4
+	reqFieldTimeoutMS protowire.Number = 5
+	reqFieldMetadata  protowire.Number = 6
+	reqFieldKind      protowire.Number = 7
+	reqFieldWindow    protowire.Number = 8
+	reqFieldNoReply   protowire.Number = 9
+
+	respFieldID       protowire.Number = 1
+	respFieldResult   protowire.Number = 2
+	respFieldError    protowire.Number = 3
+	respFieldMetadata protowire.Number = 4
+	respFieldKind     protowire.Number = 5
+	respFieldWindow   protowire.Number = 6
+
+	errFieldCode    protowire.Number = 1
+	errFieldMessage protowire.Number = 2
+	errFieldDetails protowire.Number = 3
+
+	mapFieldKey   protowire.Number = 1
+	mapFieldValue protowire.Number = 2
+
+	mdFieldKey    protowire.Number = 1
+	mdFieldValues protowire.Number = 2
+)
+
+func appendRequest(b []byte, req *Request) []byte {
+	b = appendStringField(b, reqFieldID, req.ID)
+	b = appendStringField(b, reqFieldService, req.Service)
+	b = appendStringField(b, reqFieldMethod, req.Method)
+	for _, param := range req.Params {
+		b = protowire.AppendTag(b, reqFieldParams, protowire.BytesType)
+		b = protowire.AppendBytes(b, param)
+	}
+	b = appendIntField(b, reqFieldTimeoutMS, req.TimeoutMS)
+	b = appendMetadata(b, reqFieldMetadata, req.Metadata)
+	b = appendStringField(b, reqFieldKind, req.Kind)
+	b = appendIntField(b, reqFieldWindow, req.Window)
+	if req.NoReply {
+		b = appendIntField(b, reqFieldNoReply, 1)
+	}
+	return b
+}
+
+func unmarshalRequest(b []byte, req *Request) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case reqFieldID:
+			return consumeString(typ, b, &req.ID)
+		case reqFieldService:
+			return consumeString(typ, b, &req.Service)
+		case reqFieldMethod:
+			return consumeString(typ, b, &req.Method)
+		case reqFieldParams:
+			var param []byte
+			n, err := consumeBytes(typ, b, &param)
+			req.Params = append(req.Params, param)
+			return n, err
+		case reqFieldTimeoutMS:
+			return consumeInt(typ, b, &req.TimeoutMS)
+		case reqFieldMetadata:
+			if req.Metadata == nil {
+				req.Metadata = make(Metadata)
+			}
+			return consumeMetadataEntry(typ, b, req.Metadata)
+		case reqFieldKind:
+			return consumeString(typ, b, &req.Kind)
+		case reqFieldWindow:
+			return consumeInt(typ, b, &req.Window)
+		case reqFieldNoReply:
+			var v int
+			n, err := consumeInt(typ, b, &v)
+			req.NoReply = v != 0
+			return n, err
+		}
+		return -1, nil
+	})
+}
+
+func appendResponse(b []byte, resp *Response) []byte {
+	b = appendStringField(b, respFieldID, resp.ID)
+	if len(resp.Result) > 0 {
+		b = protowire.AppendTag(b, respFieldResult, protowire.BytesType)
+		b = protowire.AppendBytes(b, resp.Result)
+	}
+	if resp.Error != nil {
+		b = protowire.AppendTag(b, respFieldError, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendRemoteError(nil, resp.Error))
+	}
+	b = appendMetadata(b, respFieldMetadata, resp.Metadata)
+	b = appendStringField(b, respFieldKind, resp.Kind)
+	b = appendIntField(b, respFieldWindow, resp.Window)
+	return b
+}
+
+func unmarshalResponse(b []byte, resp *Response) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case respFieldID:
+			return consumeString(typ, b, &resp.ID)
+		case respFieldResult:
+			var result []byte
+			n, err := consumeBytes(typ, b, &result)
+			resp.Result = result
+			return n, err
+		case respFieldError:
+			var msg []byte
+			n, err := consumeBytes(typ, b, &msg)
+			if err != nil {
+				return n, err
+			}
+			resp.Error = &RemoteError{}
+			return n, unmarshalRemoteError(msg, resp.Error)
+		case respFieldMetadata:
+			if resp.Metadata == nil {
+				resp.Metadata = make(Metadata)
+			}
+			return consumeMetadataEntry(typ, b, resp.Metadata)
+		case respFieldKind:
+			return consumeString(typ, b, &resp.Kind)
+		case respFieldWindow:
+			return consumeInt(typ, b, &resp.Window)
+		}
+		return -1, nil
+	})
+}
+
+func appendRemoteError(b []byte, e *RemoteError) []byte {
+	b = appendStringField(b, errFieldCode, e.Code)
+	b = appendStringField(b, errFieldMessage, e.Message)
+	for k, v := range e.Details {
+		var entry []byte
+		entry = appendStringField(entry, mapFieldKey, k)
+		entry = appendStringField(entry, mapFieldValue, v)
+		b = protowire.AppendTag(b, errFieldDetails, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+func unmarshalRemoteError(b []byte, e *RemoteError) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case errFieldCode:
+			return consumeString(typ, b, &e.Code)
+		case errFieldMessage:
+			return consumeString(typ, b, &e.Message)
+		case errFieldDetails:
+			if e.Details == nil {
+				e.Details = make(map[string]string)
+			}
+			return consumeStringMapEntry(typ, b, e.Details)
+		}
+		return -1, nil
+	})
+}
+
+func appendStringField(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendIntField encodes a non-zero int64 field as a varint
+func appendIntField(b []byte, num protowire.Number, v int) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// appendMetadata encodes Metadata as repeated MetadataEntry messages
+func appendMetadata(b []byte, num protowire.Number, md Metadata) []byte {
+	for k, values := range md {
+		var entry []byte
+		entry = appendStringField(entry, mdFieldKey, k)
+		for _, v := range values {
+			// Empty values are kept so the value count survives the trip
+			entry = protowire.AppendTag(entry, mdFieldValues, protowire.BytesType)
+			entry = protowire.AppendString(entry, v)
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// consumeFields walks the fields of one message. fn returns the number of
+// bytes it consumed, or -1 to have an unknown field skipped.
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := fn(num, typ, b)
+		if err != nil {
+			return fmt.Errorf("field %d: %w", num, err)
+		}
+		if n < 0 {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeString(typ protowire.Type, b []byte, v *string) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, fmt.Errorf("wire type %d, want bytes", typ)
+	}
+	s, n := protowire.ConsumeString(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*v = s
+	return n, nil
+}
+
+// consumeBytes copies the value because frame buffers are reused
+func consumeBytes(typ protowire.Type, b []byte, v *[]byte) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, fmt.Errorf("wire type %d, want bytes", typ)
+	}
+	raw, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*v = append([]byte{}, raw...)
+	return n, nil
+}
+
+// consumeInt reads an int64 varint field
+func consumeInt(typ protowire.Type, b []byte, v *int) (int, error) {
+	if typ != protowire.VarintType {
+		return 0, fmt.Errorf("wire type %d, want varint", typ)
+	}
+	x, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*v = int(int64(x))
+	return n, nil
+}
+
+func consumeStringMapEntry(typ protowire.Type, b []byte, m map[string]string) (int, error) {
+	var entry []byte
+	n, err := consumeBytes(typ, b, &entry)
+	if err != nil {
+		return n, err
+	}
+
+	var key, value string
+	err = consumeFields(entry, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case mapFieldKey:
+			return consumeString(typ, b, &key)
+		case mapFieldValue:
+			return consumeString(typ, b, &value)
+		}
+		return -1, nil
+	})
+	m[key] = value
+	return n, err
+}
+
+func consumeMetadataEntry(typ protowire.Type, b []byte, md Metadata) (int, error) {
+	var entry []byte
+	n, err := consumeBytes(typ, b, &entry)
+	if err != nil {
+		return n, err
+	}
+
+	var key string
+	var values []string
+	err = consumeFields(entry, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case mdFieldKey:
+			return consumeString(typ, b, &key)
+		case mdFieldValues:
+			var v string
+			n, err := consumeString(typ, b, &v)
+			values = append(values, v)
+			return n, err
+		}
+		return -1, nil
+	})
+	md[key] = append(md[key], values...)
+	return n, err
+}
+
+// protoPayload encodes each value as a google.protobuf.Any, so that peers
+// in any language can decode it: a proto.Message as itself, Go booleans,
+// numbers, strings and byte slices as the matching wrapper of
+// google/protobuf/wrappers.proto, and anything else as a
+// google.protobuf.Value holding its JSON form. nil is sent as an empty
+// payload.
+type protoPayload struct{}
+
+func (protoPayload) Marshal(v interface{}) (Payload, error) {
+	if v == nil {
+		return nil, nil
+	}
+	msg, err := toProtoMessage(v)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := anypb.New(msg)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(wrapped)
+}
+
+func (protoPayload) Unmarshal(data Payload, v interface{}) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("cannot decode into %T", v)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	var wrapped anypb.Any
+	if err := proto.Unmarshal(data, &wrapped); err != nil {
+		return err
+	}
+	msg, err := wrapped.UnmarshalNew()
+	if err != nil {
+		return err
+	}
+
+	// A message decoded into its own type, possibly through a pointer to
+	// a message pointer such as a method parameter
+	if elem := target.Elem(); elem.Kind() == reflect.Pointer && elem.Type().Implements(protoMessageType) {
+		if elem.IsNil() {
+			elem.Set(reflect.New(elem.Type().Elem()))
+		}
+		v = elem.Interface()
+	}
+	if dst, ok := v.(proto.Message); ok {
+		if dst.ProtoReflect().Descriptor() != msg.ProtoReflect().Descriptor() {
+			return fmt.Errorf("cannot use %s as %T", msg.ProtoReflect().Descriptor().FullName(), v)
+		}
+		proto.Reset(dst)
+		proto.Merge(dst, msg)
+		return nil
+	}
+
+	value, isScalar := fromProtoMessage(msg)
+	if !isScalar && target.Elem().Kind() != reflect.Interface {
+		// Compound values went through JSON on the way in as well
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		return jsonPayload{}.Unmarshal(data, v)
+	}
+	return assign(target.Elem(), reflect.ValueOf(value))
+}
+
+var protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// toProtoMessage converts v into the message protoPayload sends
+func toProtoMessage(v interface{}) (proto.Message, error) {
+	if msg, ok := v.(proto.Message); ok {
+		return msg, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.Kind() == reflect.Bool:
+		return wrapperspb.Bool(rv.Bool()), nil
+	case rv.Kind() == reflect.String:
+		return wrapperspb.String(rv.String()), nil
+	case isInt(rv.Kind()):
+		return wrapperspb.Int64(rv.Int()), nil
+	case isUint(rv.Kind()):
+		return wrapperspb.UInt64(rv.Uint()), nil
+	case isFloat(rv.Kind()):
+		return wrapperspb.Double(rv.Float()), nil
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8:
+		return wrapperspb.Bytes(rv.Bytes()), nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return structpb.NewValue(generic)
+}
+
+// fromProtoMessage returns the Go value msg carries and whether it is a
+// scalar sent in a wrapper
+func fromProtoMessage(msg proto.Message) (interface{}, bool) {
+	switch m := msg.(type) {
+	case *wrapperspb.BoolValue:
+		return m.GetValue(), true
+	case *wrapperspb.StringValue:
+		return m.GetValue(), true
+	case *wrapperspb.Int64Value:
+		return m.GetValue(), true
+	case *wrapperspb.UInt64Value:
+		return m.GetValue(), true
+	case *wrapperspb.DoubleValue:
+		return m.GetValue(), true
+	case *wrapperspb.BytesValue:
+		return m.GetValue(), true
+	case *structpb.Value:
+		return m.AsInterface(), false
+	}
+	// Any other message is handed to the caller as is
+	return msg, false
+}
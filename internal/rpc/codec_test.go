@@ -0,0 +1,321 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type point struct {
+	X, Y int
+	Tag  string
+}
+
+type codecService struct{}
+
+func (codecService) Add(a, b int) int { return a + b }
+
+func (codecService) Echo(s string) string { return s }
+
+func (codecService) Scale(p point, k float64) point {
+	return point{X: int(float64(p.X) * k), Y: int(float64(p.Y) * k), Tag: p.Tag}
+}
+
+func (codecService) Bytes(b []byte) []byte { return append(b, '!') }
+
+func (codecService) Wrap(v *wrapperspb.StringValue) *wrapperspb.StringValue {
+	return wrapperspb.String(strings.ToUpper(v.GetValue()))
+}
+
+func (codecService) Count(n int, stream *ServerStream) error {
+	for i := 0; i < n; i++ {
+		if err := stream.Send(point{X: i}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startServer serves the codec test service on a loopback listener
+func startServer(t testing.TB) string {
+	t.Helper()
+
+	server := NewServer()
+	if err := server.Register("Codec", codecService{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	return serve(t, server)
+}
+
+// serve runs server on a loopback listener until the test ends and
+// returns its address
+func serve(t testing.TB, server *Server) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.ServeListener(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+func dialCodec(t testing.TB, addr string, codecType CodecType) *Client {
+	t.Helper()
+
+	client, err := NewClient(addr, WithCodec(codecType))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+var allCodecs = []CodecType{CodecJSON, CodecGob, CodecProto}
+
+func TestCodecsRoundTripTypedValues(t *testing.T) {
+	addr := startServer(t)
+
+	for _, codecType := range allCodecs {
+		t.Run(codecType.String(), func(t *testing.T) {
+			client := dialCodec(t, addr, codecType)
+			ctx := context.Background()
+
+			var sum int
+			if err := client.Invoke(ctx, "Codec", "Add", &sum, 2, 3); err != nil || sum != 5 {
+				t.Fatalf("Add = %d, %v; want 5", sum, err)
+			}
+
+			var echoed string
+			if err := client.Invoke(ctx, "Codec", "Echo", &echoed, "héllo"); err != nil || echoed != "héllo" {
+				t.Fatalf("Echo = %q, %v", echoed, err)
+			}
+
+			var scaled point
+			err := client.Invoke(ctx, "Codec", "Scale", &scaled, point{X: 2, Y: 3, Tag: "p"}, 1.5)
+			if err != nil || scaled != (point{X: 3, Y: 4, Tag: "p"}) {
+				t.Fatalf("Scale = %+v, %v", scaled, err)
+			}
+
+			var b []byte
+			if err := client.Invoke(ctx, "Codec", "Bytes", &b, []byte("hi")); err != nil || string(b) != "hi!" {
+				t.Fatalf("Bytes = %q, %v", b, err)
+			}
+		})
+	}
+}
+
+func TestCodecsDecodeGenericResults(t *testing.T) {
+	addr := startServer(t)
+
+	want := map[CodecType]interface{}{
+		CodecJSON:  float64(5),
+		CodecGob:   5,
+		CodecProto: int64(5),
+	}
+	for _, codecType := range allCodecs {
+		t.Run(codecType.String(), func(t *testing.T) {
+			client := dialCodec(t, addr, codecType)
+
+			result, err := client.Call("Codec", "Add", 2, 3)
+			if err != nil {
+				t.Fatalf("Call: %v", err)
+			}
+			if result != want[codecType] {
+				t.Fatalf("Call = %#v, want %#v", result, want[codecType])
+			}
+		})
+	}
+}
+
+func TestCodecsStreamMessages(t *testing.T) {
+	addr := startServer(t)
+
+	for _, codecType := range allCodecs {
+		t.Run(codecType.String(), func(t *testing.T) {
+			client := dialCodec(t, addr, codecType)
+
+			stream, err := client.Stream(context.Background(), "Codec", "Count", 3)
+			if err != nil {
+				t.Fatalf("Stream: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				var p point
+				if err := stream.Recv(&p); err != nil || p.X != i {
+					t.Fatalf("Recv %d = %+v, %v", i, p, err)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONCodecRejectsUnknownFields(t *testing.T) {
+	addr := startServer(t)
+	client := dialCodec(t, addr, CodecJSON)
+
+	extra := map[string]interface{}{"X": 1, "Y": 2, "Z": 3}
+	err := client.Invoke(context.Background(), "Codec", "Scale", nil, extra, 1.0)
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Code != CodeInvalidArgument {
+		t.Fatalf("Scale with an unknown field = %v, want %s", err, CodeInvalidArgument)
+	}
+}
+
+func TestProtoCodecCarriesMessages(t *testing.T) {
+	addr := startServer(t)
+	client := dialCodec(t, addr, CodecProto)
+
+	var reply wrapperspb.StringValue
+	if err := client.Invoke(context.Background(), "Codec", "Wrap", &reply, wrapperspb.String("abc")); err != nil {
+		t.Fatalf("Wrap: %v", err)
+	}
+	if reply.GetValue() != "ABC" {
+		t.Fatalf("Wrap = %q, want ABC", reply.GetValue())
+	}
+}
+
+func TestProtoEnvelopeRoundTrip(t *testing.T) {
+	req := &Request{
+		ID:        "id-1",
+		Kind:      KindStreamMsg,
+		Service:   "S",
+		Method:    "M",
+		Params:    []Payload{Payload("a"), nil, Payload("ccc")},
+		TimeoutMS: 1500,
+		Metadata:  Metadata{"k": {"v1", ""}},
+		Window:    -1,
+		NoReply:   true,
+	}
+	var decoded Request
+	if err := unmarshalRequest(appendRequest(nil, req), &decoded); err != nil {
+		t.Fatalf("unmarshalRequest: %v", err)
+	}
+	decoded.Params[1] = nil // empty bytes decode as an empty slice
+	if !reflect.DeepEqual(*req, decoded) {
+		t.Fatalf("request = %+v, want %+v", decoded, *req)
+	}
+
+	resp := &Response{
+		ID:     "id-1",
+		Result: Payload("r"),
+		Error:  &RemoteError{Code: CodeInternal, Message: "boom", Details: map[string]string{"a": "b"}},
+	}
+	var decodedResp Response
+	if err := unmarshalResponse(appendResponse(nil, resp), &decodedResp); err != nil {
+		t.Fatalf("unmarshalResponse: %v", err)
+	}
+	if !reflect.DeepEqual(*resp, decodedResp) {
+		t.Fatalf("response = %+v, want %+v", decodedResp, *resp)
+	}
+
+	if err := unmarshalRequest([]byte{0x0a, 0x05, 'a'}, &decoded); err == nil {
+		t.Fatal("truncated request decoded without error")
+	}
+}
+
+func TestProtoPayloadIsAny(t *testing.T) {
+	data, err := protoPayload{}.Marshal(42)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var n int32
+	if err := (protoPayload{}).Unmarshal(data, &n); err != nil || n != 42 {
+		t.Fatalf("Unmarshal = %d, %v", n, err)
+	}
+
+	// The Any holds a plain Int64Value that any protobuf peer can read
+	var wrapped wrapperspb.Int64Value
+	if err := (protoPayload{}).Unmarshal(data, &wrapped); err != nil || wrapped.GetValue() != 42 {
+		t.Fatalf("Unmarshal into Int64Value = %v, %v", wrapped.GetValue(), err)
+	}
+
+	var small int8
+	big, _ := protoPayload{}.Marshal(1000)
+	if err := (protoPayload{}).Unmarshal(big, &small); err == nil {
+		t.Fatal("1000 decoded into int8 without error")
+	}
+}
+
+// BenchmarkCodecs compares the codecs on a call carrying a struct
+func BenchmarkCodecs(b *testing.B) {
+	addr := startServer(b)
+	p := point{X: 1, Y: 2, Tag: strings.Repeat("x", 64)}
+
+	for _, codecType := range allCodecs {
+		b.Run(codecType.String(), func(b *testing.B) {
+			client := dialCodec(b, addr, codecType)
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var scaled point
+				if err := client.Invoke(ctx, "Codec", "Scale", &scaled, p, 2.0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONCodecFramesMessagesWithNewlines(t *testing.T) {
+	addr := startServer(t)
+	client := dialCodec(t, addr, CodecJSON)
+
+	var echoed string
+	if err := client.Invoke(context.Background(), "Codec", "Echo", &echoed, "two\nlines\n"); err != nil {
+		t.Fatalf("Echo: %v", err)
+	}
+	if echoed != "two\nlines\n" {
+		t.Fatalf("Echo = %q", echoed)
+	}
+}
+
+func TestLegacyJSONWithoutHandshake(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Two requests in one write, as an old newline-delimited client may send
+	first, _ := EncodeRequest(Request{ID: "1", Service: "Codec", Method: "Add", Params: []Payload{Payload("1"), Payload("2")}})
+	second, _ := EncodeRequest(Request{ID: "2", Service: "Codec", Method: "Add", Params: []Payload{Payload("3"), Payload("4")}})
+	if _, err := conn.Write(append(first, second...)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	results := map[string]string{}
+	for len(results) < 2 {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("ReadBytes: %v", err)
+		}
+		resp, err := DecodeResponse(line)
+		if err != nil {
+			t.Fatalf("DecodeResponse: %v", err)
+		}
+		results[resp.ID] = string(resp.Result)
+	}
+	if results["1"] != "3" || results["2"] != "7" {
+		t.Fatalf("results = %v, want 1:3 and 2:7", results)
+	}
+}
@@ -0,0 +1,96 @@
+package rpc
+
+import (
+	"context"
+	"sort"
+)
+
+// DescribeService is the built-in service every Server answers. Its
+// Describe method reports the methods of a registered service together
+// with their idempotency, which is how clients learn what they may retry.
+const DescribeService = "_rpc"
+
+// ServiceDescription is the result of DescribeService.Describe
+type ServiceDescription struct {
+	Name    string              `json:"name"`
+	Methods []MethodDescription `json:"methods"`
+}
+
+// MethodDescription describes one remotely callable method
+type MethodDescription struct {
+	Name       string `json:"name"`
+	Idempotent bool   `json:"idempotent"`
+	Streaming  bool   `json:"streaming,omitempty"`
+}
+
+// Idempotent reports whether method is declared idempotent
+func (d *ServiceDescription) Idempotent(method string) bool {
+	for _, m := range d.Methods {
+		if m.Name == method {
+			return m.Idempotent
+		}
+	}
+	return false
+}
+
+// describer implements DescribeService for one Server
+type describer struct {
+	server *Server
+}
+
+// newDescribeService builds the built-in service directly, bypassing
+// Register so it needs no log line and cannot collide with user services
+func newDescribeService(s *Server) *service {
+	svc, _, err := newService(DescribeService, &describer{server: s})
+	if err != nil {
+		panic("rpc: " + err.Error())
+	}
+	svc.methods["Describe"].idempotent = true
+	return svc
+}
+
+// Describe reports the methods of the named service
+func (d *describer) Describe(name string) (*ServiceDescription, error) {
+	d.server.mu.RLock()
+	svc, ok := d.server.services[name]
+	d.server.mu.RUnlock()
+
+	if !ok {
+		return nil, Errorf(CodeNotFound, "service not found: %s", name)
+	}
+
+	desc := &ServiceDescription{Name: name}
+	for methodName, mtype := range svc.methods {
+		desc.Methods = append(desc.Methods, MethodDescription{
+			Name:       methodName,
+			Idempotent: mtype.idempotent,
+			Streaming:  mtype.stream,
+		})
+	}
+	sort.Slice(desc.Methods, func(i, j int) bool { return desc.Methods[i].Name < desc.Methods[j].Name })
+	return desc, nil
+}
+
+// Describe asks the server which methods service has and which of them are
+// idempotent
+func (c *Client) Describe(ctx context.Context, service string) (*ServiceDescription, error) {
+	params, err := encodeParams(c.payload, []interface{}{service})
+	if err != nil {
+		return nil, err
+	}
+
+	// Interceptors and credentials still apply, but not retries, which
+	// are what needs the description in the first place
+	req := &Request{
+		Service:  DescribeService,
+		Method:   "Describe",
+		Params:   params,
+		Metadata: requestMetadata(ctx),
+	}
+
+	var desc ServiceDescription
+	if err := c.describeHandler(ctx, req, &desc); err != nil {
+		return nil, err
+	}
+	return &desc, nil
+}
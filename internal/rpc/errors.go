@@ -0,0 +1,65 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Error codes carried in RemoteError.Code
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeNotFound         = "not_found"
+	CodeInvalidArgument  = "invalid_argument"
+	CodeDeadlineExceeded = "deadline_exceeded"
+	CodeCanceled         = "canceled"
+	CodeInternal         = "internal"
+	CodeApplication      = "application"
+	// CodeUnavailable means the server refused the call without running
+	// it, e.g. because it is shutting down; it is safe to send again
+	CodeUnavailable = "unavailable"
+	// CodeUnauthenticated means the request carried no valid credentials
+	CodeUnauthenticated = "unauthenticated"
+	// CodePermissionDenied means the caller is known but may not call
+	// the method
+	CodePermissionDenied = "permission_denied"
+)
+
+// RemoteError is an error reported by the server in a Response.
+// Service methods may return a *RemoteError to choose the code and
+// details themselves; any other error is sent with CodeApplication.
+type RemoteError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Error implements the error interface
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error [%s]: %s", e.Code, e.Message)
+}
+
+// Errorf creates a RemoteError with a formatted message
+func Errorf(code, format string, args ...interface{}) *RemoteError {
+	return &RemoteError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// toRemoteError maps an error from invoke onto its wire representation
+func toRemoteError(err error) *RemoteError {
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &RemoteError{Code: CodeDeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &RemoteError{Code: CodeCanceled, Message: err.Error()}
+	default:
+		return &RemoteError{Code: CodeApplication, Message: err.Error()}
+	}
+}
@@ -0,0 +1,53 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// accountErrors returns a plain error and a RemoteError with its own code
+type accountErrors struct{}
+
+func (accountErrors) Withdraw(amount int) (int, error) {
+	return 0, errors.New("insufficient funds")
+}
+
+func (accountErrors) Lookup(id string) (string, error) {
+	return "", &RemoteError{
+		Code:    CodeNotFound,
+		Message: "no account " + id,
+		Details: map[string]string{"id": id},
+	}
+}
+
+func TestMethodErrorsArriveAsRemoteError(t *testing.T) {
+	server := NewServer()
+	if err := server.Register("Account", accountErrors{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	addr := serve(t, server)
+
+	for _, codecType := range allCodecs {
+		t.Run(codecType.String(), func(t *testing.T) {
+			client := dialCodec(t, addr, codecType)
+			ctx := context.Background()
+			var remoteErr *RemoteError
+
+			_, err := client.CallContext(ctx, "Account", "Withdraw", 10)
+			if !errors.As(err, &remoteErr) || remoteErr.Code != CodeApplication || remoteErr.Message != "insufficient funds" {
+				t.Fatalf("Withdraw = %v; want RemoteError %s with the method's message", err, CodeApplication)
+			}
+
+			_, err = client.CallContext(ctx, "Account", "Lookup", "42")
+			if !errors.As(err, &remoteErr) || remoteErr.Code != CodeNotFound || remoteErr.Details["id"] != "42" {
+				t.Fatalf("Lookup = %v; want RemoteError %s with its details", err, CodeNotFound)
+			}
+
+			_, err = client.CallContext(ctx, "Account", "Missing")
+			if !errors.As(err, &remoteErr) || remoteErr.Code != CodeNotFound {
+				t.Fatalf("Missing = %v; want RemoteError %s", err, CodeNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package rpc
+
+import "context"
+
+// Handler serves one request on the server and returns its result
+type Handler func(ctx context.Context, req *Request) (interface{}, error)
+
+// ServerInterceptor wraps request handling on the server, in the spirit of
+// grpc.UnaryServerInterceptor. It may inspect or change ctx and req, call
+// next to continue, or return early without calling it. An error it
+// returns is sent to the client like one from the method itself.
+type ServerInterceptor func(ctx context.Context, req *Request, next Handler) (interface{}, error)
+
+// WithServerInterceptors adds interceptors to the server. The first one is
+// the outermost: it sees the request first and the result last.
+func WithServerInterceptors(interceptors ...ServerInterceptor) ServerOption {
+	return func(s *Server) {
+		s.interceptors = append(s.interceptors, interceptors...)
+	}
+}
+
+// chainServer wraps final in interceptors, outermost first
+func chainServer(interceptors []ServerInterceptor, final Handler) Handler {
+	handler := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req *Request) (interface{}, error) {
+			return interceptor(ctx, req, next)
+		}
+	}
+	return handler
+}
+
+// CallHandler performs one call on the client and decodes its result into
+// reply
+type CallHandler func(ctx context.Context, req *Request, reply interface{}) error
+
+// ClientInterceptor wraps every call made by a Client, in the spirit of
+// grpc.UnaryClientInterceptor. req has Service, Method and the encoded
+// Params set; ID and TimeoutMS are filled in for each attempt when the
+// request is written, so retries and circuit breaking happen inside next.
+type ClientInterceptor func(ctx context.Context, req *Request, reply interface{}, next CallHandler) error
+
+// WithClientInterceptors adds interceptors to the client. The first one is
+// the outermost.
+func WithClientInterceptors(interceptors ...ClientInterceptor) ClientOption {
+	return func(o *clientOptions) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
+
+// chainClient wraps final in interceptors, outermost first
+func chainClient(interceptors []ClientInterceptor, final CallHandler) CallHandler {
+	handler := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, req *Request, reply interface{}) error {
+			return interceptor(ctx, req, reply, next)
+		}
+	}
+	return handler
+}
@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// trace records the order in which interceptors run
+type trace struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (tr *trace) add(step string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.steps = append(tr.steps, step)
+}
+
+func (tr *trace) String() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return fmt.Sprint(tr.steps)
+}
+
+func serverTracer(tr *trace, name string) ServerInterceptor {
+	return func(ctx context.Context, req *Request, next Handler) (interface{}, error) {
+		tr.add(name + " before")
+		result, err := next(ctx, req)
+		tr.add(name + " after")
+		return result, err
+	}
+}
+
+func clientTracer(tr *trace, name string) ClientInterceptor {
+	return func(ctx context.Context, req *Request, reply interface{}, next CallHandler) error {
+		tr.add(name + " before")
+		err := next(ctx, req, reply)
+		tr.add(name + " after")
+		return err
+	}
+}
+
+func TestInterceptorsRunOutermostFirst(t *testing.T) {
+	tr := &trace{}
+	server := NewServer(WithServerInterceptors(serverTracer(tr, "server 1"), serverTracer(tr, "server 2")))
+	if err := server.Register("Name", nameService{"a"}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	client := dialWith(t, serve(t, server),
+		WithClientInterceptors(clientTracer(tr, "client 1"), clientTracer(tr, "client 2")))
+
+	var name string
+	if err := client.Invoke(context.Background(), "Name", "Name", &name); err != nil || name != "a" {
+		t.Fatalf("Name = %q, %v", name, err)
+	}
+
+	want := "[client 1 before client 2 before server 1 before server 2 before " +
+		"server 2 after server 1 after client 2 after client 1 after]"
+	if got := tr.String(); got != want {
+		t.Fatalf("interceptors ran as %s; want %s", got, want)
+	}
+}
+
+func TestInterceptorsShortCircuit(t *testing.T) {
+	var reached atomic.Bool
+	deny := func(ctx context.Context, req *Request, next Handler) (interface{}, error) {
+		if req.Method == "Fail" {
+			return nil, Errorf(CodePermissionDenied, "%s.%s is not allowed", req.Service, req.Method)
+		}
+		return next(ctx, req)
+	}
+	server := NewServer(WithServerInterceptors(deny, func(ctx context.Context, req *Request, next Handler) (interface{}, error) {
+		reached.Store(true)
+		return next(ctx, req)
+	}))
+	if err := server.Register("Name", nameService{"a"}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	errLocal := errors.New("answered locally")
+	client := dialWith(t, serve(t, server), WithClientInterceptors(
+		func(ctx context.Context, req *Request, reply interface{}, next CallHandler) error {
+			if req.Method == "Stall" {
+				return errLocal
+			}
+			return next(ctx, req, reply)
+		}))
+	ctx := context.Background()
+
+	var remoteErr *RemoteError
+	if err := client.Invoke(ctx, "Name", "Fail", nil); !errors.As(err, &remoteErr) || remoteErr.Code != CodePermissionDenied {
+		t.Fatalf("Fail = %v; want RemoteError %s from the server interceptor", err, CodePermissionDenied)
+	}
+	if reached.Load() {
+		t.Fatal("inner server interceptor ran after the outer one returned early")
+	}
+
+	if err := client.Invoke(ctx, "Name", "Stall", nil, 1000); !errors.Is(err, errLocal) {
+		t.Fatalf("Stall = %v; want the client interceptor's error", err)
+	}
+}
@@ -0,0 +1,181 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Metadata carries headers such as auth tokens, trace IDs or tenant IDs
+// alongside a request or response, like gRPC metadata. Keys are
+// case-insensitive: the methods below lower-case them.
+type Metadata map[string][]string
+
+// NewMetadata builds Metadata from alternating keys and values
+func NewMetadata(kv ...string) Metadata {
+	md := Metadata{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		md.Append(kv[i], kv[i+1])
+	}
+	return md
+}
+
+// Get returns the first value for key, or "" if there is none
+func (md Metadata) Get(key string) string {
+	if values := md[strings.ToLower(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns every value for key
+func (md Metadata) Values(key string) []string {
+	return md[strings.ToLower(key)]
+}
+
+// Set replaces the values for key
+func (md Metadata) Set(key string, values ...string) {
+	md[strings.ToLower(key)] = values
+}
+
+// Append adds values to key
+func (md Metadata) Append(key string, values ...string) {
+	key = strings.ToLower(key)
+	md[key] = append(md[key], values...)
+}
+
+// Copy returns a deep copy of md
+func (md Metadata) Copy() Metadata {
+	out := make(Metadata, len(md))
+	for k, v := range md {
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// Context keys for per-call metadata
+type (
+	outgoingMetadataKey struct{}
+	responseCaptureKey  struct{}
+	incomingMetadataKey struct{}
+	responseMetadataKey struct{}
+)
+
+// WithMetadata returns a context whose calls send md to the server, in
+// addition to metadata attached by outer WithMetadata calls
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	merged := outgoingMetadata(ctx)
+	for k, v := range md {
+		merged.Append(k, v...)
+	}
+	return context.WithValue(ctx, outgoingMetadataKey{}, merged)
+}
+
+// outgoingMetadata returns a copy of the metadata attached with WithMetadata
+func outgoingMetadata(ctx context.Context) Metadata {
+	if md, ok := ctx.Value(outgoingMetadataKey{}).(Metadata); ok {
+		return md.Copy()
+	}
+	return Metadata{}
+}
+
+// requestMetadata returns the metadata ctx attaches to a request. It is
+// nil if there is none, so requests without metadata stay small on the
+// wire.
+func requestMetadata(ctx context.Context) Metadata {
+	md := outgoingMetadata(ctx)
+	if len(md) == 0 {
+		return nil
+	}
+	return md
+}
+
+// addCredentials appends the client's per-RPC credentials to a copy of
+// req's metadata. It runs for every request sent, once its ID and params
+// are final, so each retry attempt carries credentials of its own.
+func (c *Client) addCredentials(ctx context.Context, req *Request) error {
+	if len(c.opts.credentials) == 0 {
+		return nil
+	}
+
+	md := req.Metadata.Copy()
+	for _, creds := range c.opts.credentials {
+		credMD, err := creds.RequestMetadata(ctx, req)
+		if err != nil {
+			return fmt.Errorf("failed to get request credentials: %w", err)
+		}
+		for k, v := range credMD {
+			md.Append(k, v...)
+		}
+	}
+	req.Metadata = md
+	return nil
+}
+
+// WithResponseMetadata returns a context whose calls store the metadata
+// sent back by the server in *md. It is filled in for failed calls too,
+// as long as the server answered.
+func WithResponseMetadata(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, responseCaptureKey{}, md)
+}
+
+// captureResponseMetadata hands resp's metadata to WithResponseMetadata
+func captureResponseMetadata(ctx context.Context, resp *Response) {
+	if dst, ok := ctx.Value(responseCaptureKey{}).(*Metadata); ok && dst != nil {
+		*dst = resp.Metadata
+	}
+}
+
+// MetadataFromContext returns the metadata the client sent with the
+// request being served. It is nil outside a server call. Forward it to
+// downstream calls with WithMetadata to propagate it end to end.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingMetadataKey{}).(Metadata)
+	return md
+}
+
+// ErrNotServerContext is returned by SetResponseMetadata when ctx does not
+// belong to a request being served
+var ErrNotServerContext = errors.New("context does not belong to a server call")
+
+// responseMetadata collects what the handler wants to send back
+type responseMetadata struct {
+	mu sync.Mutex
+	md Metadata
+}
+
+// SetResponseMetadata adds values for key to the metadata returned with
+// the response to the request being served
+func SetResponseMetadata(ctx context.Context, key string, values ...string) error {
+	rm, ok := ctx.Value(responseMetadataKey{}).(*responseMetadata)
+	if !ok {
+		return ErrNotServerContext
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if rm.md == nil {
+		rm.md = Metadata{}
+	}
+	rm.md.Append(key, values...)
+	return nil
+}
+
+// serverMetadataContext exposes req's metadata to the handler and returns
+// the collector for the response metadata
+func serverMetadataContext(ctx context.Context, req *Request) (context.Context, *responseMetadata) {
+	rm := &responseMetadata{}
+	ctx = context.WithValue(ctx, incomingMetadataKey{}, req.Metadata)
+	ctx = context.WithValue(ctx, responseMetadataKey{}, rm)
+	return ctx, rm
+}
+
+// metadata returns the collected response metadata
+func (rm *responseMetadata) metadata() Metadata {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.md
+}
@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// headerService echoes request metadata and answers with metadata of its own
+type headerService struct{}
+
+func (headerService) Tenants(ctx context.Context) (string, error) {
+	md := MetadataFromContext(ctx)
+	if err := SetResponseMetadata(ctx, "X-Served-By", "server-1"); err != nil {
+		return "", err
+	}
+	if md.Get("trace-id") == "" {
+		return "", Errorf(CodeInvalidArgument, "missing trace-id")
+	}
+	return strings.Join(md.Values("tenant"), ","), nil
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	server := NewServer()
+	if err := server.Register("Header", headerService{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	addr := serve(t, server)
+
+	for _, codecType := range allCodecs {
+		t.Run(codecType.String(), func(t *testing.T) {
+			client := dialCodec(t, addr, codecType)
+
+			// Outer and inner WithMetadata calls are merged
+			ctx := WithMetadata(context.Background(), NewMetadata("Trace-ID", "t-1", "tenant", "a"))
+			ctx = WithMetadata(ctx, NewMetadata("TENANT", "b"))
+			var header Metadata
+			ctx = WithResponseMetadata(ctx, &header)
+
+			var tenants string
+			if err := client.Invoke(ctx, "Header", "Tenants", &tenants); err != nil {
+				t.Fatalf("Tenants: %v", err)
+			}
+			if tenants != "a,b" {
+				t.Fatalf("server saw tenants %q; want a,b", tenants)
+			}
+			if got := header.Get("x-served-by"); got != "server-1" {
+				t.Fatalf("response metadata x-served-by = %q; want server-1", got)
+			}
+
+			// Response metadata is delivered with a failed call too
+			header = nil
+			ctx = WithResponseMetadata(context.Background(), &header)
+			var remoteErr *RemoteError
+			if err := client.Invoke(ctx, "Header", "Tenants", &tenants); !errors.As(err, &remoteErr) || remoteErr.Code != CodeInvalidArgument {
+				t.Fatalf("Tenants without trace-id = %v; want RemoteError %s", err, CodeInvalidArgument)
+			}
+			if got := header.Get("x-served-by"); got != "server-1" {
+				t.Fatalf("response metadata of failed call x-served-by = %q; want server-1", got)
+			}
+		})
+	}
+}
+
+func TestSetResponseMetadataOutsideServerCall(t *testing.T) {
+	if err := SetResponseMetadata(context.Background(), "k", "v"); !errors.Is(err, ErrNotServerContext) {
+		t.Fatalf("SetResponseMetadata = %v; want ErrNotServerContext", err)
+	}
+	if md := MetadataFromContext(context.Background()); md != nil {
+		t.Fatalf("MetadataFromContext outside a server call = %v; want nil", md)
+	}
+}
@@ -0,0 +1,204 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Payload is one encoded parameter, result or stream message. It is
+// encoded by the PayloadCodec of the connection's codec, so a gob
+// connection carries gob payloads and a proto connection protobuf ones.
+// In the JSON codec it is embedded as a raw JSON value.
+type Payload []byte
+
+// MarshalJSON embeds p as is, like json.RawMessage
+func (p Payload) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+	return p, nil
+}
+
+// UnmarshalJSON keeps a copy of the raw JSON value
+func (p *Payload) UnmarshalJSON(data []byte) error {
+	*p = append((*p)[0:0], data...)
+	return nil
+}
+
+// PayloadCodec encodes the values carried in Request.Params and
+// Response.Result. Unmarshal decodes into v, a pointer; a pointer to an
+// empty interface receives the value in a generic form.
+type PayloadCodec interface {
+	Marshal(v interface{}) (Payload, error)
+	Unmarshal(data Payload, v interface{}) error
+}
+
+// jsonPayload encodes values as JSON. A strict one, used by the server for
+// parameters, rejects unknown struct fields.
+type jsonPayload struct {
+	strict bool
+}
+
+func (jsonPayload) Marshal(v interface{}) (Payload, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal relies on encoding/json rejecting out-of-range numbers and
+// fractional values for integer kinds; the error is reworded so it names
+// the offending value
+func (p jsonPayload) Unmarshal(data Payload, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if p.strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			if typeErr.Field != "" {
+				return fmt.Errorf("field %q: cannot use %s as %s", typeErr.Field, typeErr.Value, typeErr.Type)
+			}
+			return fmt.Errorf("cannot use %s as %s", typeErr.Value, typeErr.Type)
+		}
+		return err
+	}
+	return nil
+}
+
+// gobPayload encodes each value as a gob interface value, which names its
+// type, so it can also be decoded generically. Types are registered with
+// gob.Register on first use; struct types must therefore have the same
+// package-qualified name on both ends. Pointers are sent as the values
+// they point to; nil is sent as an empty payload.
+type gobPayload struct{}
+
+func (gobPayload) Marshal(v interface{}) (Payload, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() || rv.Kind() == reflect.Pointer {
+		return nil, nil
+	}
+
+	value := rv.Interface()
+	if err := registerGob(rv.Type()); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobPayload) Unmarshal(data Payload, v interface{}) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("cannot decode into %T", v)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	// The sender's type must be registered here too
+	base := target.Type().Elem()
+	for base.Kind() == reflect.Pointer {
+		base = base.Elem()
+	}
+	if base.Kind() != reflect.Interface {
+		if err := registerGob(base); err != nil {
+			return err
+		}
+	}
+
+	var value interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value); err != nil {
+		return err
+	}
+	return assign(target.Elem(), reflect.ValueOf(value))
+}
+
+// registerGob registers t for gob interface values; gob panics if another
+// type already uses t's name
+func registerGob(t reflect.Type) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot send %s with gob: %v", t, r)
+		}
+	}()
+	gob.Register(reflect.Zero(t).Interface())
+	return nil
+}
+
+// assign stores value in dst, allocating pointers on the way and
+// converting between integer types as long as the value fits, and
+// between float types
+func assign(dst reflect.Value, value reflect.Value) error {
+	if !value.IsValid() {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	if dst.Kind() == reflect.Pointer && value.Type() != dst.Type() {
+		ptr := reflect.New(dst.Type().Elem())
+		if err := assign(ptr.Elem(), value); err != nil {
+			return err
+		}
+		dst.Set(ptr)
+		return nil
+	}
+	if value.Type().AssignableTo(dst.Type()) {
+		dst.Set(value)
+		return nil
+	}
+
+	switch {
+	case isInt(dst.Kind()) && isInt(value.Kind()):
+		if dst.OverflowInt(value.Int()) {
+			return fmt.Errorf("cannot use %d as %s", value.Int(), dst.Type())
+		}
+		dst.SetInt(value.Int())
+		return nil
+	case isUint(dst.Kind()) && isUint(value.Kind()):
+		if dst.OverflowUint(value.Uint()) {
+			return fmt.Errorf("cannot use %d as %s", value.Uint(), dst.Type())
+		}
+		dst.SetUint(value.Uint())
+		return nil
+	case isUint(dst.Kind()) && isInt(value.Kind()):
+		if value.Int() < 0 || dst.OverflowUint(uint64(value.Int())) {
+			return fmt.Errorf("cannot use %d as %s", value.Int(), dst.Type())
+		}
+		dst.SetUint(uint64(value.Int()))
+		return nil
+	case isInt(dst.Kind()) && isUint(value.Kind()):
+		if value.Uint() > math.MaxInt64 || dst.OverflowInt(int64(value.Uint())) {
+			return fmt.Errorf("cannot use %d as %s", value.Uint(), dst.Type())
+		}
+		dst.SetInt(int64(value.Uint()))
+		return nil
+	case isFloat(dst.Kind()) && isFloat(value.Kind()):
+		dst.SetFloat(value.Float())
+		return nil
+	case value.Type().ConvertibleTo(dst.Type()) && value.Kind() == dst.Kind():
+		dst.Set(value.Convert(dst.Type()))
+		return nil
+	}
+	return fmt.Errorf("cannot use %s as %s", value.Type(), dst.Type())
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type numberService struct{}
+
+func (numberService) Int8(v int8) int8       { return v }
+func (numberService) Int(v int) int          { return v }
+func (numberService) Uint(v uint) uint       { return v }
+func (numberService) Uint16(v uint16) uint16 { return v }
+
+func TestParameterConversionRangeChecks(t *testing.T) {
+	server := NewServer()
+	if err := server.Register("Number", numberService{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	addr := serve(t, server)
+
+	tests := []struct {
+		name   string
+		method string
+		param  interface{}
+		ok     bool
+	}{
+		{"int8 max", "Int8", 127, true},
+		{"int8 overflow", "Int8", 128, false},
+		{"int8 underflow", "Int8", -129, false},
+		{"uint16 max", "Uint16", 65535, true},
+		{"uint16 overflow", "Uint16", 65536, false},
+		{"uint64 to int8", "Int8", uint64(100), true},
+		{"uint64 overflowing int", "Int", uint64(1 << 63), false},
+		{"negative uint", "Uint", -1, false},
+		{"negative uint16", "Uint16", -5, false},
+		{"whole float to int", "Int", 3, true},
+		{"fractional float to int", "Int", 1.5, false},
+		{"fractional float to uint", "Uint", 2.25, false},
+	}
+	for _, codecType := range []CodecType{CodecJSON, CodecGob} {
+		client := dialCodec(t, addr, codecType)
+		for _, tt := range tests {
+			t.Run(codecType.String()+"/"+tt.name, func(t *testing.T) {
+				var reply interface{}
+				err := client.Invoke(context.Background(), "Number", tt.method, &reply, tt.param)
+				if tt.ok {
+					if err != nil {
+						t.Fatalf("%s(%v) = %v", tt.method, tt.param, err)
+					}
+					return
+				}
+
+				var remoteErr *RemoteError
+				if !errors.As(err, &remoteErr) || remoteErr.Code != CodeInvalidArgument {
+					t.Fatalf("%s(%v) = %v, %v; want invalid_argument", tt.method, tt.param, reply, err)
+				}
+				if !strings.Contains(remoteErr.Message, "parameter 0") {
+					t.Fatalf("error %q does not name the parameter", remoteErr.Message)
+				}
+			})
+		}
+	}
+}
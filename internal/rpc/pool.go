@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+)
+
+// Pool holds several connections to the same address and sends each call
+// over the one with the fewest calls in flight. Combine it with
+// WithReconnect so a server restart heals every member.
+type Pool struct {
+	clients []*Client
+}
+
+// NewPool dials size connections to addr, each configured by opts
+func NewPool(addr string, size int, opts ...ClientOption) (*Pool, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("pool size must be positive, got %d", size)
+	}
+
+	pool := &Pool{}
+	for i := 0; i < size; i++ {
+		client, err := NewClient(addr, opts...)
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("pool connection %d: %w", i, err)
+		}
+		pool.clients = append(pool.clients, client)
+	}
+	return pool, nil
+}
+
+// pick returns the connected member with the least pending calls. Members
+// waiting for a reconnect are skipped, since a call would wait there for
+// the backoff; if all are, the first one gets the call.
+func (p *Pool) pick() *Client {
+	var best *Client
+	bestPending := 0
+	for _, client := range p.clients {
+		pending, live := client.pendingCount()
+		if live && (best == nil || pending < bestPending) {
+			best, bestPending = client, pending
+		}
+	}
+	if best == nil {
+		return p.clients[0]
+	}
+	return best
+}
+
+// Invoke implements Invoker on the least loaded connection
+func (p *Pool) Invoke(ctx context.Context, service, method string, reply interface{}, params ...interface{}) error {
+	return p.pick().Invoke(ctx, service, method, reply, params...)
+}
+
+// Stream implements Streamer on the least loaded connection
+func (p *Pool) Stream(ctx context.Context, service, method string, params ...interface{}) (*ClientStream, error) {
+	return p.pick().Stream(ctx, service, method, params...)
+}
+
+// CallContext is Client.CallContext on the least loaded connection
+func (p *Pool) CallContext(ctx context.Context, service, method string, params ...interface{}) (interface{}, error) {
+	return p.pick().CallContext(ctx, service, method, params...)
+}
+
+// Call is Client.Call on the least loaded connection
+func (p *Pool) Call(service, method string, params ...interface{}) (interface{}, error) {
+	return p.pick().Call(service, method, params...)
+}
+
+// Close closes every connection in the pool
+func (p *Pool) Close() error {
+	var firstErr error
+	for _, client := range p.clients {
+		if err := client.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
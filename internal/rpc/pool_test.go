@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newPool(t *testing.T, addr string, size int, opts ...ClientOption) *Pool {
+	t.Helper()
+
+	pool, err := NewPool(addr, size, opts...)
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+// dropConn breaks the client's connection as a server restart would
+func dropConn(t *testing.T, client *Client) {
+	t.Helper()
+
+	client.mu.Lock()
+	conn := client.conn
+	client.mu.Unlock()
+	conn.close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		client.mu.Lock()
+		current := client.conn
+		client.mu.Unlock()
+		if current != conn || conn.usable() != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client did not notice its connection was lost")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolPicksLeastPending(t *testing.T) {
+	pool := newPool(t, startNamed(t, "a"), 2)
+
+	busy := pool.pick()
+	go busy.Invoke(context.Background(), "Name", "Stall", nil, 300)
+	time.Sleep(50 * time.Millisecond)
+
+	if pool.pick() == busy {
+		t.Fatal("picked the member with a call in flight over an idle one")
+	}
+}
+
+func TestPoolSkipsReconnectingMember(t *testing.T) {
+	// The backoff keeps the dropped member down for the whole test
+	pool := newPool(t, startNamed(t, "a"), 2, WithReconnect(Backoff{Initial: time.Minute}))
+	dropConn(t, pool.clients[0])
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		var name string
+		if err := pool.Invoke(ctx, "Name", "Name", &name); err != nil {
+			t.Fatalf("Invoke with one member reconnecting: %v", err)
+		}
+	}
+}
+
+func TestReconnectAfterConnectionDrop(t *testing.T) {
+	client := dialWith(t, startNamed(t, "a"), WithReconnect(Backoff{Initial: 10 * time.Millisecond}))
+
+	dropConn(t, client)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var name string
+	if err := client.Invoke(ctx, "Name", "Name", &name); err != nil || name != "a" {
+		t.Fatalf("Invoke after the connection dropped = %q, %v; want a reconnect", name, err)
+	}
+}
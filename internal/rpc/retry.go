@@ -0,0 +1,189 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// RetryClass is a set of error classes a RetryPolicy retries on
+type RetryClass uint
+
+// Retryable error classes
+const (
+	// RetryConnection covers failures to reach the server: dial errors,
+	// connections lost while the call was in flight and CodeUnavailable
+	RetryConnection RetryClass = 1 << iota
+	// RetryTimeout covers attempts that ran out of time (PerAttemptTimeout
+	// or deadline_exceeded from the server) while the caller's own context
+	// still has time left
+	RetryTimeout
+	// RetryInternal covers CodeInternal errors reported by the server
+	RetryInternal
+)
+
+// RetryPolicy configures automatic retries. Only methods the server
+// registered WithIdempotent are retried; the client learns which ones
+// through DescribeService on first use and caches the answer.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first
+	MaxAttempts int
+	// Backoff is the delay between attempts; zero means DefaultBackoff
+	Backoff Backoff
+	// PerAttemptTimeout bounds each attempt, so a hung server leaves time
+	// for another try; zero means attempts share the caller's deadline
+	PerAttemptTimeout time.Duration
+	// RetryOn selects the error classes worth retrying
+	RetryOn RetryClass
+}
+
+// DefaultRetryPolicy retries connection failures and timeouts up to three
+// attempts in total
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff: Backoff{
+		Initial:    50 * time.Millisecond,
+		Max:        time.Second,
+		Multiplier: 2,
+		Jitter:     0.2,
+	},
+	RetryOn: RetryConnection | RetryTimeout,
+}
+
+// WithRetry retries failed calls to idempotent methods according to policy.
+// Calls to methods not declared idempotent are never sent twice.
+func WithRetry(policy RetryPolicy) ClientOption {
+	return func(o *clientOptions) {
+		if policy.MaxAttempts < 1 {
+			policy.MaxAttempts = 1
+		}
+		o.retry = &policy
+	}
+}
+
+// invokeWithRetry runs invokeOnce until it succeeds, the error is not
+// retryable, the attempts are used up or ctx is done
+func (c *Client) invokeWithRetry(ctx context.Context, req *Request, reply interface{}) error {
+	policy := c.opts.retry
+
+	if !c.isIdempotent(ctx, req.Service, req.Method) {
+		return c.invokeOnce(ctx, req, reply)
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if policy.PerAttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, policy.PerAttemptTimeout)
+		}
+		err := c.invokeOnce(attemptCtx, req, reply)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+		if attempt+1 >= policy.MaxAttempts || classifyError(ctx, err)&policy.RetryOn == 0 {
+			return err
+		}
+
+		delay := policy.Backoff.Delay(attempt)
+		log.Printf("Retrying %s.%s in %v (attempt %d of %d): %v", req.Service, req.Method, delay, attempt+2, policy.MaxAttempts, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// isIdempotent reports whether the server declared service.method
+// idempotent. The service description is fetched once and cached; if it
+// cannot be fetched the method is treated as not idempotent. Only a
+// not-found answer is cached that way: other failures, such as transport
+// trouble or rejected credentials, are asked about again on the next call.
+func (c *Client) isIdempotent(ctx context.Context, service, method string) bool {
+	c.descMu.Lock()
+	desc, ok := c.descriptions[service]
+	c.descMu.Unlock()
+
+	if !ok {
+		var err error
+		desc, err = c.Describe(ctx, service)
+		if err != nil {
+			var remoteErr *RemoteError
+			if !errors.As(err, &remoteErr) || remoteErr.Code != CodeNotFound {
+				return false
+			}
+			// The server has no such service or predates DescribeService
+			desc = &ServiceDescription{Name: service}
+		}
+
+		c.descMu.Lock()
+		if c.descriptions == nil {
+			c.descriptions = make(map[string]*ServiceDescription)
+		}
+		c.descriptions[service] = desc
+		c.descMu.Unlock()
+	}
+
+	return desc.Idempotent(method)
+}
+
+// classifyError maps an attempt's error onto a RetryClass; zero means the
+// error is never retried. ctx is the caller's context, which decides
+// whether a deadline belonged to the attempt or to the whole call.
+func classifyError(ctx context.Context, err error) RetryClass {
+	if err == nil || errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrClientClosed) {
+		return 0
+	}
+
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		switch remoteErr.Code {
+		case CodeUnavailable:
+			// Refused before running, like a failed dial
+			return RetryConnection
+		case CodeInternal:
+			return RetryInternal
+		case CodeDeadlineExceeded:
+			if ctx.Err() == nil {
+				return RetryTimeout
+			}
+		}
+		return 0
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		if ctx.Err() == nil {
+			return RetryTimeout
+		}
+		return 0
+	case isConnectionError(err):
+		return RetryConnection
+	}
+	// Anything else, such as a result that failed to decode or rejected
+	// credentials, would fail the same way again, or may have run the
+	// method already
+	return 0
+}
+
+// isConnectionError reports whether err means the connection to the
+// server failed: it could not be dialed, broke or closed while the call
+// was in flight, or was going away. Errors from the caller's context do
+// not count, although context.DeadlineExceeded is a net.Error.
+func isConnectionError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, ErrConnectionLost) ||
+		errors.Is(err, errGoingAway) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.As(err, &netErr)
+}
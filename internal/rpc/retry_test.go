@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// accountService counts how often each method ran; every call takes long
+// enough for the test to drop the connection under it
+type accountService struct {
+	balanceCalls  atomic.Int32
+	transferCalls atomic.Int32
+}
+
+// Balance is registered idempotent; only its first call is slow
+func (s *accountService) Balance() int {
+	if s.balanceCalls.Add(1) == 1 {
+		time.Sleep(200 * time.Millisecond)
+	}
+	return 100
+}
+
+func (s *accountService) Transfer(amount int) int {
+	s.transferCalls.Add(1)
+	time.Sleep(200 * time.Millisecond)
+	return amount
+}
+
+func TestRetryAfterConnectionDrop(t *testing.T) {
+	svc := &accountService{}
+	server := NewServer()
+	if err := server.Register("Account", svc, WithIdempotent("Balance")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	client := dialWith(t, serve(t, server),
+		WithReconnect(Backoff{Initial: 10 * time.Millisecond}),
+		WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: Backoff{Initial: 10 * time.Millisecond}, RetryOn: RetryConnection}))
+	ctx := context.Background()
+	client.isIdempotent(ctx, "Account", "Balance")
+
+	// dropDuring runs a call and drops the connection while it is in flight
+	dropDuring := func(method string, reply interface{}, params ...interface{}) error {
+		result := make(chan error, 1)
+		go func() { result <- client.Invoke(ctx, "Account", method, reply, params...) }()
+		time.Sleep(50 * time.Millisecond)
+		dropConn(t, client)
+		return <-result
+	}
+
+	var balance int
+	if err := dropDuring("Balance", &balance); err != nil || balance != 100 {
+		t.Fatalf("Balance = %d, %v; want it retried on the new connection", balance, err)
+	}
+	if n := svc.balanceCalls.Load(); n != 2 {
+		t.Fatalf("Balance ran %d times, want 2", n)
+	}
+
+	var moved int
+	if err := dropDuring("Transfer", &moved, 10); !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("Transfer = %v, want ErrConnectionLost", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := svc.transferCalls.Load(); n != 1 {
+		t.Fatalf("Transfer ran %d times, want exactly once", n)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	live := context.Background()
+	expired, cancel := context.WithTimeout(live, 0)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want RetryClass
+	}{
+		{"connection lost", live, ErrConnectionLost, RetryConnection},
+		{"going away", live, errGoingAway, RetryConnection},
+		{"EOF", live, io.EOF, RetryConnection},
+		{"dial error", live, fmt.Errorf("failed to connect: %w", &net.OpError{Op: "dial", Err: errors.New("refused")}), RetryConnection},
+		{"closed connection", live, fmt.Errorf("failed to send request: %w", net.ErrClosed), RetryConnection},
+		{"unavailable", live, Errorf(CodeUnavailable, "shutting down"), RetryConnection},
+		{"internal", live, Errorf(CodeInternal, "boom"), RetryInternal},
+		{"attempt timeout", live, context.DeadlineExceeded, RetryTimeout},
+		{"caller timeout", expired, context.DeadlineExceeded, 0},
+		{"cancelled", live, context.Canceled, 0},
+		{"decode error", live, fmt.Errorf("failed to decode result: %w", errors.New("bad json")), 0},
+		{"encode error", live, fmt.Errorf("failed to send request: %w", errors.New("gob: type not registered")), 0},
+		{"unauthenticated", live, Errorf(CodeUnauthenticated, "no token"), 0},
+		{"credentials", live, fmt.Errorf("failed to get credentials: %w", errors.New("expired")), 0},
+		{"circuit open", live, ErrCircuitOpen, 0},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.ctx, tt.err); got != tt.want {
+			t.Errorf("%s: classifyError(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -2,28 +2,112 @@ package rpc
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"reflect"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"time"
 )
 
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// DefaultMaxConcurrentRequests is the per-connection limit used when none is configured
+const DefaultMaxConcurrentRequests = 64
+
 // Server is the RPC server (Skeleton)
 type Server struct {
-	services map[string]interface{}
+	services map[string]*service
 	mu       sync.RWMutex
+
+	maxConcurrent int
+	interceptors  []ServerInterceptor
+	handler       Handler // dispatch wrapped in interceptors
+	tlsConfig     *tls.Config
+
+	lifecycleMu sync.Mutex
+	listeners   map[net.Listener]struct{}
+	conns       map[*serverConn]struct{}
+	shutdown    bool
+}
+
+// ServerOption configures a Server
+type ServerOption func(*Server)
+
+// WithMaxConcurrentRequests limits how many requests from one connection
+// are executed at the same time. Reading pauses while the limit is reached.
+func WithMaxConcurrentRequests(n int) ServerOption {
+	return func(s *Server) {
+		if n > 0 {
+			s.maxConcurrent = n
+		}
+	}
 }
 
 // NewServer creates a new RPC server
-func NewServer() *Server {
-	return &Server{
-		services: make(map[string]interface{}),
+func NewServer(opts ...ServerOption) *Server {
+	s := &Server{
+		services:      make(map[string]*service),
+		maxConcurrent: DefaultMaxConcurrentRequests,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.services[DescribeService] = newDescribeService(s)
+	s.handler = chainServer(s.interceptors, s.dispatch)
+	return s
+}
+
+// RegisterOption configures a service at Register time
+type RegisterOption func(*registerOptions)
+
+// registerOptions collects the settings applied by RegisterOption
+type registerOptions struct {
+	idempotent []string
+}
+
+// WithIdempotent declares methods that can safely run more than once, such
+// as reads or upserts. Clients configured WithRetry only retry these;
+// every other method is sent at most once per call.
+func WithIdempotent(methods ...string) RegisterOption {
+	return func(o *registerOptions) {
+		o.idempotent = append(o.idempotent, methods...)
 	}
 }
 
-// Register registers a service instance
-func (s *Server) Register(name string, service interface{}) error {
+// Register registers a service instance.
+// Its exported methods are validated up front: methods with unsupported
+// signatures are skipped with a log line, and a receiver with no
+// suitable methods at all is rejected.
+func (s *Server) Register(name string, rcvr interface{}, opts ...RegisterOption) error {
+	var options registerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	svc, rejected, err := newService(name, rcvr)
+	for _, methodName := range sortedKeys(rejected) {
+		log.Printf("Register %s: skipping method %s: %v", name, methodName, rejected[methodName])
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, methodName := range options.idempotent {
+		mtype, ok := svc.methods[methodName]
+		if !ok {
+			return fmt.Errorf("service %s: idempotent method %s not found", name, methodName)
+		}
+		mtype.idempotent = true
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -31,109 +115,308 @@ func (s *Server) Register(name string, service interface{}) error {
 		return fmt.Errorf("service %s already registered", name)
 	}
 
-	s.services[name] = service
-	log.Printf("Registered service: %s", name)
+	s.services[name] = svc
+	log.Printf("Registered service: %s (%d methods)", name, len(svc.methods))
 	return nil
 }
 
-// HandleConnection handles a client connection
+// ServiceNames returns the names of the registered services, e.g. to
+// announce them to a service registry. The built-in DescribeService is
+// not included.
+func (s *Server) ServiceNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.services))
+	for name := range s.services {
+		if name != DescribeService {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedKeys returns the keys of m in a stable order for logging
+func sortedKeys(m map[string]error) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serverConn serializes response writes from concurrent handlers and
+// tracks the open streams
+type serverConn struct {
+	codec   Codec
+	payload PayloadCodec // encodes params and results for codec
+	writeMu sync.Mutex
+
+	netConn net.Conn
+	cancel  context.CancelFunc // cancels the connection's calls
+	done    chan struct{}      // closed when HandleConnection returns
+
+	drainMu   sync.Mutex
+	inFlight  int  // calls and streams started and not yet answered
+	goingAway bool // set once KindGoAway was sent
+
+	streamMu sync.Mutex
+	streams  map[string]*ServerStream
+}
+
+// writeResponse encodes resp and writes it as one unit
+func (sc *serverConn) writeResponse(resp Response) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	return sc.codec.WriteResponse(&resp)
+}
+
+// HandleConnection handles a client connection.
+// The codec is chosen by the client's handshake. Each request runs in its
+// own goroutine, bounded by the server's concurrency limit, and responses
+// are written as soon as they are ready, possibly out of order.
+// A *tls.Conn completes its TLS handshake first.
 func (s *Server) HandleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	reader := bufio.NewReader(conn)
+	peer, err := newPeer(conn)
+	if err != nil {
+		log.Printf("Connection from %s rejected: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	codec, payload, err := readHandshake(bufio.NewReader(conn), conn)
+	if err != nil {
+		log.Printf("Handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if _, ok := payload.(jsonPayload); ok {
+		// Parameters must match the declared types exactly
+		payload = jsonPayload{strict: true}
+	}
+
+	// connCtx is cancelled when the connection goes away so in-flight
+	// handlers learn that nobody is waiting for their result
+	connCtx := context.WithValue(context.Background(), peerKey{}, peer)
+	connCtx, cancel := context.WithCancel(context.WithValue(connCtx, payloadKey{}, payload))
+
+	sc := &serverConn{
+		codec:   codec,
+		payload: payload,
+		netConn: conn,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	if !s.trackConn(sc) {
+		cancel()
+		return
+	}
+	defer s.untrackConn(sc)
+
+	sem := make(chan struct{}, s.maxConcurrent)
+	var wg sync.WaitGroup
+
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
 	for {
 		// Read request
-		line, err := reader.ReadBytes('\n')
+		req := &Request{}
+		err := codec.ReadRequest(req)
+		if isDecodeError(err) {
+			s.sendError(sc, "", Errorf(CodeInvalidRequest, "decode error: %v", err))
+			continue
+		}
 		if err != nil {
 			return
 		}
 
-		req, err := DecodeRequest(line)
-		if err != nil {
-			s.sendError(conn, "", fmt.Sprintf("decode error: %v", err))
+		if (req.Kind == "" || req.Kind == KindStreamOpen) && !sc.startCall() {
+			s.refuse(sc, req)
 			continue
 		}
 
-		// Process request
-		result, err := s.invoke(req.Service, req.Method, req.Params)
-
-		resp := Response{
-			ID: req.ID,
+		switch req.Kind {
+		case "":
+		case KindStreamOpen:
+			s.openStream(connCtx, sc, req, &wg)
+			continue
+		case KindStreamMsg, KindStreamEnd, KindStreamCancel, KindStreamWindow:
+			sc.routeStreamFrame(req)
+			continue
+		default:
+			s.sendError(sc, req.ID, Errorf(CodeInvalidRequest, "unknown request kind %q", req.Kind))
+			continue
 		}
 
+		// Wait for a free slot before dispatching
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				sc.finishCall()
+				wg.Done()
+			}()
+			s.handleRequest(connCtx, sc, req)
+		}()
+	}
+}
+
+// handleRequest invokes a single request and writes its response
+func (s *Server) handleRequest(connCtx context.Context, sc *serverConn, req *Request) {
+	if req.NoReply {
+		// Nobody waits for a one-way call, so it outlives the connection
+		connCtx = context.WithoutCancel(connCtx)
+	}
+	ctx, cancel := requestContext(connCtx, req)
+	ctx, respMD := serverMetadataContext(ctx, req)
+	result, err := s.handler(ctx, req)
+	cancel()
+
+	if req.NoReply {
 		if err != nil {
-			resp.Error = err.Error()
-		} else {
-			resp.Result = result
+			log.Printf("One-way call %s.%s failed: %v", req.Service, req.Method, err)
 		}
+		return
+	}
+
+	resp := Response{
+		ID:       req.ID,
+		Metadata: respMD.metadata(),
+	}
 
-		// Send response
-		respData, err := EncodeResponse(resp)
+	if err == nil {
+		resp.Result, err = sc.payload.Marshal(result)
 		if err != nil {
-			log.Printf("Failed to encode response: %v", err)
-			continue
+			err = Errorf(CodeInternal, "failed to encode result: %v", err)
 		}
+	}
 
-		if _, err := conn.Write(respData); err != nil {
-			log.Printf("Failed to write response: %v", err)
-			return
-		}
+	if err != nil {
+		resp.Result = nil
+		resp.Error = toRemoteError(err)
+	}
+
+	if err := sc.writeResponse(resp); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// requestContext derives the per-call context from the deadline sent by the client
+func requestContext(parent context.Context, req *Request) (context.Context, context.CancelFunc) {
+	if req.TimeoutMS > 0 {
+		return context.WithTimeout(parent, time.Duration(req.TimeoutMS)*time.Millisecond)
+	}
+	return context.WithCancel(parent)
+}
+
+// payloadKey carries the PayloadCodec of the connection a call came on
+type payloadKey struct{}
+
+// payloadFromContext returns the connection's PayloadCodec, or strict JSON
+func payloadFromContext(ctx context.Context) PayloadCodec {
+	if payload, ok := ctx.Value(payloadKey{}).(PayloadCodec); ok {
+		return payload
+	}
+	return jsonPayload{strict: true}
+}
+
+// decodeParam unmarshals one encoded parameter into a fresh value of
+// paramType
+func decodeParam(payload PayloadCodec, raw Payload, paramType reflect.Type) (reflect.Value, error) {
+	ptr := reflect.New(paramType)
+	if err := payload.Unmarshal(raw, ptr.Interface()); err != nil {
+		return reflect.Value{}, err
 	}
+	return ptr.Elem(), nil
+}
+
+// dispatch is the innermost Handler; it runs the method named by req
+func (s *Server) dispatch(ctx context.Context, req *Request) (interface{}, error) {
+	return s.invoke(ctx, req.Service, req.Method, req.Params)
 }
 
-// invoke calls a method on a registered service using reflection
-func (s *Server) invoke(serviceName, methodName string, params []interface{}) (interface{}, error) {
+// invoke calls a method on a registered service using reflection.
+// Methods whose first parameter is a context.Context receive ctx there.
+// A panic in the method is recovered and reported as CodeInternal.
+func (s *Server) invoke(ctx context.Context, serviceName, methodName string, params []Payload) (result interface{}, err error) {
 	s.mu.RLock()
-	service, exists := s.services[serviceName]
+	svc, exists := s.services[serviceName]
 	s.mu.RUnlock()
 
 	if !exists {
-		return nil, fmt.Errorf("service not found: %s", serviceName)
+		return nil, Errorf(CodeNotFound, "service not found: %s", serviceName)
 	}
 
-	// Get service value
-	serviceValue := reflect.ValueOf(service)
+	mtype, exists := svc.methods[methodName]
+	if !exists {
+		return nil, Errorf(CodeNotFound, "method not found: %s.%s", serviceName, methodName)
+	}
+
+	stream := serverStreamFromContext(ctx)
+	if mtype.stream && stream == nil {
+		return nil, Errorf(CodeInvalidRequest, "%s.%s is a streaming method; open it with Client.Stream", serviceName, methodName)
+	}
+	if !mtype.stream && stream != nil {
+		return nil, Errorf(CodeInvalidRequest, "%s.%s is not a streaming method", serviceName, methodName)
+	}
 
-	// Get method
-	method := serviceValue.MethodByName(methodName)
-	if !method.IsValid() {
-		return nil, fmt.Errorf("method not found: %s.%s", serviceName, methodName)
+	if len(params) != len(mtype.argTypes) {
+		return nil, Errorf(CodeInvalidArgument, "wrong number of parameters: expected %d, got %d", len(mtype.argTypes), len(params))
 	}
 
-	// Convert params to reflect.Value
-	methodType := method.Type()
-	if len(params) != methodType.NumIn() {
-		return nil, fmt.Errorf("wrong number of parameters: expected %d, got %d", methodType.NumIn(), len(params))
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s.%s not started: %w", serviceName, methodName, err)
 	}
 
-	args := make([]reflect.Value, len(params))
+	// Convert params to reflect.Value; args[0] is the receiver
+	args := make([]reflect.Value, 0, 2+len(params))
+	args = append(args, svc.rcvr)
+	if mtype.hasCtx {
+		args = append(args, reflect.ValueOf(ctx))
+	}
+	payload := payloadFromContext(ctx)
 	for i, param := range params {
-		// Convert JSON numbers to proper types
-		paramType := methodType.In(i)
-
-		switch paramType.Kind() {
-		case reflect.Int:
-			// JSON unmarshals numbers as float64
-			if v, ok := param.(float64); ok {
-				args[i] = reflect.ValueOf(int(v))
-			} else {
-				return nil, fmt.Errorf("parameter %d: expected number, got %T", i, param)
-			}
-		case reflect.String:
-			if v, ok := param.(string); ok {
-				args[i] = reflect.ValueOf(v)
-			} else {
-				return nil, fmt.Errorf("parameter %d: expected string, got %T", i, param)
+		arg, err := decodeParam(payload, param, mtype.argTypes[i])
+		if err != nil {
+			return nil, &RemoteError{
+				Code:    CodeInvalidArgument,
+				Message: fmt.Sprintf("parameter %d (%s): %v", i, mtype.argTypes[i], err),
+				Details: map[string]string{"parameter": fmt.Sprint(i)},
 			}
-		default:
-			args[i] = reflect.ValueOf(param)
 		}
+		args = append(args, arg)
+	}
+	if mtype.stream {
+		args = append(args, reflect.ValueOf(stream))
 	}
 
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic in %s.%s: %v\n%s", serviceName, methodName, r, debug.Stack())
+			result = nil
+			err = Errorf(CodeInternal, "internal error in %s.%s", serviceName, methodName)
+		}
+	}()
+
 	// Call method
-	results := method.Call(args)
+	results := mtype.method.Func.Call(args)
+
+	// A trailing error return carries the method's failure
+	if mtype.hasError {
+		n := len(results)
+		if errValue := results[n-1]; !errValue.IsNil() {
+			return nil, errValue.Interface().(error)
+		}
+		results = results[:n-1]
+	}
 
-	// For simplicity, assume single return value
 	if len(results) == 0 {
 		return nil, nil
 	}
@@ -142,40 +425,13 @@ func (s *Server) invoke(serviceName, methodName string, params []interface{}) (i
 }
 
 // sendError sends an error response
-func (s *Server) sendError(conn net.Conn, id, errMsg string) {
+func (s *Server) sendError(sc *serverConn, id string, remoteErr *RemoteError) {
 	resp := Response{
 		ID:    id,
-		Error: errMsg,
+		Error: remoteErr,
 	}
 
-	respData, err := EncodeResponse(resp)
-	if err != nil {
-		log.Printf("Failed to encode error response: %v", err)
-		return
-	}
-
-	if _, err := conn.Write(respData); err != nil {
+	if err := sc.writeResponse(resp); err != nil {
 		log.Printf("Failed to write error response: %v", err)
 	}
 }
-
-// Serve starts the RPC server
-func (s *Server) Serve(addr string) error {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen: %w", err)
-	}
-	defer listener.Close()
-
-	log.Printf("RPC Server listening on %s", addr)
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Accept error: %v", err)
-			continue
-		}
-
-		go s.HandleConnection(conn)
-	}
-}
@@ -0,0 +1,50 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowCallDoesNotBlockConnection(t *testing.T) {
+	client := dialCodec(t, startNamed(t, "a"), CodecJSON)
+
+	slow := client.Go("Name", "Stall", 300)
+	start := time.Now()
+	fast := client.Go("Name", "Name")
+
+	select {
+	case call := <-fast.Done:
+		if call.Error != nil {
+			t.Fatalf("Name: %v", call.Error)
+		}
+	case <-slow.Done:
+		t.Fatal("slow call answered before the fast one")
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("fast call took %v; it waited for the slow one", elapsed)
+	}
+	if call := <-slow.Done; call.Error != nil {
+		t.Fatalf("Stall: %v", call.Error)
+	}
+}
+
+func TestMaxConcurrentRequestsQueuesCalls(t *testing.T) {
+	server := NewServer(WithMaxConcurrentRequests(1))
+	if err := server.Register("Name", nameService{"a"}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	client := dialCodec(t, serve(t, server), CodecJSON)
+
+	start := time.Now()
+	first := client.Go("Name", "Stall", 100)
+	time.Sleep(20 * time.Millisecond)
+	second := client.Go("Name", "Stall", 100)
+	for _, call := range []*Call{<-first.Done, <-second.Done} {
+		if call.Error != nil {
+			t.Fatalf("Stall: %v", call.Error)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("two calls finished in %v; want them run one at a time", elapsed)
+	}
+}
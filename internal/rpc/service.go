@@ -0,0 +1,169 @@
+package rpc
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// service is a registered receiver together with the methods that can be
+// called remotely
+type service struct {
+	name    string
+	rcvr    reflect.Value
+	methods map[string]*methodType
+}
+
+// methodType describes a method accepted by suitableMethods.
+// Supported shapes are
+//
+//	func (T) M([ctx context.Context,] args...) [R | error | (R, error)]
+//	func (T) M([ctx context.Context,] args..., stream *ServerStream) error
+//
+// where every argument and R must be encodable. The second shape is a
+// streaming method.
+type methodType struct {
+	method     reflect.Method
+	hasCtx     bool
+	argTypes   []reflect.Type
+	hasError   bool
+	stream     bool // takes a trailing *ServerStream
+	idempotent bool // safe to retry, see WithIdempotent
+}
+
+// newService inspects rcvr and collects its suitable methods.
+// Unsuitable methods are returned with the reason they were rejected.
+func newService(name string, rcvr interface{}) (*service, map[string]error, error) {
+	if name == "" {
+		return nil, nil, fmt.Errorf("service name must not be empty")
+	}
+	if rcvr == nil {
+		return nil, nil, fmt.Errorf("service %s: receiver is nil", name)
+	}
+
+	rcvrValue := reflect.ValueOf(rcvr)
+	methods, rejected := suitableMethods(rcvrValue.Type())
+	if len(methods) == 0 {
+		return nil, rejected, fmt.Errorf("service %s: type %s has no suitable methods", name, rcvrValue.Type())
+	}
+
+	return &service{
+		name:    name,
+		rcvr:    rcvrValue,
+		methods: methods,
+	}, rejected, nil
+}
+
+// suitableMethods returns the methods of typ that can be exposed over RPC,
+// in the spirit of net/rpc. Methods with unsupported signatures are
+// reported in rejected instead.
+func suitableMethods(typ reflect.Type) (methods map[string]*methodType, rejected map[string]error) {
+	methods = make(map[string]*methodType)
+	rejected = make(map[string]error)
+
+	for i := 0; i < typ.NumMethod(); i++ {
+		method := typ.Method(i)
+		if !method.IsExported() {
+			continue
+		}
+
+		mtype, err := checkMethod(method)
+		if err != nil {
+			rejected[method.Name] = err
+			continue
+		}
+		methods[method.Name] = mtype
+	}
+
+	return methods, rejected
+}
+
+// checkMethod validates a single method signature.
+// In(0) is the receiver because method comes from a reflect.Type.
+func checkMethod(method reflect.Method) (*methodType, error) {
+	ftype := method.Type
+	mtype := &methodType{method: method}
+
+	for i := 1; i < ftype.NumIn(); i++ {
+		argType := ftype.In(i)
+		if argType == contextType {
+			if i != 1 {
+				return nil, fmt.Errorf("context.Context must be the first parameter")
+			}
+			mtype.hasCtx = true
+			continue
+		}
+		if argType == serverStreamType {
+			if i != ftype.NumIn()-1 {
+				return nil, fmt.Errorf("*rpc.ServerStream must be the last parameter")
+			}
+			if ftype.NumOut() != 1 || ftype.Out(0) != errorType {
+				return nil, fmt.Errorf("streaming method must return only error")
+			}
+			mtype.stream = true
+			continue
+		}
+		if err := checkEncodable(argType, map[reflect.Type]bool{}); err != nil {
+			return nil, fmt.Errorf("parameter %d: %w", i-1, err)
+		}
+		mtype.argTypes = append(mtype.argTypes, argType)
+	}
+
+	switch ftype.NumOut() {
+	case 0:
+	case 1:
+		if ftype.Out(0) == errorType {
+			mtype.hasError = true
+		} else if err := checkEncodable(ftype.Out(0), map[reflect.Type]bool{}); err != nil {
+			return nil, fmt.Errorf("result: %w", err)
+		}
+	case 2:
+		if ftype.Out(1) != errorType {
+			return nil, fmt.Errorf("second result must be error, got %s", ftype.Out(1))
+		}
+		if err := checkEncodable(ftype.Out(0), map[reflect.Type]bool{}); err != nil {
+			return nil, fmt.Errorf("result: %w", err)
+		}
+		mtype.hasError = true
+	default:
+		return nil, fmt.Errorf("too many results: %d", ftype.NumOut())
+	}
+
+	return mtype, nil
+}
+
+// checkEncodable reports whether values of t can travel through the codec.
+// visited breaks cycles in recursive types.
+func checkEncodable(t reflect.Type, visited map[reflect.Type]bool) error {
+	if visited[t] {
+		return nil
+	}
+	visited[t] = true
+
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return fmt.Errorf("type %s cannot be encoded", t)
+	case reflect.Interface:
+		if t.NumMethod() > 0 {
+			return fmt.Errorf("interface type %s cannot be decoded", t)
+		}
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return checkEncodable(t.Elem(), visited)
+	case reflect.Map:
+		if err := checkEncodable(t.Key(), visited); err != nil {
+			return err
+		}
+		return checkEncodable(t.Elem(), visited)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if err := checkEncodable(field.Type, visited); err != nil {
+				return fmt.Errorf("field %s: %w", field.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// mixedService has one method of each kind Register has to judge
+type mixedService struct{}
+
+func (mixedService) Divide(a, b int) int { return a / b }
+
+func (mixedService) Subscribe(ch chan int) {}
+
+func (mixedService) Results() (int, int) { return 0, 0 }
+
+func (mixedService) Later(n int, ctx context.Context) int { return n }
+
+// noMethods has only methods Register must skip
+type noMethods struct{}
+
+func (noMethods) Callback(f func()) {}
+
+func TestRegisterSkipsUnsuitableMethods(t *testing.T) {
+	methods, rejected := suitableMethods(reflect.TypeOf(mixedService{}))
+	if _, ok := methods["Divide"]; !ok || len(methods) != 1 {
+		t.Fatalf("got %d suitable methods; want only Divide", len(methods))
+	}
+	for _, name := range []string{"Subscribe", "Results", "Later"} {
+		if rejected[name] == nil {
+			t.Errorf("%s was not rejected", name)
+		}
+	}
+
+	server := NewServer()
+	if err := server.Register("Empty", noMethods{}); err == nil {
+		t.Fatal("Register accepted a type with no suitable methods")
+	}
+	if err := server.Register("Mixed", mixedService{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	client := dialCodec(t, serve(t, server), CodecJSON)
+
+	var remoteErr *RemoteError
+	_, err := client.CallContext(context.Background(), "Mixed", "Subscribe", nil)
+	if !errors.As(err, &remoteErr) || remoteErr.Code != CodeNotFound {
+		t.Fatalf("Subscribe = %v; want RemoteError %s", err, CodeNotFound)
+	}
+}
+
+func TestPanicInMethodIsReportedAsInternal(t *testing.T) {
+	server := NewServer()
+	if err := server.Register("Mixed", mixedService{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	client := dialCodec(t, serve(t, server), CodecJSON)
+	ctx := context.Background()
+
+	var quotient int
+	var remoteErr *RemoteError
+	err := client.Invoke(ctx, "Mixed", "Divide", &quotient, 1, 0)
+	if !errors.As(err, &remoteErr) || remoteErr.Code != CodeInternal {
+		t.Fatalf("Divide(1, 0) = %v; want RemoteError %s", err, CodeInternal)
+	}
+
+	// The connection and the server survive the panic
+	if err := client.Invoke(ctx, "Mixed", "Divide", &quotient, 6, 3); err != nil || quotient != 2 {
+		t.Fatalf("Divide(6, 3) = %d, %v; want 2", quotient, err)
+	}
+}
@@ -0,0 +1,293 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/cont1nu1ty/distributed-systems-go-demos/pkg/socket"
+)
+
+// KindGoAway is sent by a server that is shutting down. The client stops
+// starting calls on the connection, lets the calls in flight finish and
+// then closes it; with WithReconnect it dials again for new calls.
+const KindGoAway = "goaway"
+
+// DefaultDrainTimeout bounds the drain started when Serve's context is done
+const DefaultDrainTimeout = 10 * time.Second
+
+// goAwayGrace is how long a drained connection stays open after
+// KindGoAway, so that calls the client sent before reading it are refused
+// with CodeUnavailable rather than lost with the connection
+const goAwayGrace = 100 * time.Millisecond
+
+// ErrServerClosed is returned by Serve and ServeListener after Shutdown
+var ErrServerClosed = errors.New("rpc: server closed")
+
+// errGoingAway is returned by a client connection that received
+// KindGoAway before the call was sent; the call is retried on a new one
+var errGoingAway = errors.New("connection is going away")
+
+// Serve listens on addr and serves connections until Shutdown is called
+// or ctx is done. In the latter case it drains the server as Shutdown
+// does, for up to DefaultDrainTimeout, before returning.
+func (s *Server) Serve(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	log.Printf("RPC Server listening on %s", addr)
+	return s.ServeListener(ctx, listener)
+}
+
+// ServeListener serves connections accepted from listener like Serve,
+// wrapping it in TLS if the server was created WithServerTLS. The
+// listener is closed when it returns.
+func (s *Server) ServeListener(ctx context.Context, listener net.Listener) error {
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	if !s.trackListener(listener) {
+		listener.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(listener)
+
+	drained := make(chan error, 1)
+	stopDrain := context.AfterFunc(ctx, func() {
+		drainCtx, cancel := context.WithTimeout(context.Background(), DefaultDrainTimeout)
+		defer cancel()
+		drained <- s.Shutdown(drainCtx)
+	})
+
+	err := s.accept(listener)
+	if !stopDrain() {
+		// ctx ended the server; return once the drain is over
+		if drainErr := <-drained; drainErr != nil {
+			return drainErr
+		}
+	}
+	return err
+}
+
+// accept hands connections to HandleConnection until the listener is
+// closed
+func (s *Server) accept(listener net.Listener) error {
+	err := socket.Serve(listener, s.HandleConnection)
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops the server gracefully: it closes the listeners, sends
+// KindGoAway on every connection and waits for the connections to drain.
+// Each connection is closed by the server once its in-flight calls and
+// streams have been answered, so a client that never hangs up does not
+// hold Shutdown up. Calls that reach a connection after its KindGoAway
+// are refused with CodeUnavailable without running. If ctx is done
+// first, the remaining connections are closed, their in-flight calls are
+// cancelled and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycleMu.Lock()
+	s.shutdown = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.lifecycleMu.Unlock()
+
+	if len(conns) > 0 {
+		log.Printf("Shutting down: draining %d connections", len(conns))
+	}
+	// A peer that stops reading blocks its goaway write until ctx is done
+	// and forceClose closes the socket under it
+	for _, sc := range conns {
+		go sc.goAway()
+	}
+
+	for _, sc := range conns {
+		select {
+		case <-sc.done:
+		case <-ctx.Done():
+			for _, sc := range conns {
+				sc.forceClose()
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *Server) shuttingDown() bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+	return s.shutdown
+}
+
+// trackListener registers listener for Shutdown unless the server is
+// already shut down
+func (s *Server) trackListener(listener net.Listener) bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(listener net.Listener) {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+
+	listener.Close()
+	delete(s.listeners, listener)
+}
+
+// trackConn registers sc for Shutdown unless the server is already shut
+// down
+func (s *Server) trackConn(sc *serverConn) bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	s.conns[sc] = struct{}{}
+	return true
+}
+
+// untrackConn forgets sc and tells Shutdown that it is gone
+func (s *Server) untrackConn(sc *serverConn) {
+	s.lifecycleMu.Lock()
+	delete(s.conns, sc)
+	s.lifecycleMu.Unlock()
+
+	close(sc.done)
+}
+
+// goAway marks the connection as draining, then tells the client; every
+// call read after that is refused. The connection is closed shortly after
+// nothing is in flight on it.
+func (sc *serverConn) goAway() {
+	sc.drainMu.Lock()
+	sc.goingAway = true
+	drained := sc.inFlight == 0
+	sc.drainMu.Unlock()
+
+	if err := sc.writeResponse(Response{Kind: KindGoAway}); err != nil {
+		log.Printf("Failed to write goaway: %v", err)
+	}
+	if drained {
+		sc.closeDrained()
+	}
+}
+
+// startCall counts a unary call or stream open about to run. It returns
+// false once the connection is going away; the call must then be refused.
+func (sc *serverConn) startCall() bool {
+	sc.drainMu.Lock()
+	defer sc.drainMu.Unlock()
+
+	if sc.goingAway {
+		return false
+	}
+	sc.inFlight++
+	return true
+}
+
+// finishCall is called after a call's response or a stream's end was
+// written; the last one to finish on a going-away connection closes it
+func (sc *serverConn) finishCall() {
+	sc.drainMu.Lock()
+	sc.inFlight--
+	drained := sc.goingAway && sc.inFlight == 0
+	sc.drainMu.Unlock()
+
+	if drained {
+		sc.closeDrained()
+	}
+}
+
+// closeDrained closes a going-away connection with nothing in flight
+// after goAwayGrace. No call can start on it any more, so closing the
+// socket ends HandleConnection.
+func (sc *serverConn) closeDrained() {
+	time.AfterFunc(goAwayGrace, func() {
+		sc.netConn.Close()
+	})
+}
+
+// forceClose ends a connection that did not drain in time
+func (sc *serverConn) forceClose() {
+	sc.cancel()
+	sc.netConn.Close()
+}
+
+// refuse answers a call that arrived after KindGoAway
+func (s *Server) refuse(sc *serverConn, req *Request) {
+	remoteErr := Errorf(CodeUnavailable, "server is shutting down; %s.%s was not run", req.Service, req.Method)
+	switch {
+	case req.Kind == KindStreamOpen:
+		s.sendStreamEnd(sc, req.ID, remoteErr, nil)
+	case req.NoReply:
+		log.Printf("One-way call %s.%s dropped: server is shutting down", req.Service, req.Method)
+	default:
+		s.sendError(sc, req.ID, remoteErr)
+	}
+}
+
+// goAway stops new calls on the connection and closes it at once if
+// nothing is in flight; otherwise the last call or stream to finish
+// closes it
+func (cc *clientConn) goAway() {
+	cc.mu.Lock()
+	cc.goingAway = true
+	drained := cc.drainedLocked()
+	cc.mu.Unlock()
+
+	if drained {
+		cc.close()
+	}
+}
+
+// drainedLocked reports whether a going-away connection has nothing left
+// in flight. cc.mu must be held.
+func (cc *clientConn) drainedLocked() bool {
+	return cc.goingAway && !cc.broken && len(cc.pending) == 0 && len(cc.streams) == 0
+}
+
+// usableLocked reports why no new call may start on cc, if any. cc.mu
+// must be held.
+func (cc *clientConn) usableLocked() error {
+	switch {
+	case cc.broken:
+		return ErrConnectionLost
+	case cc.goingAway:
+		return errGoingAway
+	}
+	return nil
+}
+
+// usable is usableLocked for callers that do not hold cc.mu
+func (cc *clientConn) usable() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.usableLocked()
+}
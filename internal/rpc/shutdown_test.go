@@ -0,0 +1,246 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveShutdown runs a nameService server the test shuts down itself
+func serveShutdown(t *testing.T) (*Server, string) {
+	t.Helper()
+
+	server := NewServer()
+	if err := server.Register("Name", nameService{"a"}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return server, serve(t, server)
+}
+
+// shutdownAsync starts Shutdown and returns its result channel
+func shutdownAsync(server *Server) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result <- server.Shutdown(ctx)
+	}()
+	return result
+}
+
+// lineConn is a legacy newline-JSON client that never hangs up by itself
+type lineConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialLine(t *testing.T, addr string) *lineConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &lineConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (lc *lineConn) send(t *testing.T, req Request) {
+	t.Helper()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if _, err := lc.Write(append(data, '\n')); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+func (lc *lineConn) recv(t *testing.T) (Response, error) {
+	t.Helper()
+
+	lc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := lc.r.ReadBytes('\n')
+	if err != nil {
+		return Response{}, err
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatalf("Unmarshal %q: %v", line, err)
+	}
+	return resp, nil
+}
+
+func TestShutdownWaitsForInFlightCall(t *testing.T) {
+	server, addr := serveShutdown(t)
+	client := dialCodec(t, addr, CodecJSON)
+
+	called := make(chan error, 1)
+	go func() {
+		var name string
+		called <- client.Invoke(context.Background(), "Name", "Stall", &name, 300)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := shutdownAsync(server)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the in-flight call finished", err)
+	case err := <-called:
+		if err != nil {
+			t.Fatalf("in-flight call = %v, want it to complete", err)
+		}
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+
+	// Without WithReconnect later calls fail, but the client is not closed
+	err := client.Invoke(context.Background(), "Name", "Name", nil)
+	if !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("call after goaway = %v, want ErrConnectionLost", err)
+	}
+	if !client.lost() {
+		t.Fatal("client without reconnect not reported as lost")
+	}
+}
+
+func TestShutdownClosesConnectionWithoutClient(t *testing.T) {
+	server, addr := serveShutdown(t)
+	lc := dialLine(t, addr)
+
+	lc.send(t, Request{ID: "1", Service: "Name", Method: "Name"})
+	if resp, err := lc.recv(t); err != nil || resp.ID != "1" {
+		t.Fatalf("response = %+v, %v", resp, err)
+	}
+
+	start := time.Now()
+	if err := <-shutdownAsync(server); err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Shutdown took %v with an idle connection", elapsed)
+	}
+
+	if resp, err := lc.recv(t); err != nil || resp.Kind != KindGoAway {
+		t.Fatalf("frame after Shutdown = %+v, %v; want goaway", resp, err)
+	}
+	if _, err := lc.recv(t); err != io.EOF {
+		t.Fatalf("read after goaway = %v, want EOF from the server closing", err)
+	}
+}
+
+func TestShutdownDrainOrdering(t *testing.T) {
+	server, addr := serveShutdown(t)
+	lc := dialLine(t, addr)
+
+	lc.send(t, Request{ID: "slow", Service: "Name", Method: "Stall", Params: []Payload{Payload("300")}})
+	time.Sleep(50 * time.Millisecond)
+	shutdown := shutdownAsync(server)
+
+	if resp, err := lc.recv(t); err != nil || resp.Kind != KindGoAway {
+		t.Fatalf("first frame = %+v, %v; want goaway", resp, err)
+	}
+
+	// A call sent after goaway is refused, the one in flight still answers
+	lc.send(t, Request{ID: "late", Service: "Name", Method: "Name"})
+	resp, err := lc.recv(t)
+	if err != nil || resp.ID != "late" || resp.Error == nil || resp.Error.Code != CodeUnavailable {
+		t.Fatalf("late call = %+v, %v; want unavailable", resp, err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a call in flight", err)
+	default:
+	}
+
+	resp, err = lc.recv(t)
+	if err != nil || resp.ID != "slow" || resp.Error != nil {
+		t.Fatalf("in-flight call = %+v, %v; want its result", resp, err)
+	}
+	if _, err := lc.recv(t); err != io.EOF {
+		t.Fatalf("read after the last response = %v, want EOF", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+}
+
+func TestShutdownWaitsForStream(t *testing.T) {
+	svc := &tickerService{stopped: make(chan error, 1)}
+	server := NewServer()
+	if err := server.Register("Ticker", svc); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	client := dialCodec(t, serve(t, server), CodecJSON)
+
+	stream, err := client.Stream(context.Background(), "Ticker", "Tick")
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	var n int
+	if err := stream.Recv(&n); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	shutdown := shutdownAsync(server)
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a stream open", err)
+	default:
+	}
+	if err := stream.Recv(&n); err != nil {
+		t.Fatalf("Recv while draining: %v", err)
+	}
+
+	stream.Cancel()
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+}
+
+func TestShutdownDoesNotWaitForPeerThatStopsReading(t *testing.T) {
+	server := NewServer()
+	if err := server.Register("Name", nameService{"a"}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	// A pipe has no buffer: the goaway write blocks until the peer reads
+	conn, serverConn := net.Pipe()
+	defer conn.Close()
+	go server.HandleConnection(serverConn)
+	lc := &lineConn{Conn: conn, r: bufio.NewReader(conn)}
+	lc.send(t, Request{ID: "1", Service: "Name", Method: "Name"})
+	if resp, err := lc.recv(t); err != nil || resp.ID != "1" {
+		t.Fatalf("response = %+v, %v", resp, err)
+	}
+	// Let the call finish, so only the goaway write can close the
+	// connection
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- server.Shutdown(ctx) }()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Shutdown = %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown blocked on a goaway the peer never reads")
+	}
+}
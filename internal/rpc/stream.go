@@ -0,0 +1,554 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// Frame kinds of a streaming call. Unary requests and responses leave Kind
+// empty. Every frame of a stream carries the ID of the request that
+// opened it, so streams share the connection with unary calls.
+const (
+	// KindStreamOpen starts a stream; Service, Method, Params, TimeoutMS
+	// and Metadata are set as for a unary request
+	KindStreamOpen = "stream_open"
+	// KindStreamMsg carries one message: Params[0] from the client,
+	// Result from the server
+	KindStreamMsg = "stream_msg"
+	// KindStreamEnd means the sender has no more messages. From the server
+	// it ends the call; its Error and Metadata are the final status.
+	KindStreamEnd = "stream_end"
+	// KindStreamCancel is sent by the client to abandon the call
+	KindStreamCancel = "stream_cancel"
+	// KindStreamWindow grants the peer Window more messages
+	KindStreamWindow = "stream_window"
+)
+
+// StreamWindow is how many messages either side may send ahead of the
+// receiver. The receiver returns credit in KindStreamWindow frames as its
+// application reads messages.
+const StreamWindow = 32
+
+// ErrFlowControl is reported when a peer sends beyond its window
+var ErrFlowControl = errors.New("stream flow control window exceeded")
+
+var serverStreamType = reflect.TypeOf((*ServerStream)(nil))
+
+// streamCore is the part of a stream shared by both ends: a bounded
+// receive queue and the credit for sending
+type streamCore struct {
+	id     string
+	ctx    context.Context
+	cancel context.CancelFunc
+	// write sends one frame of kind for this stream
+	write func(kind string, payload Payload, window int) error
+	// payload encodes the messages sent and received
+	payload PayloadCodec
+
+	recv       chan Payload
+	recvMu     sync.Mutex
+	recvClosed bool
+	recvErr    error // returned once the queue is drained
+	consumed   int   // messages read since the last window update
+
+	creditMu   sync.Mutex
+	credit     int
+	creditWake chan struct{}
+}
+
+func newStreamCore(ctx context.Context, cancel context.CancelFunc, id string, payload PayloadCodec) *streamCore {
+	return &streamCore{
+		id:         id,
+		ctx:        ctx,
+		cancel:     cancel,
+		payload:    payload,
+		recv:       make(chan Payload, StreamWindow),
+		credit:     StreamWindow,
+		creditWake: make(chan struct{}, 1),
+	}
+}
+
+// deliver queues a message from the peer; it never blocks the connection's
+// reader. It returns false if the peer overran its window.
+func (s *streamCore) deliver(payload Payload) bool {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	if s.recvClosed {
+		return true
+	}
+	select {
+	case s.recv <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish marks the end of incoming messages; Recv returns err after the
+// queued ones
+func (s *streamCore) finish(err error) {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	if s.recvClosed {
+		return
+	}
+	s.recvClosed = true
+	s.recvErr = err
+	close(s.recv)
+}
+
+// finished reports whether finish was called
+func (s *streamCore) finished() bool {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	return s.recvClosed
+}
+
+// addCredit lets Send go on after the peer read n messages
+func (s *streamCore) addCredit(n int) {
+	s.creditMu.Lock()
+	s.credit += n
+	s.creditMu.Unlock()
+
+	select {
+	case s.creditWake <- struct{}{}:
+	default:
+	}
+}
+
+// acquireCredit waits until one more message may be sent
+func (s *streamCore) acquireCredit() error {
+	for {
+		s.creditMu.Lock()
+		if s.credit > 0 {
+			s.credit--
+			s.creditMu.Unlock()
+			return nil
+		}
+		s.creditMu.Unlock()
+
+		select {
+		case <-s.creditWake:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// send encodes v and writes it once the peer has room for it
+func (s *streamCore) send(v interface{}) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	payload, err := s.payload.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode stream message: %w", err)
+	}
+	if err := s.acquireCredit(); err != nil {
+		return err
+	}
+	return s.write(KindStreamMsg, payload, 0)
+}
+
+// receive decodes the next message into v. Messages queued before the
+// stream finished are still delivered after its context is done.
+func (s *streamCore) receive(v interface{}) error {
+	var payload Payload
+	var ok bool
+
+	select {
+	case payload, ok = <-s.recv:
+	case <-s.ctx.Done():
+		if !s.finished() {
+			return s.ctx.Err()
+		}
+		// recv is closed, so this cannot block
+		payload, ok = <-s.recv
+	}
+
+	if !ok {
+		s.recvMu.Lock()
+		defer s.recvMu.Unlock()
+		return s.recvErr
+	}
+
+	s.returnCredit()
+	return decodeResult(s.payload, payload, v)
+}
+
+// returnCredit tells the peer about consumed messages in batches of half
+// a window, so updates do not double the frame count
+func (s *streamCore) returnCredit() {
+	s.recvMu.Lock()
+	s.consumed++
+	n := s.consumed
+	if n < StreamWindow/2 || s.recvClosed {
+		s.recvMu.Unlock()
+		return
+	}
+	s.consumed = 0
+	s.recvMu.Unlock()
+
+	// A failed update means the stream is going away anyway
+	s.write(KindStreamWindow, nil, n)
+}
+
+// ServerStream is the server's end of a streaming call. A service method
+// becomes a streaming method by taking it as its last parameter:
+//
+//	func (T) M([ctx context.Context,] args..., stream *rpc.ServerStream) error
+//
+// The call ends when the method returns; its error is sent to the client
+// as the final status. Send and Recv may be used from different
+// goroutines, but each only from one at a time.
+type ServerStream struct {
+	*streamCore
+}
+
+// Context returns the call's context, cancelled when the client cancels,
+// the deadline passes or the connection closes
+func (ss *ServerStream) Context() context.Context {
+	return ss.ctx
+}
+
+// Send sends one message to the client, waiting while the client's window
+// is full
+func (ss *ServerStream) Send(v interface{}) error {
+	return ss.send(v)
+}
+
+// Recv decodes the next client message into v. It returns io.EOF after the
+// client called CloseSend.
+func (ss *ServerStream) Recv(v interface{}) error {
+	return ss.receive(v)
+}
+
+// serverStreamKey hands the stream to invoke through the context, so
+// stream opens travel through the same interceptors as unary calls
+type serverStreamKey struct{}
+
+// serverStreamFromContext returns the stream being served, if any
+func serverStreamFromContext(ctx context.Context) *ServerStream {
+	ss, _ := ctx.Value(serverStreamKey{}).(*ServerStream)
+	return ss
+}
+
+// openStream starts serving a KindStreamOpen request. The method runs in
+// its own goroutine outside the connection's concurrency limit, since it
+// may wait on messages that only the connection's reader can deliver.
+// The caller has counted the stream with startCall.
+func (s *Server) openStream(connCtx context.Context, sc *serverConn, req *Request, wg *sync.WaitGroup) {
+	ctx, cancel := requestContext(connCtx, req)
+	ctx, respMD := serverMetadataContext(ctx, req)
+
+	core := newStreamCore(ctx, cancel, req.ID, sc.payload)
+	core.write = func(kind string, payload Payload, window int) error {
+		return sc.writeResponse(Response{ID: req.ID, Kind: kind, Result: payload, Window: window})
+	}
+	ss := &ServerStream{core}
+	ss.ctx = context.WithValue(ctx, serverStreamKey{}, ss)
+
+	if !sc.addStream(ss) {
+		cancel()
+		s.sendStreamEnd(sc, req.ID, Errorf(CodeInvalidRequest, "duplicate stream id %q", req.ID), nil)
+		sc.finishCall()
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		_, err := s.handler(ss.ctx, req)
+		cancel()
+		sc.removeStream(req.ID)
+
+		var remoteErr *RemoteError
+		if err != nil {
+			remoteErr = toRemoteError(err)
+		}
+		s.sendStreamEnd(sc, req.ID, remoteErr, respMD.metadata())
+		sc.finishCall()
+	}()
+}
+
+// sendStreamEnd writes the final status of a stream
+func (s *Server) sendStreamEnd(sc *serverConn, id string, remoteErr *RemoteError, md Metadata) {
+	resp := Response{ID: id, Kind: KindStreamEnd, Error: remoteErr, Metadata: md}
+	if err := sc.writeResponse(resp); err != nil {
+		log.Printf("Failed to write stream end: %v", err)
+	}
+}
+
+// routeStreamFrame applies a client frame to the stream it belongs to.
+// Frames for streams that already ended are dropped.
+func (sc *serverConn) routeStreamFrame(req *Request) {
+	ss := sc.stream(req.ID)
+	if ss == nil {
+		return
+	}
+
+	switch req.Kind {
+	case KindStreamMsg:
+		var payload Payload
+		if len(req.Params) > 0 {
+			payload = req.Params[0]
+		}
+		if !ss.deliver(payload) {
+			ss.finish(ErrFlowControl)
+			ss.cancel()
+		}
+	case KindStreamEnd:
+		ss.finish(io.EOF)
+	case KindStreamCancel:
+		ss.finish(context.Canceled)
+		ss.cancel()
+	case KindStreamWindow:
+		ss.addCredit(req.Window)
+	}
+}
+
+// addStream registers ss unless its ID is in use
+func (sc *serverConn) addStream(ss *ServerStream) bool {
+	sc.streamMu.Lock()
+	defer sc.streamMu.Unlock()
+
+	if sc.streams == nil {
+		sc.streams = make(map[string]*ServerStream)
+	}
+	if _, exists := sc.streams[ss.id]; exists {
+		return false
+	}
+	sc.streams[ss.id] = ss
+	return true
+}
+
+func (sc *serverConn) stream(id string) *ServerStream {
+	sc.streamMu.Lock()
+	defer sc.streamMu.Unlock()
+	return sc.streams[id]
+}
+
+func (sc *serverConn) removeStream(id string) {
+	sc.streamMu.Lock()
+	defer sc.streamMu.Unlock()
+	delete(sc.streams, id)
+}
+
+// Streamer opens streaming calls. Client, Pool and BalancedClient
+// implement it.
+type Streamer interface {
+	Stream(ctx context.Context, service, method string, params ...interface{}) (*ClientStream, error)
+}
+
+// OpenStream opens a stream through invoker, which must also be a
+// Streamer; generated stubs use it for streaming methods
+func OpenStream(ctx context.Context, invoker Invoker, service, method string, params ...interface{}) (*ClientStream, error) {
+	streamer, ok := invoker.(Streamer)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support streaming calls", invoker)
+	}
+	return streamer.Stream(ctx, service, method, params...)
+}
+
+// ClientStream is the client's end of a streaming call. Send and Recv may
+// be used from different goroutines, but each only from one at a time.
+type ClientStream struct {
+	*streamCore
+	conn      *clientConn
+	parentCtx context.Context // the caller's ctx, for response metadata
+
+	endOnce       sync.Once
+	closeSendOnce sync.Once
+}
+
+// Stream opens a streaming call to a method taking a *ServerStream. params
+// are the method's regular arguments. The stream lives until the server
+// ends it, ctx is done or Cancel is called; metadata attached to ctx with
+// WithMetadata is sent when the stream opens, and WithResponseMetadata
+// receives the server's final metadata.
+func (c *Client) Stream(ctx context.Context, service, method string, params ...interface{}) (*ClientStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	encodedParams, err := encodeParams(c.payload, params)
+	if err != nil {
+		return nil, err
+	}
+
+	timeoutMS, err := timeoutFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &Request{
+		ID:        fmt.Sprintf("%s-%s-%d", service, method, c.seq.Add(1)),
+		Kind:      KindStreamOpen,
+		Service:   service,
+		Method:    method,
+		Params:    encodedParams,
+		TimeoutMS: timeoutMS,
+		Metadata:  requestMetadata(ctx),
+	}
+	if err := c.addCredentials(ctx, req); err != nil {
+		return nil, err
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	cs := &ClientStream{
+		streamCore: newStreamCore(streamCtx, cancel, req.ID, c.payload),
+		parentCtx:  ctx,
+	}
+	cs.write = func(kind string, payload Payload, window int) error {
+		frame := &Request{ID: req.ID, Kind: kind, Window: window}
+		if payload != nil {
+			frame.Params = []Payload{payload}
+		}
+		return cs.conn.write(frame)
+	}
+
+	for {
+		conn, err := c.getConn(ctx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		cs.conn = conn
+		err = conn.addStream(cs)
+		if errors.Is(err, errGoingAway) {
+			continue
+		}
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		break
+	}
+
+	conn := cs.conn
+	if err := conn.write(req); err != nil {
+		conn.removeStream(req.ID)
+		cancel()
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	go cs.watch()
+	return cs, nil
+}
+
+// watch cancels the call on the server once the stream's context is done,
+// unless the stream already ended
+func (cs *ClientStream) watch() {
+	<-cs.ctx.Done()
+	cs.end(cs.ctx.Err(), func() {
+		cs.write(KindStreamCancel, nil, 0)
+	})
+}
+
+// end finishes the stream exactly once; notify runs first if this call
+// is the one ending it
+func (cs *ClientStream) end(err error, notify func()) {
+	cs.endOnce.Do(func() {
+		if notify != nil {
+			notify()
+		}
+		cs.conn.removeStream(cs.id)
+		cs.finish(err)
+	})
+	cs.cancel()
+}
+
+// Send sends one message to the server, waiting while the server's window
+// is full. It returns io.EOF if the server already ended the call; Recv
+// then reports the final status.
+func (cs *ClientStream) Send(v interface{}) error {
+	if cs.finished() {
+		return io.EOF
+	}
+	return cs.send(v)
+}
+
+// CloseSend tells the server no more messages will be sent
+func (cs *ClientStream) CloseSend() error {
+	var err error
+	cs.closeSendOnce.Do(func() {
+		if !cs.finished() {
+			err = cs.write(KindStreamEnd, nil, 0)
+		}
+	})
+	return err
+}
+
+// Recv decodes the next server message into v. It returns io.EOF when the
+// server ended the call successfully and the server's error (usually a
+// *RemoteError) otherwise.
+func (cs *ClientStream) Recv(v interface{}) error {
+	return cs.receive(v)
+}
+
+// Cancel abandons the call; the server's stream context is cancelled
+func (cs *ClientStream) Cancel() {
+	cs.cancel()
+}
+
+// routeStreamFrame applies a server frame to the stream it belongs to
+func (cc *clientConn) routeStreamFrame(resp *Response) {
+	cc.mu.Lock()
+	cs := cc.streams[resp.ID]
+	cc.mu.Unlock()
+	if cs == nil {
+		return
+	}
+
+	switch resp.Kind {
+	case KindStreamMsg:
+		if !cs.deliver(resp.Result) {
+			cs.end(ErrFlowControl, func() {
+				cs.write(KindStreamCancel, nil, 0)
+			})
+		}
+	case KindStreamEnd:
+		captureResponseMetadata(cs.parentCtx, resp)
+		var err error = io.EOF
+		if resp.Error != nil {
+			err = resp.Error
+		}
+		cs.end(err, nil)
+	case KindStreamWindow:
+		cs.addCredit(resp.Window)
+	}
+}
+
+// addStream registers cs unless the connection takes no new calls
+func (cc *clientConn) addStream(cs *ClientStream) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if err := cc.usableLocked(); err != nil {
+		return err
+	}
+	if cc.streams == nil {
+		cc.streams = make(map[string]*ClientStream)
+	}
+	cc.streams[cs.id] = cs
+	return nil
+}
+
+func (cc *clientConn) removeStream(id string) {
+	cc.mu.Lock()
+	delete(cc.streams, id)
+	drained := cc.drainedLocked()
+	cc.mu.Unlock()
+
+	if drained {
+		cc.close()
+	}
+}
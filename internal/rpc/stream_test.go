@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// tickerService streams numbers until its context ends
+type tickerService struct {
+	stopped chan error
+}
+
+func (s *tickerService) Tick(ctx context.Context, stream *ServerStream) error {
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			s.stopped <- err
+			return err
+		}
+		if err := stream.Send(i); err != nil {
+			s.stopped <- err
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamCancelStopsServerMethod(t *testing.T) {
+	svc := &tickerService{stopped: make(chan error, 1)}
+	server := NewServer()
+	if err := server.Register("Ticker", svc); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	client := dialCodec(t, serve(t, server), CodecJSON)
+
+	stream, err := client.Stream(context.Background(), "Ticker", "Tick")
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		var n int
+		if err := stream.Recv(&n); err != nil || n != i {
+			t.Fatalf("Recv = %d, %v; want %d", n, err, i)
+		}
+	}
+
+	stream.Cancel()
+	select {
+	case err := <-svc.stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("method stopped with %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("method still running after the client cancelled")
+	}
+}
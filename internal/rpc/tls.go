@@ -0,0 +1,85 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TLSHandshakeTimeout bounds the TLS handshake of an accepted connection
+const TLSHandshakeTimeout = 10 * time.Second
+
+// WithServerTLS makes Serve and ServeListener accept TLS connections only.
+// Set config.ClientAuth to tls.RequireAndVerifyClientCert (with ClientCAs)
+// for mutual TLS; handlers then learn the client's identity through
+// PeerFromContext.
+func WithServerTLS(config *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// WithClientTLS makes the client dial with TLS. An empty
+// config.ServerName is taken from the dialed address.
+func WithClientTLS(config *tls.Config) ClientOption {
+	return func(o *clientOptions) {
+		o.tlsConfig = config
+	}
+}
+
+// Peer describes the remote end of the connection a request arrived on
+type Peer struct {
+	Addr net.Addr
+	// TLS is the state of the TLS connection; nil on plain TCP
+	TLS *tls.ConnectionState
+}
+
+// Identity returns the subject common name of the client certificate
+// verified during a mutual TLS handshake, or "" if there is none
+func (p *Peer) Identity() string {
+	if p.TLS == nil || len(p.TLS.VerifiedChains) == 0 || len(p.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return p.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// peerKey carries the *Peer of a server call
+type peerKey struct{}
+
+// PeerFromContext returns the peer of the request being served
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	peer, ok := ctx.Value(peerKey{}).(*Peer)
+	return peer, ok
+}
+
+// newPeer completes the TLS handshake of conn, if it is a TLS connection,
+// and describes its remote end
+func newPeer(conn net.Conn) (*Peer, error) {
+	peer := &Peer{Addr: conn.RemoteAddr()}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return peer, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TLSHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	state := tlsConn.ConnectionState()
+	peer.TLS = &state
+	return peer, nil
+}
+
+// dialConn opens the transport for a client connection
+func dialConn(addr string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if config == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
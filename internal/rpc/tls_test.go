@@ -0,0 +1,191 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for one test, like cmd/certgen but in memory
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := certTemplate(name)
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func certTemplate(commonName string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+// issue signs a certificate for commonName with the given usage; server
+// certificates are valid for 127.0.0.1
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := certTemplate(commonName)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	if usage == x509.ExtKeyUsageServerAuth {
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+type peerService struct{}
+
+// Who returns the verified client identity, or "tls"/"plain" without one
+func (peerService) Who(ctx context.Context) string {
+	peer, ok := PeerFromContext(ctx)
+	switch {
+	case !ok:
+		return ""
+	case peer.Identity() != "":
+		return peer.Identity()
+	case peer.TLS != nil:
+		return "tls"
+	}
+	return "plain"
+}
+
+// startTLS serves peerService with the CA's server certificate; clientCA,
+// if set, turns on mutual TLS
+func startTLS(t *testing.T, ca, clientCA *testCA) string {
+	t.Helper()
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth)},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != nil {
+		config.ClientCAs = clientCA.pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	server := NewServer(WithServerTLS(config))
+	if err := server.Register("Peer", peerService{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	return serve(t, server)
+}
+
+// who dials addr with config and asks for its identity
+func who(t *testing.T, addr string, config *tls.Config) (string, error) {
+	t.Helper()
+
+	client, err := NewClient(addr, WithClientTLS(config), WithDialTimeout(2*time.Second))
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var identity string
+	err = client.Invoke(ctx, "Peer", "Who", &identity)
+	return identity, err
+}
+
+func TestTLSServer(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	addr := startTLS(t, ca, nil)
+
+	identity, err := who(t, addr, &tls.Config{RootCAs: ca.pool})
+	if err != nil || identity != "tls" {
+		t.Fatalf("Who = %q, %v; want a TLS peer without identity", identity, err)
+	}
+
+	// A client that does not trust the CA refuses the server
+	if _, err := who(t, addr, &tls.Config{RootCAs: newTestCA(t, "other CA").pool}); err == nil {
+		t.Fatal("client accepted a server signed by an unknown CA")
+	}
+
+	// Plain TCP clients cannot talk to a TLS server
+	if _, err := who(t, addr, nil); err == nil {
+		t.Fatal("plain client got an answer from a TLS server")
+	}
+}
+
+func TestMutualTLSIdentity(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	addr := startTLS(t, ca, ca)
+
+	identity, err := who(t, addr, &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)},
+	})
+	if err != nil || identity != "alice" {
+		t.Fatalf("Who = %q, %v; want alice", identity, err)
+	}
+}
+
+func TestMutualTLSRejectsClientCert(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	addr := startTLS(t, ca, ca)
+
+	tests := []struct {
+		name string
+		cert []tls.Certificate
+	}{
+		{"no certificate", nil},
+		{"unknown CA", []tls.Certificate{newTestCA(t, "rogue CA").issue(t, "mallory", x509.ExtKeyUsageClientAuth)}},
+		{"server usage", []tls.Certificate{ca.issue(t, "bob", x509.ExtKeyUsageServerAuth)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// With TLS 1.3 the client learns of the rejection only on its
+			// first read, so the error may come from the call
+			identity, err := who(t, addr, &tls.Config{RootCAs: ca.pool, Certificates: tt.cert})
+			if err == nil {
+				t.Fatalf("Who = %q; want the client certificate rejected", identity)
+			}
+		})
+	}
+}
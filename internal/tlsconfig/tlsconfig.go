@@ -0,0 +1,112 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Server builds a server-side config from PEM files. A non-empty
+// clientCAFile turns on mutual TLS: clients must present a certificate
+// signed by one of its CAs.
+func Server(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Client builds a client-side config that trusts the CAs in caFile, or
+// the system roots if it is empty. certFile and keyFile, if set, are the
+// client certificate presented to servers requiring mutual TLS.
+func Client(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// loadCertPool reads PEM certificates from path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Flags are the -tls-* command line flags shared by the demo programs
+type Flags struct {
+	Cert *string
+	Key  *string
+	CA   *string
+}
+
+// RegisterFlags defines -tls-cert, -tls-key and -tls-ca on the default
+// flag set. For a server the certificate enables TLS and the CA enables
+// client verification; for a client the CA verifies the server and the
+// certificate is sent for mutual TLS.
+func RegisterFlags() *Flags {
+	return &Flags{
+		Cert: flag.String("tls-cert", "", "PEM certificate to present; enables TLS on servers"),
+		Key:  flag.String("tls-key", "", "PEM private key for -tls-cert"),
+		CA:   flag.String("tls-ca", "", "PEM CA bundle: verifies clients on servers (mutual TLS), the server on clients"),
+	}
+}
+
+// ServerConfig returns the server config selected by the flags, or nil
+// when -tls-cert is not set
+func (f *Flags) ServerConfig() (*tls.Config, error) {
+	if *f.Cert == "" {
+		if *f.CA != "" {
+			return nil, fmt.Errorf("-tls-ca needs -tls-cert and -tls-key on a server")
+		}
+		return nil, nil
+	}
+	return Server(*f.Cert, *f.Key, *f.CA)
+}
+
+// ClientConfig returns the client config selected by the flags, or nil
+// when no -tls-* flag is set
+func (f *Flags) ClientConfig() (*tls.Config, error) {
+	if *f.Cert == "" && *f.Key == "" && *f.CA == "" {
+		return nil, nil
+	}
+	return Client(*f.CA, *f.Cert, *f.Key)
+}
@@ -0,0 +1,43 @@
+package socket
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// Delays between retries of a failing Accept
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Serve accepts connections from listener and runs handle for each in its
+// own goroutine until the listener is closed, returning the error that
+// ended it. Other Accept errors, such as running out of file descriptors,
+// are retried after a delay that doubles up to a second instead of
+// spinning.
+func Serve(listener net.Listener, handle func(net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			log.Printf("Accept error: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		go handle(conn)
+	}
+}
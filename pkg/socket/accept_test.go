@@ -0,0 +1,51 @@
+package socket
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// flakyListener fails Accept failures times, then hands out one end of a
+// pipe and reports itself closed
+type flakyListener struct {
+	net.Listener
+	failures int
+	accepted bool
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	switch {
+	case l.failures > 0:
+		l.failures--
+		return nil, errors.New("too many open files")
+	case !l.accepted:
+		l.accepted = true
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+	return nil, net.ErrClosed
+}
+
+func TestServeBacksOffOnAcceptErrors(t *testing.T) {
+	listener := &flakyListener{failures: 4}
+	handled := make(chan net.Conn, 1)
+
+	start := time.Now()
+	err := Serve(listener, func(conn net.Conn) { handled <- conn })
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Serve = %v, want net.ErrClosed", err)
+	}
+	// 5 + 10 + 20 + 40ms
+	if elapsed := time.Since(start); elapsed < 75*time.Millisecond {
+		t.Fatalf("four failed Accepts took %v; want a growing delay between them", elapsed)
+	}
+
+	select {
+	case conn := <-handled:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("accepted connection was not handled")
+	}
+}
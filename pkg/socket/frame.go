@@ -0,0 +1,134 @@
+package socket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameHeaderSize is the length of the big-endian size prefix
+const FrameHeaderSize = 4
+
+// DefaultMaxFrameSize bounds a frame unless SetMaxFrameSize says otherwise
+const DefaultMaxFrameSize = 4 << 20
+
+// ErrFrameTooLarge is returned for frames above the configured limit
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// FrameReader reads length-prefixed frames: a 4-byte big-endian payload
+// size followed by the payload. Unlike newline delimiting, frames can carry
+// arbitrary binary data, and partial reads or several frames arriving in
+// one TCP segment are handled by the buffered reader it keeps for the
+// whole connection.
+type FrameReader struct {
+	reader  *bufio.Reader
+	maxSize int
+	buf     []byte
+}
+
+// NewFrameReader creates a FrameReader on r
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{
+		reader:  bufio.NewReader(r),
+		maxSize: DefaultMaxFrameSize,
+	}
+}
+
+// SetMaxFrameSize changes the largest payload ReadFrame accepts
+func (fr *FrameReader) SetMaxFrameSize(n int) {
+	fr.maxSize = n
+}
+
+// ReadFrame returns the next payload. The returned slice is reused by the
+// following call, so callers must copy anything they keep.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	var header [FrameHeaderSize]byte
+	if _, err := io.ReadFull(fr.reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(fr.maxSize) {
+		return nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, size, fr.maxSize)
+	}
+
+	if cap(fr.buf) < int(size) {
+		fr.buf = make([]byte, size)
+	}
+	fr.buf = fr.buf[:size]
+
+	if _, err := io.ReadFull(fr.reader, fr.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return fr.buf, nil
+}
+
+// ReadJSON reads one frame and unmarshals it into v
+func (fr *FrameReader) ReadJSON(v interface{}) error {
+	frame, err := fr.ReadFrame()
+	if err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("connection closed")
+		}
+		return fmt.Errorf("read error: %w", err)
+	}
+
+	if err := json.Unmarshal(frame, v); err != nil {
+		return fmt.Errorf("json unmarshal error: %w", err)
+	}
+	return nil
+}
+
+// FrameWriter writes length-prefixed frames. Header and payload go out in
+// a single Write so concurrent writers serialized by a mutex never
+// interleave partial frames.
+type FrameWriter struct {
+	writer  io.Writer
+	maxSize int
+	buf     []byte
+}
+
+// NewFrameWriter creates a FrameWriter on w
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{
+		writer:  w,
+		maxSize: DefaultMaxFrameSize,
+	}
+}
+
+// SetMaxFrameSize changes the largest payload WriteFrame accepts
+func (fw *FrameWriter) SetMaxFrameSize(n int) {
+	fw.maxSize = n
+}
+
+// WriteFrame writes payload as one frame
+func (fw *FrameWriter) WriteFrame(payload []byte) error {
+	if len(payload) > fw.maxSize {
+		return fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, len(payload), fw.maxSize)
+	}
+
+	fw.buf = binary.BigEndian.AppendUint32(fw.buf[:0], uint32(len(payload)))
+	fw.buf = append(fw.buf, payload...)
+
+	_, err := fw.writer.Write(fw.buf)
+	return err
+}
+
+// WriteJSON marshals v and writes it as one frame
+func (fw *FrameWriter) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("json marshal error: %w", err)
+	}
+
+	if err := fw.WriteFrame(data); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+	return nil
+}
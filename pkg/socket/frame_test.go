@@ -0,0 +1,184 @@
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// chunkReader returns at most the next chunk size of bytes per Read, as a
+// TCP connection does when a frame arrives split across segments
+type chunkReader struct {
+	data   []byte
+	chunks []int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := len(r.data)
+	if len(r.chunks) > 0 {
+		n = r.chunks[0]
+		r.chunks = r.chunks[1:]
+		if n <= 0 || n > len(r.data) {
+			n = len(r.data)
+		}
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// splitPayloads cuts data into payloads at the given sizes
+func splitPayloads(data []byte, sizes []byte) [][]byte {
+	var payloads [][]byte
+	for _, size := range sizes {
+		n := int(size)
+		if n > len(data) {
+			n = len(data)
+		}
+		payloads = append(payloads, data[:n])
+		data = data[n:]
+	}
+	return append(payloads, data)
+}
+
+// FuzzFrameReader writes payloads with FrameWriter and reads them back
+// from a stream delivered in arbitrary pieces: split inside headers and
+// payloads, or several frames coalesced into one read
+func FuzzFrameReader(f *testing.F) {
+	f.Add([]byte("hello world"), []byte{3, 0, 5}, []byte{1, 1, 1, 2})
+	f.Add([]byte{}, []byte{}, []byte{})
+	f.Add(bytes.Repeat([]byte{0xff}, 300), []byte{255, 10}, []byte{2, 200, 0})
+
+	f.Fuzz(func(t *testing.T, data, sizes, chunks []byte) {
+		payloads := splitPayloads(data, sizes)
+
+		var stream bytes.Buffer
+		writer := NewFrameWriter(&stream)
+		for _, payload := range payloads {
+			if err := writer.WriteFrame(payload); err != nil {
+				t.Fatalf("WriteFrame: %v", err)
+			}
+		}
+
+		pieces := make([]int, len(chunks))
+		for i, c := range chunks {
+			pieces[i] = int(c)
+		}
+		for _, src := range []io.Reader{
+			&chunkReader{data: stream.Bytes(), chunks: pieces}, // split
+			bytes.NewReader(stream.Bytes()),                    // coalesced
+		} {
+			reader := NewFrameReader(src)
+			for i, want := range payloads {
+				got, err := reader.ReadFrame()
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("frame %d = %q, want %q", i, got, want)
+				}
+			}
+			if _, err := reader.ReadFrame(); err != io.EOF {
+				t.Fatalf("after the last frame: %v, want EOF", err)
+			}
+		}
+
+		// Arbitrary input must fail cleanly, never panic or over-allocate
+		reader := NewFrameReader(bytes.NewReader(data))
+		reader.SetMaxFrameSize(1 << 10)
+		for {
+			if _, err := reader.ReadFrame(); err != nil {
+				break
+			}
+		}
+	})
+}
+
+func TestFrameReaderRejectsOversizedFrame(t *testing.T) {
+	var header [FrameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], 1<<20)
+
+	reader := NewFrameReader(bytes.NewReader(header[:]))
+	reader.SetMaxFrameSize(1 << 10)
+	if _, err := reader.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("ReadFrame = %v, want ErrFrameTooLarge", err)
+	}
+
+	writer := NewFrameWriter(io.Discard)
+	writer.SetMaxFrameSize(4)
+	if err := writer.WriteFrame([]byte("12345")); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("WriteFrame = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestFrameReaderTruncatedPayload(t *testing.T) {
+	var stream bytes.Buffer
+	NewFrameWriter(&stream).WriteFrame([]byte("truncated"))
+
+	reader := NewFrameReader(bytes.NewReader(stream.Bytes()[:stream.Len()-1]))
+	if _, err := reader.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadFrame = %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestFrameJSONRoundTrip(t *testing.T) {
+	type message struct {
+		Text string
+		N    int
+	}
+
+	var stream bytes.Buffer
+	writer := NewFrameWriter(&stream)
+	want := []message{{"a\nb", 1}, {"", 2}}
+	for _, m := range want {
+		if err := writer.WriteJSON(m); err != nil {
+			t.Fatalf("WriteJSON: %v", err)
+		}
+	}
+
+	reader := NewFrameReader(&stream)
+	for _, w := range want {
+		var got message
+		if err := reader.ReadJSON(&got); err != nil || got != w {
+			t.Fatalf("ReadJSON = %+v, %v; want %+v", got, err, w)
+		}
+	}
+}
+
+func TestReadJSONKeepsBufferedMessages(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		// Both messages in one write
+		client.Write([]byte("{\"n\":1}\n{\"n\":2}\n{\"n\""))
+		client.Close()
+	}()
+
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(server)
+	for want := 1; want <= 2; want++ {
+		var got struct{ N int }
+		if err := ReadJSON(reader, &got); err != nil || got.N != want {
+			t.Fatalf("ReadJSON = %+v, %v; want %d", got, err, want)
+		}
+	}
+
+	var rest struct{ N int }
+	err := ReadJSON(reader, &rest)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("ReadJSON of a partial message = %v, want unexpected EOF", err)
+	}
+}
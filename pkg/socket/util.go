@@ -9,11 +9,15 @@ import (
 )
 
 // ReadJSON reads a JSON message from the connection
-// It expects a newline-delimited JSON message
-func ReadJSON(conn net.Conn, v interface{}) error {
-	reader := bufio.NewReader(conn)
-	line, err := reader.ReadBytes('\n')
+// It expects a newline-delimited JSON message. r must wrap the connection
+// for its whole lifetime, since it may buffer the start of the next
+// message; prefer FrameReader for anything beyond simple demos.
+func ReadJSON(r *bufio.Reader, v interface{}) error {
+	line, err := r.ReadBytes('\n')
 	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
 		if err == io.EOF {
 			return fmt.Errorf("connection closed")
 		}
@@ -132,7 +132,7 @@ else
 fi
 
 info "Testing 02_simple_rpc server can compile..."
-if go build -o /tmp/simple_rpc_server cmd/02_simple_rpc/server/main.go; then
+if go build -o /tmp/simple_rpc_server ./cmd/02_simple_rpc/server; then
     success "Simple RPC server compiles successfully"
     rm /tmp/simple_rpc_server
 else